@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maintenanceRetryAfter is the Retry-After hint, in seconds, sent with
+// bootstrap rejections while maintenance mode is on.
+const maintenanceRetryAfter = 60
+
+func (s *AppState) handleEnableMaintenance(c *gin.Context) {
+	s.maintenance.Store(true)
+	log.Printf("Maintenance mode enabled, new registrations are rejected")
+	c.JSON(http.StatusOK, gin.H{"maintenance": true})
+}
+
+func (s *AppState) handleDisableMaintenance(c *gin.Context) {
+	s.maintenance.Store(false)
+	log.Printf("Maintenance mode disabled")
+	c.JSON(http.StatusOK, gin.H{"maintenance": false})
+}
+
+// rejectDuringMaintenance aborts the request with 503 while maintenance mode
+// is on. It is applied to write paths only; read endpoints keep working.
+func (s *AppState) rejectDuringMaintenance(c *gin.Context) {
+	if !s.maintenance.Load() {
+		c.Next()
+		return
+	}
+
+	c.Header("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+	c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is in maintenance mode"})
+	c.Abort()
+}
+
+// isOperator reports whether the request carries the operator token. It is
+// false for everyone when no token is configured.
+func (s *AppState) isOperator(c *gin.Context) bool {
+	if s.config.OperatorToken == "" {
+		return false
+	}
+	token := c.GetHeader("X-Operator-Token")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.OperatorToken)) == 1
+}
+
+// requireOperator rejects admin requests without a matching X-Operator-Token
+// header. It runs in addition to the app id check, so tenants that are
+// allowed to bootstrap cannot perform operator actions. Without
+// OPERATOR_TOKEN every admin request is rejected.
+func (s *AppState) requireOperator(c *gin.Context) {
+	if s.config.OperatorToken == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin endpoints are disabled, OPERATOR_TOKEN is not set"})
+		c.Abort()
+		return
+	}
+
+	if !s.isOperator(c) {
+		log.Printf("Rejected %s %s from %s: missing or invalid operator token", c.Request.Method, c.Request.URL.Path, c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"error": "Operator token required"})
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
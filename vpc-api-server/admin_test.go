@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+const testOperatorToken = "operator-secret"
+
+// newOperatorRequest returns a request from testAppID carrying the operator
+// token.
+func newOperatorRequest(method, target string) *http.Request {
+	req := newRequest(method, target)
+	req.Header.Set("X-Operator-Token", testOperatorToken)
+	return req
+}
+
+func TestMaintenanceBlocksBootstrapOnly(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+
+	if w := serve(r, newOperatorRequest("POST", "/api/maintenance")); w.Code != http.StatusOK {
+		t.Fatalf("enabling maintenance: got status %d: %s", w.Code, w.Body)
+	}
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1"))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("bootstrap during maintenance: got status %d, want 503", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("bootstrap during maintenance: missing Retry-After")
+	}
+	if w := serve(r, newRequest("GET", "/api/nodes")); w.Code != http.StatusOK {
+		t.Errorf("listing nodes during maintenance: got status %d, want 200", w.Code)
+	}
+	if w := serve(r, newRequest("GET", "/api/nodes/ips?node_type=mongodb&port=27017")); w.Code != http.StatusOK {
+		t.Errorf("listing node IPs during maintenance: got status %d, want 200", w.Code)
+	}
+
+	if w := serve(r, newOperatorRequest("DELETE", "/api/maintenance")); w.Code != http.StatusOK {
+		t.Fatalf("disabling maintenance: got status %d: %s", w.Code, w.Body)
+	}
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1")); w.Code != http.StatusOK {
+		t.Errorf("bootstrap after maintenance: got status %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+// adminRoutes lists one request per operator-only route.
+var adminRoutes = []struct{ method, target string }{
+	{"DELETE", "/api/nodes?node_type=mongodb"},
+	{"POST", "/api/nodes/rekey"},
+	{"POST", "/api/nodes/n1/expire"},
+	{"POST", "/api/nodes/n1/drain"},
+	{"POST", "/api/nodes/n1/undrain"},
+	{"POST", "/api/nodes/n1/retire"},
+	{"GET", "/api/nodes/n1/retire"},
+	{"POST", "/api/nodes/n1/routes"},
+	{"GET", "/api/debug/headscale/nodes"},
+	{"GET", "/api/preauthkeys"},
+	{"POST", "/api/keyfile/rotate"},
+	{"POST", "/api/maintenance"},
+	{"DELETE", "/api/maintenance"},
+}
+
+func TestAdminRoutesRequireOperatorToken(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+
+	for _, route := range adminRoutes {
+		if w := serve(r, newRequest(route.method, route.target)); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s without token: got status %d, want 403", route.method, route.target, w.Code)
+		}
+
+		req := newRequest(route.method, route.target)
+		req.Header.Set("X-Operator-Token", "wrong")
+		if w := serve(r, req); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with wrong token: got status %d, want 403", route.method, route.target, w.Code)
+		}
+
+		if w := serve(r, newOperatorRequest(route.method, route.target)); w.Code == http.StatusForbidden {
+			t.Errorf("%s %s with token: got status 403: %s", route.method, route.target, w.Body)
+		}
+	}
+}
+
+func TestAdminRoutesDisabledWithoutOperatorToken(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	for _, route := range adminRoutes {
+		if w := serve(r, newRequest(route.method, route.target)); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: got status %d, want 403", route.method, route.target, w.Code)
+		}
+		if w := serve(r, newOperatorRequest(route.method, route.target)); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s with a token: got status %d, want 403", route.method, route.target, w.Code)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import "fmt"
+
+// parseNodeTypeAliases parses NODE_TYPE_ALIASES, e.g. "app=service", mapping
+// old node type names to the allowed type that replaced them.
+func parseNodeTypeAliases(list string, allowedTypes []string) (map[string]string, error) {
+	entries, err := parseKeyValueList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool, len(allowedTypes))
+	for _, nodeType := range allowedTypes {
+		allowed[nodeType] = true
+	}
+
+	for alias, canonical := range entries {
+		if allowed[alias] {
+			return nil, fmt.Errorf("alias %q is itself an allowed node type", alias)
+		}
+		if !allowed[canonical] {
+			return nil, fmt.Errorf("alias %q points to unknown node type %q", alias, canonical)
+		}
+	}
+	return entries, nil
+}
+
+// canonicalNodeType resolves a NODE_TYPE_ALIASES alias to the node type it
+// stands for; other values are returned unchanged.
+func (s *AppState) canonicalNodeType(nodeType string) string {
+	if canonical, ok := s.config.NodeTypeAliases[nodeType]; ok {
+		return canonical
+	}
+	return nodeType
+}
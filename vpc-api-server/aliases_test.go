@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseNodeTypeAliases(t *testing.T) {
+	aliases, err := parseNodeTypeAliases("db=mongodb, service=app", []string{"mongodb", "app"})
+	if err != nil {
+		t.Fatalf("parseNodeTypeAliases failed: %v", err)
+	}
+	if want := map[string]string{"db": "mongodb", "service": "app"}; !reflect.DeepEqual(aliases, want) {
+		t.Errorf("got %v, want %v", aliases, want)
+	}
+
+	for _, list := range []string{"app=mongodb", "db=redis", "db"} {
+		if _, err := parseNodeTypeAliases(list, []string{"mongodb", "app"}); err == nil {
+			t.Errorf("parseNodeTypeAliases(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestRegisterResolvesNodeTypeAlias(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.NodeTypeAliases = map[string]string{"db": "mongodb"} })
+	addTestNode(state, hs, NodeInfo{UUID: "i0", Name: "app-1", NodeType: "app"})
+
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_type=db")); w.Code != http.StatusOK {
+		t.Fatalf("register: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	node, ok := state.storedNode("i1")
+	if !ok || node.NodeType != "mongodb" {
+		t.Errorf("got node %+v, want node type mongodb", node)
+	}
+
+	w := serve(r, newRequest("GET", "/api/nodes?node_type=db"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp NodesResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if len(resp.Nodes) != 1 || resp.Nodes[0].UUID != "i1" {
+		t.Errorf("got nodes %+v, want only i1", resp.Nodes)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// parseNodeTypeAppACL parses NODE_TYPE_APP_ACL, e.g.
+// "mongodb=app-a|app-b,app=any". Entries use the ALLOWED_APPS syntax
+// (exact ids, path.Match globs or "any") separated by '|'.
+func parseNodeTypeAppACL(list string, allowedTypes []string) (map[string][]string, error) {
+	entries, err := parseKeyValueList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool, len(allowedTypes))
+	for _, nodeType := range allowedTypes {
+		allowed[nodeType] = true
+	}
+
+	acl := make(map[string][]string, len(entries))
+	for nodeType, value := range entries {
+		if !allowed[nodeType] {
+			return nil, fmt.Errorf("unknown node type %q", nodeType)
+		}
+		apps := []string{}
+		for _, app := range strings.Split(value, "|") {
+			app = strings.TrimSpace(app)
+			if app == "" {
+				continue
+			}
+			if _, err := path.Match(app, ""); err != nil {
+				return nil, fmt.Errorf("invalid app pattern %q for node type %s: %w", app, nodeType, err)
+			}
+			apps = append(apps, app)
+		}
+		acl[nodeType] = apps
+	}
+	return acl, nil
+}
+
+// matchAppID reports whether appID matches any of patterns.
+func matchAppID(patterns []string, appID string) bool {
+	for _, allowed := range patterns {
+		if allowed == "any" || allowed == appID {
+			return true
+		}
+		if matched, _ := path.Match(allowed, appID); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isAppAllowedForType applies the NODE_TYPE_APP_ACL rule for nodeType on top
+// of ALLOWED_APPS. Node types without a rule allow every app ALLOWED_APPS
+// does.
+func (s *AppState) isAppAllowedForType(appID, nodeType string) bool {
+	apps, ok := s.config.NodeTypeAppACL[nodeType]
+	if !ok {
+		return true
+	}
+	return matchAppID(apps, appID)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseAllowedAppsDropsInvalidPatterns(t *testing.T) {
+	got := parseAllowedApps("app-a, myorg-*, bad[, ,app-?")
+	if want := []string{"app-a", "myorg-*", "app-?"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAllowedAppWildcards(t *testing.T) {
+	newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.AllowedApps = parseAllowedApps("app-a,myorg-*") })
+
+	for _, tc := range []struct {
+		appID    string
+		allowed  bool
+		attested bool
+	}{
+		{"app-a", true, true},
+		{"myorg-web", true, false},
+		{"myorg-", true, false},
+		{"other-web", false, false},
+		{"app-ab", false, false},
+	} {
+		req := newRequest("GET", "/api/nodes")
+		req.Header.Set("x-dstack-app-id", tc.appID)
+		w := serve(r, req)
+		if tc.allowed && w.Code != http.StatusOK {
+			t.Errorf("app %q: got status %d, want 200", tc.appID, w.Code)
+		}
+		if !tc.allowed && w.Code != http.StatusForbidden {
+			t.Errorf("app %q: got status %d, want 403", tc.appID, w.Code)
+		}
+		if got := state.isAppAttested(tc.appID); got != tc.attested {
+			t.Errorf("isAppAttested(%q) = %v, want %v", tc.appID, got, tc.attested)
+		}
+	}
+}
+
+func TestParseNodeTypeAppACL(t *testing.T) {
+	acl, err := parseNodeTypeAppACL("mongodb=app-a|myorg-*, app=any", []string{"mongodb", "app"})
+	if err != nil {
+		t.Fatalf("parseNodeTypeAppACL failed: %v", err)
+	}
+	want := map[string][]string{"mongodb": {"app-a", "myorg-*"}, "app": {"any"}}
+	if !reflect.DeepEqual(acl, want) {
+		t.Errorf("got %v, want %v", acl, want)
+	}
+
+	for _, list := range []string{"redis=app-a", "mongodb=bad[", "mongodb"} {
+		if _, err := parseNodeTypeAppACL(list, []string{"mongodb", "app"}); err == nil {
+			t.Errorf("parseNodeTypeAppACL(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestRegisterNodeTypeAppACL(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) {
+		c.NodeTypeAppACL = map[string][]string{"mongodb": {"app-a"}}
+	})
+
+	register := func(appID, nodeType string) *httptest.ResponseRecorder {
+		req := newRequest("GET", "/api/register?instance_id=i-"+appID+"-"+nodeType+"&node_type="+nodeType)
+		req.Header.Set("x-dstack-app-id", appID)
+		return serve(r, req)
+	}
+
+	if w := register("app-a", "mongodb"); w.Code != http.StatusOK {
+		t.Errorf("app-a bootstrapping mongodb: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	w := register("app-b", "mongodb")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("app-b bootstrapping mongodb: got status %d, want 403", w.Code)
+	}
+	var resp struct {
+		Code string `json:"code"`
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp.Code != "node_type_not_allowed" {
+		t.Errorf("got code %q, want node_type_not_allowed", resp.Code)
+	}
+	if w := register("app-b", "app"); w.Code != http.StatusOK {
+		t.Errorf("app-b bootstrapping a type without a rule: got status %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestListOnlyVerifiedNodes(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.AllowedApps = parseAllowedApps("app-a,myorg-*") })
+	bootstrapNode(t, r, "app-a", "instance_id=i1&node_name=n1")
+	bootstrapNode(t, r, "myorg-web", "instance_id=i2&node_name=n2")
+
+	for _, tc := range []struct {
+		query string
+		want  map[string]bool
+	}{
+		{"", map[string]bool{"n1": true, "n2": false}},
+		{"?only_verified=true", map[string]bool{"n1": true}},
+	} {
+		var resp NodesResponse
+		decodeJSON(t, serve(r, newRequest("GET", "/api/nodes"+tc.query)).Body.Bytes(), &resp)
+		got := map[string]bool{}
+		for _, node := range resp.Nodes {
+			got[node.Name] = node.Verified
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got verified %v, want %v", tc.query, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audit outcomes, derived from the response status.
+const (
+	auditSuccess  = "success"
+	auditRejected = "rejected"
+	auditError    = "error"
+)
+
+// Audit event kinds.
+const (
+	auditEventBootstrap = "bootstrap"
+	auditEventKeyfile   = "keyfile"
+)
+
+// AuditEntry is one newline-delimited JSON record of a bootstrap attempt or
+// keyfile retrieval.
+type AuditEntry struct {
+	Timestamp  string `json:"timestamp"`
+	Event      string `json:"event"`
+	AppID      string `json:"app_id"`
+	InstanceID string `json:"instance_id"`
+	NodeType   string `json:"node_type"`
+	NodeName   string `json:"node_name"`
+	Outcome    string `json:"outcome"`
+	Status     int    `json:"status"`
+	ClientIP   string `json:"client_ip"`
+}
+
+// auditLogger appends audit entries to a file or stdout. Writes are
+// serialized so concurrent entries never interleave.
+type auditLogger struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// newAuditLogger opens path for appending, or writes to stdout when path is
+// empty or "-".
+func newAuditLogger(path string) (*auditLogger, error) {
+	if path == "" || path == "-" {
+		return &auditLogger{w: os.Stdout}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %w", path, err)
+	}
+	return &auditLogger{w: f}, nil
+}
+
+// record writes entry to the audit log. A failed write is logged rather than
+// failing the request it describes.
+func (a *auditLogger) record(entry AuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("ERROR: failed to encode audit entry: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, err := a.w.Write(line); err != nil {
+		log.Printf("ERROR: failed to write audit log: %v (entry: %s)", err, line)
+	}
+}
+
+// auditBootstrap records every /api/register attempt, including ones
+// rejected by authentication or validation. It must run before the auth
+// middleware so aborted requests are still recorded.
+func (s *AppState) auditBootstrap(c *gin.Context) {
+	if c.FullPath() != "/api/register" {
+		c.Next()
+		return
+	}
+
+	c.Next()
+
+	status := c.Writer.Status()
+	outcome := auditSuccess
+	switch {
+	case status >= 500:
+		outcome = auditError
+	case status >= 400:
+		outcome = auditRejected
+	}
+
+	// The handler stores the resolved values; fall back to what was asked.
+	nodeType := c.GetString("node_type")
+	if nodeType == "" {
+		nodeType = c.Query("node_type")
+	}
+	nodeName := c.GetString("node_name")
+	if nodeName == "" {
+		nodeName = c.Query("node_name")
+	}
+
+	s.audit.record(AuditEntry{
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Event:      auditEventBootstrap,
+		AppID:      c.GetHeader("x-dstack-app-id"),
+		InstanceID: c.Query("instance_id"),
+		NodeType:   nodeType,
+		NodeName:   logName(nodeName),
+		Outcome:    outcome,
+		Status:     status,
+		ClientIP:   c.ClientIP(),
+	})
+}
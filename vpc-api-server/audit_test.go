@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// auditEntries decodes the entries written to buf.
+func auditEntries(t *testing.T, buf *bytes.Buffer) []AuditEntry {
+	t.Helper()
+	var entries []AuditEntry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry AuditEntry
+		decodeJSON(t, []byte(line), &entry)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditBootstrapOutcomes(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.AllowedApps = []string{testAppID} })
+	var buf bytes.Buffer
+	state.audit = &auditLogger{w: &buf}
+
+	bootstrapNode(t, r, testAppID, "instance_id=i1&node_type=mongodb")
+
+	req := newRequest("GET", "/api/register?instance_id=i2")
+	req.Header.Set("x-dstack-app-id", "app-x")
+	serve(r, req)
+
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/preauthkey" {
+			return false
+		}
+		writeFakeJSON(w, http.StatusInternalServerError, map[string]any{"message": "database is locked"})
+		return true
+	})
+	serve(r, newRequest("GET", "/api/register?instance_id=i3&node_name=n3"))
+
+	serve(r, newRequest("GET", "/api/nodes"))
+	serve(r, newRequest("GET", "/api/keyfile?node_type=mongodb&instance_id=i1"))
+
+	entries := auditEntries(t, &buf)
+	if len(entries) != 4 {
+		t.Fatalf("got %d audit entries, want 4: %+v", len(entries), entries)
+	}
+	for i, want := range []AuditEntry{
+		{Event: auditEventBootstrap, AppID: testAppID, InstanceID: "i1", NodeType: "mongodb", NodeName: "node-i1", Outcome: auditSuccess, Status: http.StatusOK},
+		{Event: auditEventBootstrap, AppID: "app-x", InstanceID: "i2", Outcome: auditRejected, Status: http.StatusForbidden},
+		{Event: auditEventBootstrap, AppID: testAppID, InstanceID: "i3", NodeName: "n3", Outcome: auditError, Status: http.StatusInternalServerError},
+		{Event: auditEventKeyfile, AppID: testAppID, InstanceID: "i1", NodeType: "mongodb", Outcome: auditSuccess, Status: http.StatusOK},
+	} {
+		got := entries[i]
+		if got.Timestamp == "" || got.ClientIP == "" {
+			t.Errorf("entry %d has no timestamp or client IP: %+v", i, got)
+		}
+		got.Timestamp, got.ClientIP = "", ""
+		if got != want {
+			t.Errorf("entry %d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestAuditLogAppendsToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	audit, err := newAuditLogger(path)
+	if err != nil {
+		t.Fatalf("newAuditLogger: %v", err)
+	}
+	audit.record(AuditEntry{Event: auditEventBootstrap, AppID: testAppID})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var entry AuditEntry
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &entry) != nil || entry.AppID != testAppID {
+		t.Errorf("got audit log %q, want the entry appended", data)
+	}
+}
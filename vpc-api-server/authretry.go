@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authRetryTransport retries a request once when Headscale answers 401,
+// with the API key read again. getAPIKey re-reads the key file on every
+// call, so a request that raced an operator rotating the key goes through
+// with the new key instead of failing.
+type authRetryTransport struct {
+	next http.RoundTripper
+}
+
+func (t *authRetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Header.Get("Authorization") == "" {
+		return resp, err
+	}
+	// A body that can't be replayed can't be retried.
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return resp, nil
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	retry.Header.Set("Authorization", "Bearer "+apiKey)
+	resp.Body.Close()
+
+	log.Printf("Headscale returned 401 for %s %s, retrying with the API key reloaded", req.Method, req.URL.Path)
+	return t.next.RoundTrip(retry)
+}
+
+// headscaleAuthRotating reports whether err is a 401 that persisted after
+// authRetryTransport reloaded the key, most likely because the key is being
+// rotated.
+func headscaleAuthRotating(err error) bool {
+	return headscaleAPIStatus(err) == http.StatusUnauthorized
+}
+
+// bootstrapErrorBody adds a code to Headscale errors a bootstrapping client
+// should retry rather than treat as a failure.
+func bootstrapErrorBody(err error, message string) gin.H {
+	body := gin.H{"error": message}
+	if headscaleAuthRotating(err) {
+		body["code"] = "headscale_auth_rotating"
+	}
+	return body
+}
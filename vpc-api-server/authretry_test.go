@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAuthRetryReloadsKey(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	var rejected atomic.Bool
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		// The first request races a rotation and carries the old key.
+		if rejected.CompareAndSwap(false, true) {
+			writeFakeJSON(w, http.StatusUnauthorized, map[string]any{"message": "Unauthorized"})
+			return true
+		}
+		return false
+	})
+
+	if _, err := getHeadscaleNodes(context.Background()); err != nil {
+		t.Fatalf("listing nodes: %v", err)
+	}
+	reqs := hs.requestsTo("GET", "/api/v1/node")
+	if len(reqs) != 2 {
+		t.Fatalf("sent %d requests, want the original and one retry", len(reqs))
+	}
+	if got := reqs[1].Header.Get("Authorization"); got != "Bearer "+fakeAPIKey {
+		t.Errorf("retry Authorization = %q", got)
+	}
+}
+
+func TestBootstrapDuringKeyRotation(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	hs.apiKey = "rotated-key"
+	_, r := newTestServer(t, nil)
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1"))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Code string `json:"code"`
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp.Code != "headscale_auth_rotating" {
+		t.Errorf("got code %q, want headscale_auth_rotating", resp.Code)
+	}
+
+	t.Setenv("HEADSCALE_API_KEY", "rotated-key")
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1")); w.Code != http.StatusOK {
+		t.Errorf("after the rotation: got status %d, want 200: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// errHeadscaleServerError marks a 5xx response as a failure for the breaker
+// without turning it into a transport error for the caller.
+var errHeadscaleServerError = errors.New("headscale server error")
+
+var headscaleBreaker *gobreaker.CircuitBreaker
+
+// headscaleClient is used for all Headscale API calls. It fails fast while
+// the circuit breaker is open and carries the caller's trace context.
+var headscaleClient *http.Client
+
+// newHeadscaleBreaker opens after maxFailures consecutive failed calls and
+// lets a single probe through once openTimeout has passed.
+func newHeadscaleBreaker(maxFailures uint32, openTimeout time.Duration) *gobreaker.CircuitBreaker {
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:    "headscale",
+		Timeout: openTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= maxFailures
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			log.Printf("Circuit breaker %s changed from %s to %s", name, from, to)
+		},
+	})
+}
+
+// newHeadscaleClient layers, from the outside in: tracing, the concurrency
+// limit, the circuit breaker, and a retry on 401 with the key reloaded.
+func newHeadscaleClient(breaker *gobreaker.CircuitBreaker, maxConcurrency int, queueTimeout time.Duration, extraHeaders map[string]string) *http.Client {
+	var transport http.RoundTripper = &breakerTransport{
+		next:    &authRetryTransport{next: &headerTransport{next: http.DefaultTransport, headers: extraHeaders}},
+		breaker: breaker,
+	}
+	transport = newLimitTransport(transport, maxConcurrency, queueTimeout)
+	return &http.Client{Transport: otelhttp.NewTransport(transport)}
+}
+
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *gobreaker.CircuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	result, err := t.breaker.Execute(func() (interface{}, error) {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 500 {
+			return resp, errHeadscaleServerError
+		}
+		return resp, nil
+	})
+	if err != nil && !errors.Is(err, errHeadscaleServerError) {
+		return nil, err
+	}
+	return result.(*http.Response), nil
+}
+
+// isHeadscaleUnavailable reports whether err comes from the breaker or the
+// concurrency limit refusing the call, so handlers can answer 503 instead
+// of 500.
+func isHeadscaleUnavailable(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) ||
+		errors.Is(err, gobreaker.ErrTooManyRequests) ||
+		errors.Is(err, errHeadscaleBusy)
+}
+
+// headscaleErrorStatus maps an error from a Headscale helper to the status
+// code handlers should respond with. Other failures are server errors rather
+// than the client's; a 401 that survived a key reload usually means the key
+// is being rotated, so clients are told to retry.
+func headscaleErrorStatus(err error) int {
+	if isHeadscaleUnavailable(err) || headscaleAuthRotating(err) {
+		return http.StatusServiceUnavailable
+	}
+	switch headscaleAPIStatus(err) {
+	case http.StatusNotFound:
+		return http.StatusNotFound
+	case http.StatusTooManyRequests:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
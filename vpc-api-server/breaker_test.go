@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/sony/gobreaker"
+)
+
+func TestBreakerOpensAndFailsFast(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		writeFakeJSON(w, http.StatusInternalServerError, map[string]any{"message": "database is locked"})
+		return true
+	})
+
+	for i := 0; i < 5; i++ {
+		_, err := getHeadscaleNodes(context.Background())
+		if headscaleAPIStatus(err) != http.StatusInternalServerError {
+			t.Fatalf("call %d: got %v, want the 500 passed through", i+1, err)
+		}
+	}
+
+	calls := len(hs.requestsTo("GET", "/api/v1/node"))
+	_, err := getHeadscaleNodes(context.Background())
+	if !errors.Is(err, gobreaker.ErrOpenState) {
+		t.Fatalf("got %v, want the breaker open", err)
+	}
+	if n := len(hs.requestsTo("GET", "/api/v1/node")); n != calls {
+		t.Errorf("open breaker still called Headscale")
+	}
+
+	if w := serve(r, newRequest("GET", "/api/nodes/ips?node_type=mongodb&port=27017")); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler with the breaker open: got status %d, want 503", w.Code)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cacheControl is "no-cache" without a max age, so clients revalidate with
+// If-None-Match on every request.
+func cacheControl(maxAge time.Duration) string {
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("private, max-age=%d", int(maxAge.Seconds()))
+}
+
+// etagMatches reports whether an If-None-Match header lists etag. Weak
+// validators compare equal to strong ones, as RFC 9110 asks for GET.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// respondCacheable is respondNegotiated with Cache-Control and an ETag over
+// the encoded body, answering 304 when If-None-Match already has it.
+func respondCacheable(c *gin.Context, maxAge time.Duration, obj any) {
+	var contentType string
+	var data []byte
+	var err error
+	switch negotiateFormat(c.GetHeader("Accept")) {
+	case gin.MIMEJSON:
+		contentType = gin.MIMEJSON + "; charset=utf-8"
+		data, err = json.Marshal(obj)
+	case mimeYAML:
+		contentType = mimeYAML + "; charset=utf-8"
+		data, err = toYAML(obj)
+	default:
+		// Let respondNegotiated write the 406.
+		respondNegotiated(c, http.StatusOK, obj)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", cacheControl(maxAge))
+	c.Header("Vary", "Accept")
+
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
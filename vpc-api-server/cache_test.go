@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListNodesCacheHeaders(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.NodesCacheMaxAge = 30 * time.Second })
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+
+	w := serve(r, newRequest("GET", "/api/nodes"))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got status %d and ETag %q", w.Code, etag)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "private, max-age=30" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+
+	req := newRequest("GET", "/api/nodes")
+	req.Header.Set("If-None-Match", `W/`+etag)
+	if w := serve(r, req); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match: got status %d with %d bytes, want an empty 304", w.Code, w.Body.Len())
+	}
+
+	hs.updateNodes("mongo-1", func(node *HeadscaleNode) { node.Online = false })
+	req = newRequest("GET", "/api/nodes")
+	req.Header.Set("If-None-Match", etag)
+	w = serve(r, req)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after a change: got status %d with ETag %q, want 200 and a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		writeFakeJSON(w, http.StatusBadGateway, map[string]any{"message": "down"})
+		return true
+	})
+	w = serve(r, newRequest("GET", "/api/nodes"))
+	if w.Header().Get("X-Data-Stale") != "true" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("stale listing: got X-Data-Stale %q and Cache-Control %q, want true and no-cache", w.Header().Get("X-Data-Stale"), w.Header().Get("Cache-Control"))
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// buildVersion is set at build time with
+// -ldflags "-X main.buildVersion=<version>".
+var buildVersion = "dev"
+
+// ConfigResponse is the non-secret part of the server configuration, for
+// clients to check they are talking to the server they expect.
+type ConfigResponse struct {
+	Environment      string   `json:"environment"`
+	ServerUrl        string   `json:"server_url"`
+	AllowedNodeTypes []string `json:"allowed_node_types"`
+	DefaultNodeType  string   `json:"default_node_type"`
+	Maintenance      bool     `json:"maintenance"`
+}
+
+func (s *AppState) handleConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, ConfigResponse{
+		Environment:      s.config.Environment,
+		ServerUrl:        s.ServerUrl,
+		AllowedNodeTypes: s.config.AllowedNodeTypes,
+		DefaultNodeType:  s.config.DefaultNodeType,
+		Maintenance:      s.maintenance.Load(),
+	})
+}
+
+type VersionResponse struct {
+	Version     string `json:"version"`
+	Environment string `json:"environment"`
+}
+
+func (s *AppState) handleVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, VersionResponse{Version: buildVersion, Environment: s.config.Environment})
+}
+
+// environmentHeader sets X-Environment on every response, including
+// rejected ones, so clients can fail fast when pointed at the wrong server.
+func environmentHeader(environment string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if environment != "" {
+			c.Header("X-Environment", environment)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersionReportsBuildAndEnvironment(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.Environment = "staging" })
+
+	prev := buildVersion
+	buildVersion = "v1.2.3"
+	t.Cleanup(func() { buildVersion = prev })
+
+	w := serve(r, newRequest("GET", "/version"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp VersionResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp != (VersionResponse{Version: "v1.2.3", Environment: "staging"}) {
+		t.Errorf("got %+v", resp)
+	}
+}
+
+func TestEnvironmentHeader(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.Environment = "staging" })
+
+	for name, req := range map[string]*http.Request{
+		"config":     newRequest("GET", "/api/config"),
+		"health":     httptest.NewRequest("GET", "/health", nil),
+		"rejected":   httptest.NewRequest("GET", "/api/nodes", nil),
+		"unmatched":  newRequest("GET", "/no-such-route"),
+		"validation": newRequest("POST", "/api/bootstrap/validate"),
+	} {
+		if got := serve(r, req).Header().Get("X-Environment"); got != "staging" {
+			t.Errorf("%s: X-Environment = %q, want staging", name, got)
+		}
+	}
+
+	_, r = newTestServer(t, nil)
+	if got := serve(r, newRequest("GET", "/api/config")).Header().Values("X-Environment"); len(got) != 0 {
+		t.Errorf("without ENVIRONMENT: got X-Environment %v, want none", got)
+	}
+}
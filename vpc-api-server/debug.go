@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleDebugHeadscaleNodes returns Headscale's /api/v1/node response as is,
+// status and body included, so operators can see what we parsed without
+// being handed the API key. Only the body and its content type are copied;
+// nothing from our request to Headscale is echoed back.
+func (s *AppState) handleDebugHeadscaleNodes(c *gin.Context) {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		log.Printf("Failed to read Headscale API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read Headscale API key"})
+		return
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), "GET", headscaleInternalURL+"/api/v1/node", nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to fetch raw Headscale nodes: %v", err)
+		c.JSON(headscaleErrorStatus(err), gin.H{"error": "Headscale API request failed"})
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Failed to read raw Headscale nodes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read Headscale response"})
+		return
+	}
+
+	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), body)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebugHeadscaleNodesIsRaw(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	raw := `{"nodes": [{"id": "7", "name": "n1", "somethingNew": {"x": 1}}]}`
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/api/v1/node" {
+			return false
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Echo-Auth", r.Header.Get("Authorization"))
+		w.Write([]byte(raw))
+		return true
+	})
+
+	w := serve(r, newOperatorRequest("GET", "/api/debug/headscale/nodes"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if w.Body.String() != raw {
+		t.Errorf("got body %s, want Headscale's response unmodified", w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", ct)
+	}
+	for name, values := range w.Header() {
+		if strings.Contains(strings.Join(values, " "), fakeAPIKey) {
+			t.Errorf("header %s leaks the Headscale API key", name)
+		}
+	}
+}
+
+func TestDebugHeadscaleNodesPassesErrorsThrough(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		writeFakeJSON(w, http.StatusForbidden, map[string]any{"message": "forbidden"})
+		return true
+	})
+
+	w := serve(r, newOperatorRequest("GET", "/api/debug/headscale/nodes"))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "forbidden") {
+		t.Errorf("got %d %s, want Headscale's 403 as is", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// HeadscaleAPIError is returned by the Headscale helpers for non-200
+// responses so callers can act on the status code.
+type HeadscaleAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HeadscaleAPIError) Error() string {
+	return fmt.Sprintf("headscale API returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// newHeadscaleAPIError reads the body of a failed response into an error.
+func newHeadscaleAPIError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized {
+		log.Printf("Warning: Headscale rejected the API key, check HEADSCALE_API_KEY or HEADSCALE_API_KEY_FILE")
+	}
+	return &HeadscaleAPIError{StatusCode: resp.StatusCode, Body: string(body)}
+}
+
+// headscaleAPIStatus returns the status code of a HeadscaleAPIError in
+// err's chain, or 0 if there is none.
+func headscaleAPIStatus(err error) int {
+	var apiErr *HeadscaleAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHeadscaleAPIStatusUnwraps(t *testing.T) {
+	err := fmt.Errorf("expiring node: %w", &HeadscaleAPIError{StatusCode: http.StatusNotFound, Body: "node not found"})
+	if got := headscaleAPIStatus(err); got != http.StatusNotFound {
+		t.Errorf("headscaleAPIStatus(wrapped 404) = %d, want 404", got)
+	}
+	if got := headscaleAPIStatus(fmt.Errorf("dial tcp: connection refused")); got != 0 {
+		t.Errorf("headscaleAPIStatus(network error) = %d, want 0", got)
+	}
+}
+
+func TestHeadscaleAPIErrorFromResponse(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		writeFakeJSON(w, http.StatusNotFound, map[string]any{"code": 5, "message": "node not found"})
+		return true
+	})
+
+	err := expireHeadscaleNode(context.Background(), "42")
+	if got := headscaleAPIStatus(err); got != http.StatusNotFound {
+		t.Fatalf("got status %d from %v, want 404", got, err)
+	}
+	if !strings.Contains(err.Error(), "node not found") {
+		t.Errorf("error %q does not carry the response body", err)
+	}
+}
+
+func TestHeadscaleErrorStatusInResponses(t *testing.T) {
+	for _, tc := range []struct {
+		headscale, want int
+	}{
+		{http.StatusNotFound, http.StatusNotFound},
+		{http.StatusTooManyRequests, http.StatusTooManyRequests},
+		{http.StatusBadRequest, http.StatusInternalServerError},
+		{http.StatusInternalServerError, http.StatusInternalServerError},
+	} {
+		hs := newFakeHeadscale(t)
+		state, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+		addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+		hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+			if !strings.HasSuffix(r.URL.Path, "/expire") {
+				return false
+			}
+			writeFakeJSON(w, tc.headscale, map[string]any{"message": "failed"})
+			return true
+		})
+
+		if w := serve(r, newOperatorRequest("POST", "/api/nodes/mongo-1/expire")); w.Code != tc.want {
+			t.Errorf("Headscale status %d: got status %d, want %d", tc.headscale, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// parseNodeTypeLifetimes parses NODE_TYPE_LIFETIMES, e.g. "app=2h".
+func parseNodeTypeLifetimes(list string, allowedTypes []string) (map[string]time.Duration, error) {
+	entries, err := parseKeyValueList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool, len(allowedTypes))
+	for _, nodeType := range allowedTypes {
+		allowed[nodeType] = true
+	}
+
+	lifetimes := make(map[string]time.Duration, len(entries))
+	for nodeType, value := range entries {
+		if !allowed[nodeType] {
+			return nil, fmt.Errorf("unknown node type %q", nodeType)
+		}
+		lifetime, err := time.ParseDuration(value)
+		if err != nil || lifetime <= 0 {
+			return nil, fmt.Errorf("invalid lifetime %q for node type %s", value, nodeType)
+		}
+		lifetimes[nodeType] = lifetime
+	}
+	return lifetimes, nil
+}
+
+// nodeExpired reports whether Headscale already considers the node expired.
+// Nodes that never expire have no expiry or the zero time.
+func nodeExpired(hsNode HeadscaleNode, now time.Time) bool {
+	return hsNode.Expiry != nil && !hsNode.Expiry.IsZero() && !hsNode.Expiry.After(now)
+}
+
+// expireOverdueNodes expires the Headscale session of every node that was
+// created longer ago than its node type's lifetime and isn't expired yet.
+// Registered nodes are typed by our record, others by their tags.
+func (s *AppState) expireOverdueNodes(ctx context.Context) (int, error) {
+	hsNodes, err := getHeadscaleNodes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	registeredTypes := make(map[string]string)
+	for _, node := range s.storedNodes() {
+		registeredTypes[node.Name] = node.NodeType
+	}
+
+	now := time.Now()
+	expired := 0
+	for _, hsNode := range hsNodes {
+		nodeType, ok := registeredTypes[hsNode.Name]
+		if !ok {
+			if nodeType = nodeTypeFromTags(hsNode.ValidTags); nodeType == "" {
+				nodeType = nodeTypeFromTags(hsNode.ForcedTags)
+			}
+		}
+		lifetime, ok := s.config.NodeTypeLifetimes[nodeType]
+		if !ok || hsNode.CreatedAt == nil || now.Sub(*hsNode.CreatedAt) < lifetime || nodeExpired(hsNode, now) {
+			continue
+		}
+
+		if err := expireHeadscaleNode(ctx, hsNode.ID); err != nil {
+			return expired, fmt.Errorf("failed to expire node %s (Headscale ID %s): %w", logName(hsNode.Name), hsNode.ID, err)
+		}
+		log.Printf("Expired node %s (Headscale ID %s), its %s lifetime of %s has passed", logName(hsNode.Name), hsNode.ID, nodeType, lifetime)
+		expired++
+	}
+	return expired, nil
+}
+
+// runNodeExpiry periodically enforces NODE_TYPE_LIFETIMES until ctx is
+// cancelled.
+func (s *AppState) runNodeExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		expired, err := s.expireOverdueNodes(ctx)
+		if err != nil {
+			log.Printf("Node expiry failed after expiring %d nodes: %v", expired, err)
+		}
+	}
+}
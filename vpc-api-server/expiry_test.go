@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExpireOverdueNodes(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, _ := newTestServer(t, func(c *Config) {
+		c.NodeTypeLifetimes = map[string]time.Duration{"app": time.Hour}
+	})
+	old, young := time.Now().Add(-2*time.Hour), time.Now().Add(-10*time.Minute)
+	expiredAt := time.Now().Add(-time.Minute)
+
+	overdue := addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "app-old", NodeType: "app"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "app-young", NodeType: "app"})
+	addTestNode(state, hs, NodeInfo{UUID: "i3", Name: "mongo-old", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i4", Name: "app-expired", NodeType: "app"})
+	tagged := hs.addNode(HeadscaleNode{Name: "unmanaged", ValidTags: []string{nodeTypeTag("app")}, CreatedAt: &old})
+	for name, created := range map[string]time.Time{"app-old": old, "app-young": young, "mongo-old": old, "app-expired": old} {
+		created := created
+		hs.updateNodes(name, func(node *HeadscaleNode) { node.CreatedAt = &created })
+	}
+	hs.updateNodes("app-expired", func(node *HeadscaleNode) { node.Expiry = &expiredAt })
+
+	expired, err := state.expireOverdueNodes(context.Background())
+	if err != nil {
+		t.Fatalf("expireOverdueNodes: %v", err)
+	}
+	if expired != 2 {
+		t.Errorf("expired %d nodes, want 2", expired)
+	}
+	for _, id := range []string{overdue.ID, tagged.ID} {
+		if n := len(hs.requestsTo("POST", "/api/v1/node/"+id+"/expire")); n != 1 {
+			t.Errorf("node %s expired %d times, want once", id, n)
+		}
+	}
+}
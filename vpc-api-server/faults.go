@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// faultInjection makes a fraction of bootstrap requests fail or stall, so
+// client retry handling can be exercised without breaking Headscale.
+type faultInjection struct {
+	errorRate float64
+	delayRate float64
+	delay     time.Duration
+}
+
+// parseFaultInjection parses FAULT_INJECTION, e.g.
+// "error=0.1,delay=0.2,delay_duration=3s". Rates are fractions in [0, 1].
+func parseFaultInjection(spec string) (*faultInjection, error) {
+	entries, err := parseKeyValueList(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &faultInjection{delay: 2 * time.Second}
+	for key, value := range entries {
+		switch key {
+		case "error", "delay":
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid %s rate %q, expected a number between 0 and 1", key, value)
+			}
+			if key == "error" {
+				f.errorRate = rate
+			} else {
+				f.delayRate = rate
+			}
+		case "delay_duration":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid delay_duration %q", value)
+			}
+			f.delay = d
+		default:
+			return nil, fmt.Errorf("unknown key %q, expected error, delay or delay_duration", key)
+		}
+	}
+	return f, nil
+}
+
+// inject is a middleware that does nothing when fault injection is off.
+func (f *faultInjection) inject(c *gin.Context) {
+	if f == nil {
+		c.Next()
+		return
+	}
+
+	if rand.Float64() < f.delayRate {
+		time.Sleep(f.delay)
+	}
+	if rand.Float64() < f.errorRate {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Injected fault"})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// faultInjectionFromEnv reads FAULT_INJECTION, which is only honored with
+// DEV_MODE=true so it can't be left on in production by accident.
+func faultInjectionFromEnv() *faultInjection {
+	spec := os.Getenv("FAULT_INJECTION")
+	if spec == "" {
+		return nil
+	}
+	if os.Getenv("DEV_MODE") != "true" {
+		log.Printf("Warning: ignoring FAULT_INJECTION outside DEV_MODE")
+		return nil
+	}
+
+	f, err := parseFaultInjection(spec)
+	if err != nil {
+		log.Fatalf("Invalid FAULT_INJECTION: %v", err)
+	}
+	log.Printf("Fault injection enabled for bootstrap: error rate %.2f, delay rate %.2f, delay %s", f.errorRate, f.delayRate, f.delay)
+	return f
+}
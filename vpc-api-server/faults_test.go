@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseFaultInjection(t *testing.T) {
+	f, err := parseFaultInjection("error=0.1,delay=0.5,delay_duration=3s")
+	if err != nil {
+		t.Fatalf("parseFaultInjection failed: %v", err)
+	}
+	if f.errorRate != 0.1 || f.delayRate != 0.5 || f.delay != 3*time.Second {
+		t.Errorf("got %+v", *f)
+	}
+
+	for _, spec := range []string{"error=2", "delay=-0.1", "delay_duration=0s", "timeout=1s"} {
+		if _, err := parseFaultInjection(spec); err == nil {
+			t.Errorf("parseFaultInjection(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestFaultInjectionOnlyAffectsBootstrap(t *testing.T) {
+	newFakeHeadscale(t)
+	t.Setenv("FAULT_INJECTION", "error=1")
+	t.Setenv("DEV_MODE", "true")
+	_, r := newTestServer(t, nil)
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("bootstrap: got status %d, want the injected 500", w.Code)
+	}
+	if w := serve(r, newRequest("GET", "/api/nodes")); w.Code != http.StatusOK {
+		t.Errorf("listing nodes: got status %d, want 200", w.Code)
+	}
+}
+
+func TestFaultInjectionRequiresDevMode(t *testing.T) {
+	newFakeHeadscale(t)
+	t.Setenv("FAULT_INJECTION", "error=1")
+	t.Setenv("DEV_MODE", "")
+	_, r := newTestServer(t, nil)
+
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1")); w.Code != http.StatusOK {
+		t.Errorf("bootstrap outside DEV_MODE: got status %d, want 200: %s", w.Code, w.Body)
+	}
+}
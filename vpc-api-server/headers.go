@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// reservedHeaders may not be set through HEADSCALE_EXTRA_HEADERS:
+// Authorization carries the API key, and hop-by-hop headers describe the
+// connection rather than the request.
+var reservedHeaders = []string{
+	"Authorization",
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// parseExtraHeaders parses HEADSCALE_EXTRA_HEADERS, e.g.
+// "X-Gateway-Token=abc,Host=headscale.internal".
+func parseExtraHeaders(list string) (map[string]string, error) {
+	headers, err := parseKeyValueList(list)
+	if err != nil {
+		return nil, err
+	}
+	for name := range headers {
+		for _, reserved := range reservedHeaders {
+			if strings.EqualFold(name, reserved) {
+				return nil, fmt.Errorf("header %s cannot be overridden", name)
+			}
+		}
+	}
+	return headers, nil
+}
+
+// headerTransport adds HEADSCALE_EXTRA_HEADERS to every Headscale request,
+// for deployments that sit behind a gateway. A "Host" entry overrides the
+// request's Host rather than being sent as a header.
+type headerTransport struct {
+	next    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.headers) == 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the caller's request.
+	req = req.Clone(req.Context())
+	for name, value := range t.headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseExtraHeaders(t *testing.T) {
+	headers, err := parseExtraHeaders("X-Gateway-Token=abc, Host=headscale.internal")
+	if err != nil {
+		t.Fatalf("parseExtraHeaders failed: %v", err)
+	}
+	if headers["X-Gateway-Token"] != "abc" || headers["Host"] != "headscale.internal" {
+		t.Errorf("got %v", headers)
+	}
+
+	for _, list := range []string{
+		"Authorization=Bearer other",
+		"authorization=Bearer other",
+		"X-Gateway-Token=abc,Connection=close",
+		"Transfer-Encoding=chunked",
+		"Upgrade=websocket",
+		"Proxy-Authorization=Basic abc",
+	} {
+		if _, err := parseExtraHeaders(list); err == nil {
+			t.Errorf("parseExtraHeaders(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+func TestExtraHeadersOnHeadscaleRequests(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	useHeadscale(t, hs.server.URL, map[string]string{"X-Gateway-Token": "abc"})
+
+	if _, err := getHeadscaleNodes(context.Background()); err != nil {
+		t.Fatalf("listing nodes: %v", err)
+	}
+	reqs := hs.requestsTo("GET", "/api/v1/node")
+	if len(reqs) != 1 {
+		t.Fatalf("got %d node requests, want 1", len(reqs))
+	}
+	if got := reqs[0].Header.Get("X-Gateway-Token"); got != "abc" {
+		t.Errorf("X-Gateway-Token = %q, want abc", got)
+	}
+	if got := reqs[0].Header.Get("Authorization"); got != "Bearer "+fakeAPIKey {
+		t.Errorf("Authorization = %q, want the API key", got)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPIKey is the API key the fake Headscale accepts by default.
+const fakeAPIKey = "test-api-key"
+
+// fakeHeadscale is an in-memory stand-in for the parts of the Headscale REST
+// API the server uses. Tests seed users, nodes and keys directly, drive the
+// server, and then inspect the state and the recorded requests.
+type fakeHeadscale struct {
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	apiKey   string
+	version  string
+	policy   string
+	users    []User
+	nodes    []HeadscaleNode
+	keys     []fakePreAuthKey
+	requests []fakeRequest
+	nextID   int
+
+	// userPageSize pages GET /api/v1/user when set.
+	userPageSize int
+
+	// intercept, if set, sees every request first and answers it instead
+	// of the fake when it returns true.
+	intercept func(w http.ResponseWriter, r *http.Request) bool
+}
+
+type fakePreAuthKey struct {
+	UserID  string
+	AclTags []string
+	HeadscalePreAuthKey
+}
+
+type fakeRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// newFakeHeadscale starts a fake Headscale and points the Headscale helpers
+// at it for the duration of the test.
+func newFakeHeadscale(t *testing.T) *fakeHeadscale {
+	t.Helper()
+
+	f := &fakeHeadscale{
+		apiKey:  fakeAPIKey,
+		version: "v0.26.1",
+		policy:  `{"tagOwners": {}}`,
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+
+	t.Setenv("HEADSCALE_API_KEY", fakeAPIKey)
+	useHeadscale(t, f.server.URL, nil)
+	return f
+}
+
+// useHeadscale points the Headscale helpers at baseURL with a fresh client,
+// breaker and policy cache, and restores the previous ones after the test.
+func useHeadscale(t *testing.T, baseURL string, extraHeaders map[string]string) {
+	t.Helper()
+
+	prevURL, prevClient, prevBreaker := headscaleInternalURL, headscaleClient, headscaleBreaker
+	t.Cleanup(func() {
+		headscaleInternalURL, headscaleClient, headscaleBreaker = prevURL, prevClient, prevBreaker
+		headscalePolicy = policyCache{}
+		issuedKeys = issuedKeyStore{}
+		createdUsers = createdUserStore{}
+	})
+
+	headscaleInternalURL = baseURL
+	headscaleBreaker = newHeadscaleBreaker(5, time.Minute)
+	headscaleClient = newHeadscaleClient(headscaleBreaker, 10, time.Second, extraHeaders)
+	headscalePolicy = policyCache{}
+	issuedKeys = issuedKeyStore{}
+	createdUsers = createdUserStore{}
+}
+
+func (f *fakeHeadscale) newID() string {
+	f.nextID++
+	return strconv.Itoa(f.nextID)
+}
+
+// addUser adds a user created at createdAt and returns it.
+func (f *fakeHeadscale) addUser(name string, createdAt time.Time) User {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	user := User{ID: f.newID(), Name: name, CreatedAt: &createdAt}
+	f.users = append(f.users, user)
+	return user
+}
+
+// setUserCreatedAt changes when the user name was created.
+func (f *fakeHeadscale) setUserCreatedAt(name string, createdAt time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i := range f.users {
+		if f.users[i].Name == name {
+			f.users[i].CreatedAt = &createdAt
+		}
+	}
+}
+
+// addNode adds node, assigning an ID and an address if it has none, and
+// returns it.
+func (f *fakeHeadscale) addNode(node HeadscaleNode) HeadscaleNode {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if node.ID == "" {
+		node.ID = f.newID()
+	}
+	if node.IPAddresses == nil {
+		node.IPAddresses = []string{"100.64.0." + node.ID}
+	}
+	f.nodes = append(f.nodes, node)
+	return node
+}
+
+// updateNodes applies update to every node with the given name.
+func (f *fakeHeadscale) updateNodes(name string, update func(*HeadscaleNode)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i := range f.nodes {
+		if f.nodes[i].Name == name {
+			update(&f.nodes[i])
+		}
+	}
+}
+
+func (f *fakeHeadscale) nodeNames() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	names := []string{}
+	for _, node := range f.nodes {
+		names = append(names, node.Name)
+	}
+	return names
+}
+
+func (f *fakeHeadscale) userNames() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	names := []string{}
+	for _, user := range f.users {
+		names = append(names, user.Name)
+	}
+	return names
+}
+
+// addKey adds a pre-auth key of userID and returns it.
+func (f *fakeHeadscale) addKey(userID string, key HeadscalePreAuthKey) HeadscalePreAuthKey {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if key.ID == "" {
+		key.ID = f.newID()
+	}
+	if key.Key == "" {
+		key.Key = "hskey-" + key.ID
+	}
+	f.keys = append(f.keys, fakePreAuthKey{UserID: userID, HeadscalePreAuthKey: key})
+	return key
+}
+
+func (f *fakeHeadscale) preAuthKeys() []fakePreAuthKey {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]fakePreAuthKey(nil), f.keys...)
+}
+
+func (f *fakeHeadscale) setIntercept(intercept func(w http.ResponseWriter, r *http.Request) bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.intercept = intercept
+}
+
+// holdRequests makes GET requests to path wait until the returned release
+// function is called, after which they are served normally. Each held
+// request is signalled on arrived.
+func (f *fakeHeadscale) holdRequests(t *testing.T, path string) (arrived <-chan struct{}, release func()) {
+	arrivals := make(chan struct{}, 16)
+	held := make(chan struct{})
+	f.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method == http.MethodGet && r.URL.Path == path {
+			arrivals <- struct{}{}
+			<-held
+		}
+		return false
+	})
+	var once sync.Once
+	release = func() { once.Do(func() { close(held) }) }
+	t.Cleanup(release)
+	return arrivals, release
+}
+
+// requestsTo returns the recorded requests with the given method and path.
+func (f *fakeHeadscale) requestsTo(method, path string) []fakeRequest {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var matched []fakeRequest
+	for _, req := range f.requests {
+		if req.Method == method && req.Path == path {
+			matched = append(matched, req)
+		}
+	}
+	return matched
+}
+
+func writeFakeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeHeadscale) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	f.mutex.Lock()
+	f.requests = append(f.requests, fakeRequest{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	intercept := f.intercept
+	f.mutex.Unlock()
+
+	if intercept != nil && intercept(w, r) {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.URL.Path != "/version" && r.Header.Get("Authorization") != "Bearer "+f.apiKey {
+		writeFakeJSON(w, http.StatusUnauthorized, map[string]any{"code": 16, "message": "Unauthorized"})
+		return
+	}
+
+	route := r.Method + " " + r.URL.Path
+	nodePath, isNodePath := strings.CutPrefix(r.URL.Path, "/api/v1/node/")
+	switch {
+	case route == "GET /version":
+		writeFakeJSON(w, http.StatusOK, map[string]string{"version": f.version})
+
+	case route == "GET /api/v1/policy":
+		writeFakeJSON(w, http.StatusOK, map[string]string{"policy": f.policy})
+
+	case route == "GET /api/v1/user":
+		f.serveUsers(w, r.URL.Query().Get("pageToken"))
+
+	case route == "POST /api/v1/user":
+		var req map[string]string
+		json.Unmarshal(body, &req)
+		now := time.Now().UTC()
+		user := User{ID: f.newID(), Name: req["name"], CreatedAt: &now}
+		f.users = append(f.users, user)
+		writeFakeJSON(w, http.StatusOK, map[string]any{"user": user})
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/api/v1/user/"):
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/user/")
+		for i, user := range f.users {
+			if user.ID == id {
+				f.users = append(f.users[:i], f.users[i+1:]...)
+				writeFakeJSON(w, http.StatusOK, map[string]any{})
+				return
+			}
+		}
+		writeFakeJSON(w, http.StatusNotFound, map[string]any{"code": 5, "message": "user not found"})
+
+	case route == "GET /api/v1/node":
+		writeFakeJSON(w, http.StatusOK, HeadscaleNodesResponse{Nodes: f.nodes})
+
+	case route == "POST /api/v1/node/register":
+		user := f.userByName(r.URL.Query().Get("user"))
+		id := f.newID()
+		node := HeadscaleNode{
+			ID:             id,
+			Name:           "registered-" + id,
+			User:           user,
+			IPAddresses:    []string{"100.64.0." + id},
+			RegisterMethod: "REGISTER_METHOD_CLI",
+		}
+		f.nodes = append(f.nodes, node)
+		writeFakeJSON(w, http.StatusOK, HeadscaleNodeResponse{Node: node})
+
+	case r.Method == http.MethodDelete && isNodePath:
+		for i, node := range f.nodes {
+			if node.ID == nodePath {
+				f.nodes = append(f.nodes[:i], f.nodes[i+1:]...)
+				writeFakeJSON(w, http.StatusOK, map[string]any{})
+				return
+			}
+		}
+		writeFakeJSON(w, http.StatusNotFound, map[string]any{"code": 5, "message": "node not found"})
+
+	case r.Method == http.MethodPost && isNodePath && strings.HasSuffix(nodePath, "/expire"):
+		f.serveNodeUpdate(w, strings.TrimSuffix(nodePath, "/expire"), func(node *HeadscaleNode) {
+			now := time.Now().UTC()
+			node.Expiry = &now
+		})
+
+	case r.Method == http.MethodPost && isNodePath && strings.HasSuffix(nodePath, "/approve_routes"):
+		var req ApproveRoutesRequest
+		json.Unmarshal(body, &req)
+		f.serveNodeUpdate(w, strings.TrimSuffix(nodePath, "/approve_routes"), func(node *HeadscaleNode) {
+			node.ApprovedRoutes = req.Routes
+		})
+
+	case route == "GET /api/v1/preauthkey":
+		userID := r.URL.Query().Get("user")
+		keys := []HeadscalePreAuthKey{}
+		for _, key := range f.keys {
+			if key.UserID == userID {
+				keys = append(keys, key.HeadscalePreAuthKey)
+			}
+		}
+		writeFakeJSON(w, http.StatusOK, HeadscalePreAuthKeysResponse{PreAuthKeys: keys})
+
+	case route == "POST /api/v1/preauthkey":
+		var req PreAuthKeyRequest
+		json.Unmarshal(body, &req)
+		expiration, _ := time.Parse(time.RFC3339, req.Expiration)
+		now := time.Now().UTC()
+		id := f.newID()
+		key := fakePreAuthKey{
+			UserID:  req.User,
+			AclTags: req.AclTags,
+			HeadscalePreAuthKey: HeadscalePreAuthKey{
+				ID:         id,
+				Key:        "hskey-" + id,
+				Reusable:   req.Reusable,
+				Expiration: &expiration,
+				CreatedAt:  &now,
+			},
+		}
+		f.keys = append(f.keys, key)
+		writeFakeJSON(w, http.StatusOK, PreAuthKeyResponse{PreAuthKey: PreAuthKeyData{ID: key.ID, Key: key.Key}})
+
+	case route == "POST /api/v1/preauthkey/expire":
+		var req ExpirePreAuthKeyRequest
+		json.Unmarshal(body, &req)
+		now := time.Now().UTC()
+		for i, key := range f.keys {
+			if key.UserID == req.User && key.Key == req.Key {
+				f.keys[i].Expiration = &now
+			}
+		}
+		writeFakeJSON(w, http.StatusOK, map[string]any{})
+
+	case route == "DELETE /api/v1/preauthkey":
+		userID, keyValue := r.URL.Query().Get("user"), r.URL.Query().Get("key")
+		for i, key := range f.keys {
+			if key.UserID == userID && key.Key == keyValue {
+				f.keys = append(f.keys[:i], f.keys[i+1:]...)
+				break
+			}
+		}
+		writeFakeJSON(w, http.StatusOK, map[string]any{})
+
+	default:
+		writeFakeJSON(w, http.StatusNotFound, map[string]any{"code": 5, "message": "Not Found"})
+	}
+}
+
+// serveUsers answers a user listing, one page of userPageSize users at a
+// time if set. The page token is the offset of the page.
+func (f *fakeHeadscale) serveUsers(w http.ResponseWriter, pageToken string) {
+	if f.userPageSize == 0 {
+		writeFakeJSON(w, http.StatusOK, UsersResponse{Users: f.users})
+		return
+	}
+
+	offset, _ := strconv.Atoi(pageToken)
+	end := min(offset+f.userPageSize, len(f.users))
+	resp := UsersResponse{Users: f.users[offset:end]}
+	if end < len(f.users) {
+		resp.NextPageToken = strconv.Itoa(end)
+	}
+	writeFakeJSON(w, http.StatusOK, resp)
+}
+
+func (f *fakeHeadscale) serveNodeUpdate(w http.ResponseWriter, id string, update func(*HeadscaleNode)) {
+	for i := range f.nodes {
+		if f.nodes[i].ID == id {
+			update(&f.nodes[i])
+			writeFakeJSON(w, http.StatusOK, HeadscaleNodeResponse{Node: f.nodes[i]})
+			return
+		}
+	}
+	writeFakeJSON(w, http.StatusNotFound, map[string]any{"code": 5, "message": "node not found"})
+}
+
+func (f *fakeHeadscale) userByName(name string) User {
+	for _, user := range f.users {
+		if user.Name == name {
+			return user
+		}
+	}
+	return User{Name: name}
+}
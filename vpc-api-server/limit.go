@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errHeadscaleBusy is returned when a Headscale request could not get a slot
+// within the queue timeout.
+var errHeadscaleBusy = errors.New("too many concurrent Headscale requests")
+
+// limitTransport bounds the number of in-flight Headscale requests across all
+// handlers. Requests beyond the limit wait up to queueTimeout for a slot.
+type limitTransport struct {
+	next         http.RoundTripper
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+func newLimitTransport(next http.RoundTripper, maxConcurrency int, queueTimeout time.Duration) *limitTransport {
+	return &limitTransport{
+		next:         next,
+		slots:        make(chan struct{}, maxConcurrency),
+		queueTimeout: queueTimeout,
+	}
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timer := time.NewTimer(t.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case t.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, errHeadscaleBusy
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		<-t.slots
+		return nil, err
+	}
+	// Hold the slot until the caller has finished reading the body.
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { <-t.slots }}
+	return resp, nil
+}
+
+// releaseOnClose runs release exactly once when the body is closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeadscaleConcurrencyLimit(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	const limit = 2
+	headscaleClient = newHeadscaleClient(headscaleBreaker, limit, 5*time.Second, nil)
+	_, r := newTestServer(t, nil)
+
+	var inFlight, maxInFlight atomic.Int32
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			max := maxInFlight.Load()
+			if n <= max || maxInFlight.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return false
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serve(r, newRequest("GET", fmt.Sprintf("/api/register?instance_id=i%d&node_name=n%d", i, i)))
+			if w.Code != http.StatusOK {
+				t.Errorf("bootstrap %d: got status %d: %s", i, w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if max := maxInFlight.Load(); max > limit {
+		t.Errorf("saw %d concurrent Headscale requests, limit is %d", max, limit)
+	}
+}
+
+func TestHeadscaleQueueTimeout(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	headscaleClient = newHeadscaleClient(headscaleBreaker, 1, 20*time.Millisecond, nil)
+	_, r := newTestServer(t, nil)
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		entered <- struct{}{}
+		<-release
+		return false
+	})
+	defer close(release)
+
+	// The first request holds the only slot until released.
+	go getHeadscaleNodes(context.Background())
+	<-entered
+
+	if w := serve(r, newRequest("GET", "/api/nodes/ips?node_type=mongodb&port=27017")); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("queued past the timeout: got status %d, want 503", w.Code)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// newHTTPServer wraps handler in an http.Server with explicit connection
+// limits instead of the unbounded net/http defaults. There is no read or
+// write timeout since /api/nodes/watch streams for up to 30 minutes;
+// ReadHeaderTimeout is what guards against slowloris clients.
+func newHTTPServer(handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+		IdleTimeout:       getEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    getEnvInt("HTTP_MAX_HEADER_BYTES", 64<<10),
+	}
+	log.Printf("HTTP server: read header timeout %s, idle timeout %s, max header bytes %d",
+		srv.ReadHeaderTimeout, srv.IdleTimeout, srv.MaxHeaderBytes)
+	return srv
+}
+
+// serveUntilDone runs serve until ctx is cancelled and then shuts srv down,
+// giving in-flight requests up to timeout to finish. Requests still running
+// at that point are cut off.
+func serveUntilDone(ctx context.Context, srv *http.Server, serve func() error, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serve()
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: HTTP server did not drain in time: %v", err)
+		srv.Close()
+	}
+	return nil
+}
+
+// listenUnix listens on a Unix domain socket at path, replacing any stale
+// socket left behind by a previous run. The socket is removed again when the
+// server shuts down, since closing a unix listener unlinks its socket file.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to chmod socket %s: %w", path, err)
+	}
+
+	return listener, nil
+}
+
+// socketMode parses LISTEN_SOCKET_MODE as an octal file mode, defaulting to
+// 0660 so only the owner and group (e.g. a sidecar) can connect.
+func socketMode() os.FileMode {
+	value := os.Getenv("LISTEN_SOCKET_MODE")
+	if value == "" {
+		return 0660
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		log.Printf("Warning: invalid LISTEN_SOCKET_MODE %q, using 0660", value)
+		return 0660
+	}
+	return os.FileMode(mode)
+}
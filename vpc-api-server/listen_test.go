@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// socketPath returns a path for a Unix socket in a fresh directory. Socket
+// paths are limited to about 100 bytes, which t.TempDir can exceed.
+func socketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "vpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "api.sock")
+}
+
+func TestListenUnix(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+	path := socketPath(t)
+
+	// A socket left behind by a previous run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("listenUnix: %v", err)
+	}
+	srv := &http.Server{Handler: r}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode: got %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/health")
+	if err != nil {
+		t.Fatalf("request over the socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	path := socketPath(t)
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(path, 0600); err == nil {
+		t.Errorf("listenUnix replaced a regular file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Errorf("the file was modified")
+	}
+}
+
+func TestSocketMode(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  os.FileMode
+	}{
+		{"", 0660},
+		{"600", 0600},
+		{"0666", 0666},
+		{"rw", 0660},
+	} {
+		t.Setenv("LISTEN_SOCKET_MODE", tc.value)
+		if got := socketMode(); got != tc.want {
+			t.Errorf("LISTEN_SOCKET_MODE=%q: got %o, want %o", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPServerLimits(t *testing.T) {
+	t.Setenv("HTTP_MAX_HEADER_BYTES", "4096")
+	t.Setenv("HTTP_IDLE_TIMEOUT", "5s")
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	srv := newHTTPServer(r)
+	if srv.MaxHeaderBytes != 4096 || srv.IdleTimeout != 5*time.Second || srv.ReadHeaderTimeout != 10*time.Second {
+		t.Errorf("got max header bytes %d, idle timeout %s, read header timeout %s", srv.MaxHeaderBytes, srv.IdleTimeout, srv.ReadHeaderTimeout)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", "http://"+listener.Addr().String()+"/health", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Padding", strings.Repeat("x", 16<<10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("oversized headers: got status %d, want 431", resp.StatusCode)
+	}
+}
+
+func TestServeUntilDoneDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serveUntilDone(ctx, srv, func() error { return srv.Serve(listener) }, 5*time.Second)
+	}()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+
+	select {
+	case <-done:
+		t.Fatal("serveUntilDone returned with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(finish)
+
+	if err := <-done; err != nil {
+		t.Errorf("serveUntilDone: %v", err)
+	}
+	if got := <-status; got != http.StatusNoContent {
+		t.Errorf("in-flight request: got status %d, want 204", got)
+	}
+}
+
+func TestServeUntilDoneCutsOffAfterTimeout(t *testing.T) {
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serveUntilDone(ctx, srv, func() error { return srv.Serve(listener) }, 100*time.Millisecond)
+	}()
+	go http.Get("http://" + listener.Addr().String())
+	<-started
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serveUntilDone: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveUntilDone did not give up on a stuck request")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// maskNodeNames is set from MASK_NODE_NAMES. Node names can encode tenant
+// identifiers, so when it is on they are replaced by a stable hash in log
+// output and audit entries. API responses are unaffected.
+var maskNodeNames bool
+
+// logName returns name as it should appear in logs: unchanged, or masked as
+// "node#" and a short hash, so the same name always masks the same way and
+// log lines can still be correlated.
+func logName(name string) string {
+	if !maskNodeNames || name == "" {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "node#" + hex.EncodeToString(sum[:6])
+}
+
+// fixedNodeRoutes are the single-segment /api/nodes/ routes, which take
+// precedence over a node named the same.
+var fixedNodeRoutes = map[string]bool{"ips": true, "watch": true, "rekey": true}
+
+// maskLogPath masks the node name in a request path and its node_name query
+// parameter for the access log.
+func maskLogPath(path string) string {
+	if !maskNodeNames {
+		return path
+	}
+
+	path, rawQuery, hasQuery := strings.Cut(path, "?")
+	if rest, ok := strings.CutPrefix(path, "/api/nodes/"); ok {
+		segments := strings.Split(rest, "/")
+		switch {
+		case segments[0] == "by-name" && len(segments) > 1:
+			segments[1] = logName(segments[1])
+		case len(segments) > 1 || !fixedNodeRoutes[segments[0]]:
+			segments[0] = logName(segments[0])
+		}
+		path = "/api/nodes/" + strings.Join(segments, "/")
+	}
+	if !hasQuery {
+		return path
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err == nil && query.Has("node_name") {
+		query.Set("node_name", logName(query.Get("node_name")))
+		rawQuery = query.Encode()
+	}
+	return path + "?" + rawQuery
+}
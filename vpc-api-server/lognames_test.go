@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaskLogPath(t *testing.T) {
+	maskNodeNames = true
+	t.Cleanup(func() { maskNodeNames = false })
+
+	masked := logName("mongo-1")
+	if !strings.HasPrefix(masked, "node#") || masked != logName("mongo-1") || masked == logName("mongo-2") {
+		t.Fatalf("logName(mongo-1) = %q, want a stable node# hash", masked)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/api/nodes/mongo-1/drain", "/api/nodes/" + masked + "/drain"},
+		{"/api/nodes/by-name/mongo-1", "/api/nodes/by-name/" + masked},
+		{"/api/nodes/ips", "/api/nodes/ips"},
+		{"/api/nodes/rekey?node_type=mongodb", "/api/nodes/rekey?node_type=mongodb"},
+		{"/api/nodes/rekey/rekey", "/api/nodes/" + logName("rekey") + "/rekey"},
+		{"/api/nodes/watch?since=1", "/api/nodes/watch?since=1"},
+		{"/api/register?instance_id=i1&node_name=mongo-1", "/api/register?instance_id=i1&node_name=" + strings.ReplaceAll(masked, "#", "%23")},
+		{"/api/nodes?node_type=mongodb", "/api/nodes?node_type=mongodb"},
+	} {
+		if got := maskLogPath(tc.path); got != tc.want {
+			t.Errorf("maskLogPath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestLogNameUnmaskedByDefault(t *testing.T) {
+	if got := logName("mongo-1"); got != "mongo-1" {
+		t.Errorf("logName(mongo-1) = %q, want it unchanged", got)
+	}
+	if got := maskLogPath("/api/nodes/mongo-1/drain"); got != "/api/nodes/mongo-1/drain" {
+		t.Errorf("maskLogPath changed the path to %q", got)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestLogger returns gin's access logger, logging only one in every rate
+// successful requests to the given paths. Requests that fail with a 4xx or
+// 5xx status are always logged. With MASK_NODE_NAMES, node names in request
+// paths are masked.
+func requestLogger(paths []string, rate int) gin.HandlerFunc {
+	if (len(paths) == 0 || rate <= 1) && !maskNodeNames {
+		return gin.Logger()
+	}
+
+	sampled := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		sampled[path] = true
+	}
+
+	var counter atomic.Uint64
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		path, _, _ := strings.Cut(param.Path, "?")
+		if rate > 1 && sampled[path] && param.StatusCode < 400 && counter.Add(1)%uint64(rate) != 1 {
+			return ""
+		}
+		param.Path = maskLogPath(param.Path)
+		return formatAccessLog(param)
+	})
+}
+
+// formatAccessLog matches gin's default log line, without colors.
+func formatAccessLog(param gin.LogFormatterParams) string {
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		param.Path,
+		param.ErrorMessage,
+	)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestLoggerSampling(t *testing.T) {
+	var buf bytes.Buffer
+	gin.DefaultWriter = &buf
+	defer func() { gin.DefaultWriter = io.Discard }()
+
+	r := gin.New()
+	r.Use(requestLogger([]string{"/api/nodes"}, 10))
+	r.GET("/api/nodes", func(c *gin.Context) {
+		if c.Query("fail") == "true" {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	r.GET("/api/stats", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for i := 0; i < 1000; i++ {
+		serve(r, newRequest("GET", "/api/nodes?node_type=mongodb"))
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 100 {
+		t.Errorf("logged %d of 1000 sampled requests, want 100", n)
+	}
+
+	buf.Reset()
+	for i := 0; i < 5; i++ {
+		serve(r, newRequest("GET", "/api/nodes?fail=true"))
+		serve(r, newRequest("GET", "/api/stats"))
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 10 {
+		t.Errorf("logged %d of 5 failed and 5 unsampled requests, want all 10", n)
+	}
+}
@@ -2,49 +2,317 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 type Config struct {
 	AllowedApps      []string
 	AllowedNodeTypes []string
+	DefaultNodeType  string
+
+	// NodeTypeAliases maps old node type names to allowed types, so
+	// renamed types keep working for old clients. Aliases are resolved
+	// before anything else looks at the type.
+	NodeTypeAliases map[string]string
+
+	NodeNameTemplate string
+	NodePollInterval time.Duration
+	ReusableKeys     bool
+
+	// NodesCacheMaxAge is the max-age sent with /api/nodes. Without it
+	// clients are told to revalidate every time, using the ETag.
+	NodesCacheMaxAge time.Duration
+
+	// DefaultPageSize is the limit applied to /api/nodes when the request
+	// sets none; 0 lists every node. MaxPageSize caps any limit.
+	DefaultPageSize int
+	MaxPageSize     int
+
+	// RetireGracePeriod is how long a retired node drains before it is
+	// deleted.
+	RetireGracePeriod time.Duration
+
+	// PendingGracePeriod is how long after bootstrap a node missing from
+	// Headscale is reported as pending rather than offline.
+	PendingGracePeriod time.Duration
+
+	// NodeTypeAppACL restricts which apps may bootstrap each node type,
+	// on top of AllowedApps. Types without an entry allow any allowed app.
+	NodeTypeAppACL map[string][]string
+
+	// NodeTypeQuotas caps the number of nodes per node type. Offline
+	// nodes only count when QuotaCountOffline is set.
+	NodeTypeQuotas    map[string]int
+	QuotaCountOffline bool
+
+	// NodeTypeLifetimes limits how long a node of a given type stays
+	// registered. This is separate from the pre-auth key TTL, which only
+	// bounds when a key can be used: once the lifetime has passed since the
+	// node was created in Headscale, its session is expired, even if a
+	// reusable key would still let it in.
+	NodeTypeLifetimes map[string]time.Duration
+
+	// NamespacedUsers issues pre-auth keys under a per app and node type
+	// Headscale user instead of "default".
+	NamespacedUsers bool
+
+	// AuthEnforce rejects app ids not in AllowedApps. When false they are
+	// only logged, to discover legitimate app ids before enforcing.
+	AuthEnforce bool
+
+	// NodeTypeTags adds a tag:type-<node_type> ACL tag to pre-auth keys so
+	// the node type is visible in Headscale itself.
+	NodeTypeTags bool
+
+	// AppIDTags adds a tag:app-<app id> ACL tag to pre-auth keys so ACLs
+	// can reference apps.
+	AppIDTags bool
+
+	// OperatorToken guards admin routes; they are disabled when empty.
+	OperatorToken string
+
+	// Environment names the deployment, e.g. "staging". It is returned by
+	// /api/config and in an X-Environment header on every response.
+	Environment string
 }
 
 type NodeInfo struct {
-	UUID        string  `json:"uuid"`
-	Name        string  `json:"name"`
-	NodeType    string  `json:"node_type"`
-	TailscaleIP *string `json:"tailscale_ip"`
+	// ID is the stable handle for a node: the instance id for bootstrapped
+	// nodes, "headscale:" and the Headscale node ID for nodes only
+	// Headscale knows. Unlike Name it never changes for the node's lifetime.
+	ID string `json:"id"`
+
+	UUID        string     `json:"uuid"`
+	Name        string     `json:"name"`
+	NodeType    string     `json:"node_type"`
+	TailscaleIP *string    `json:"tailscale_ip"`
+	Online      bool       `json:"online"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	Source      string     `json:"source"`
+	Draining    bool       `json:"draining"`
+	Priority    int        `json:"priority"`
+
+	// Status is pending while a fresh node hasn't shown up in Headscale yet,
+	// then active or offline.
+	Status string `json:"status"`
+
+	// Routes is only set for nodes that advertise subnet routes.
+	Routes *NodeRoutes `json:"routes,omitempty"`
+
+	// Reachable is the last TCP probe result, omitted for node types that
+	// aren't probed.
+	Reachable *bool `json:"reachable,omitempty"`
+
+	// Verified is set for nodes that bootstrapped with an attested app id
+	// explicitly listed in ALLOWED_APPS.
+	Verified bool `json:"verified"`
+
+	// AppID is the app that bootstrapped the node; only it may rekey it.
+	AppID string `json:"app_id,omitempty"`
+
+	// Tags are the ACL tags Headscale reports for the node, valid and
+	// forced combined. Empty until the node has joined.
+	Tags []string `json:"tags,omitempty"`
+
+	// ClientRef is the caller's own correlation value from bootstrap.
+	ClientRef string `json:"client_ref,omitempty"`
+
+	// BootstrapIP is the client IP that bootstrapped the node. Listings
+	// only include it for operators or with include_debug=true.
+	BootstrapIP string `json:"bootstrap_ip,omitempty"`
+
+	// LastModified is when any field other than last_seen last changed, as
+	// observed by this server since it started.
+	LastModified *time.Time `json:"last_modified,omitempty"`
+
+	// The node's current pre-auth key and the options it was issued with,
+	// kept so it can be rekeyed. Never serialized.
+	authKey    string
+	keyOptions PreAuthKeyOptions
+
+	// inHeadscale is set by mergedNodes once Headscale knows the node.
+	// Never serialized.
+	inHeadscale bool
+
+	// addresses are all the Tailscale IPs Headscale reports for the node,
+	// IPv4 and IPv6, for the subnet filter. Never serialized.
+	addresses []string
+
+	// Debug is only returned with include_debug=true.
+	Debug *NodeDebugInfo `json:"debug,omitempty"`
 }
 
+// NodeRoutes lists the subnet routes (CIDRs) a node advertises, those an
+// operator approved, and those Headscale is actually serving through it.
+type NodeRoutes struct {
+	Advertised []string `json:"advertised"`
+	Approved   []string `json:"approved"`
+	Serving    []string `json:"serving"`
+}
+
+// NodeDebugInfo records how Headscale says a node registered, to help
+// correlate nodes with the pre-auth keys we issued.
+type NodeDebugInfo struct {
+	HeadscaleID    string   `json:"headscale_id"`
+	User           string   `json:"user"`
+	RegisterMethod string   `json:"register_method"`
+	AuthKeyID      string   `json:"auth_key_id,omitempty"`
+	AuthKeyUser    string   `json:"auth_key_user,omitempty"`
+	AuthKeyTags    []string `json:"auth_key_tags,omitempty"`
+}
+
+// Node statuses, see nodeStatus.
+const (
+	statusPending = "pending"
+	statusActive  = "active"
+	statusOffline = "offline"
+)
+
+// Node sources: registered through /api/register, or only known to Headscale.
+const (
+	sourceBootstrap = "bootstrap"
+	sourceHeadscale = "headscale"
+)
+
 type BootstrapResponse struct {
-	PreAuthKey   string `json:"pre_auth_key"`
-	SharedKey    string `json:"shared_key"`
-	ServerUrl string `json:"server_url"`
+	// PreAuthKey is empty when the node was registered with node_key.
+	PreAuthKey string `json:"pre_auth_key,omitempty"`
+	SharedKey  string `json:"shared_key"`
+	ServerUrl  string `json:"server_url"`
+
+	// NodeID and TailscaleIP are only set when the node was registered
+	// directly with node_key.
+	NodeID      string `json:"node_id,omitempty"`
+	TailscaleIP string `json:"tailscale_ip,omitempty"`
+
+	// GatewayDomain is only set with include_gateway=true.
+	GatewayDomain string `json:"gateway_domain,omitempty"`
+
+	// ClientRef echoes the client_ref parameter, if any.
+	ClientRef string `json:"client_ref,omitempty"`
+
+	// KeyExpiresAt is when PreAuthKey stops working, for scheduling a rekey.
+	KeyExpiresAt *time.Time `json:"key_expires_at,omitempty"`
+
+	// Node is only set with wait=active.
+	Node *NodeInfo `json:"node,omitempty"`
+}
+
+// writeRawBootstrap answers a bootstrap with keyfile_format=raw. Raw bytes
+// can't go in a JSON string, so the keyfile is the whole body, as from
+// /api/keyfile, and the other fields are sent as headers.
+func writeRawBootstrap(c *gin.Context, response BootstrapResponse) {
+	headers := map[string]string{
+		"X-Pre-Auth-Key":   response.PreAuthKey,
+		"X-Server-Url":     response.ServerUrl,
+		"X-Node-Id":        response.NodeID,
+		"X-Tailscale-Ip":   response.TailscaleIP,
+		"X-Gateway-Domain": response.GatewayDomain,
+		"X-Client-Ref":     response.ClientRef,
+	}
+	if response.KeyExpiresAt != nil {
+		headers["X-Key-Expires-At"] = response.KeyExpiresAt.Format(time.RFC3339)
+	}
+	for name, value := range headers {
+		if value != "" {
+			c.Header(name, value)
+		}
+	}
+	c.Data(http.StatusOK, "application/octet-stream", []byte(response.SharedKey))
 }
 
 type NodesResponse struct {
 	Nodes []NodeInfo `json:"nodes"`
+
+	// Stale is set when Headscale could not be reached and the nodes come
+	// from the last successful poll; IPs and online state may be outdated
+	// or missing.
+	Stale bool `json:"stale"`
+
+	// Limit is the effective page size when the listing is paged, after
+	// DEFAULT_PAGE_SIZE and MAX_PAGE_SIZE are applied. NextOffset is set
+	// when more nodes follow.
+	Limit      int  `json:"limit,omitempty"`
+	NextOffset *int `json:"next_offset,omitempty"`
 }
 
 type AppState struct {
-	config       Config
-	nodes        map[string]NodeInfo
-	mutex        sync.RWMutex
-	sharedKey    string
-	ServerUrl string
+	config     Config
+	nodes      map[string]NodeInfo
+	mutex      sync.RWMutex
+	sharedKeys *sharedKeyStore
+	ServerUrl  string
+
+	// gatewayDomain is the detected dstack gateway domain, empty when the
+	// Headscale URL was configured explicitly or detection failed.
+	gatewayDomain string
+
+	// maintenance rejects new registrations while set, e.g. during
+	// Headscale upgrades.
+	maintenance atomic.Bool
+
+	// warm is set once Headscale has answered after startup.
+	warm atomic.Bool
+
+	watcher *nodeWatcher
+	audit   *auditLogger
+
+	// prober is nil unless PROBE_PORTS is set.
+	prober *nodeProber
+
+	self *selfCache
+
+	retirements *retirementTracker
+
+	// apps are the app ids that bootstrapped a node, for /api/stats.
+	apps *appSet
+
+	// modified tracks when each node last changed, for modified_since.
+	modified *modificationTracker
+
+	// nonces are the bootstrap nonces seen within BOOTSTRAP_NONCE_TTL.
+	nonces *nonceStore
+
+	// quotaLocks serializes bootstraps of node types with a quota.
+	quotaLocks nodeTypeLocks
+
+	// ctx is cancelled on shutdown. tasks tracks the goroutines started
+	// with spawn, which main waits for before exiting.
+	ctx   context.Context
+	tasks sync.WaitGroup
+}
+
+// spawn runs task in a goroutine that main waits for on shutdown. task
+// should return once s.ctx is done.
+func (s *AppState) spawn(task func()) {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		task()
+	}()
 }
 
 var dstackMeshURL string
@@ -96,10 +364,15 @@ func getGatewayDomainFromDstackMesh() (string, error) {
 	return info.GatewayDomain, nil
 }
 
-func buildHeadscaleURL() string {
+// buildHeadscaleURL returns the Headscale URL handed to nodes and, when it was
+// auto-detected, the dstack gateway domain it was built from.
+func buildHeadscaleURL() (string, string) {
 	// Check for explicit configuration first
 	if url := os.Getenv("VPC_SERVER_URL"); url != "" {
-		return url
+		if err := validateServerURL(url); err != nil {
+			log.Printf("Warning: VPC_SERVER_URL %q looks invalid: %v", url, err)
+		}
+		return url, ""
 	}
 
 	// Try auto-detection with retries
@@ -117,16 +390,123 @@ func buildHeadscaleURL() string {
 
 	if err != nil {
 		log.Printf("Failed to get app_id after retries: %v, falling back to default", err)
-		return "http://headscale:8080"
+		return "http://headscale:8080", ""
 	}
 
 	gatewayDomain, err = getGatewayDomainFromDstackMesh()
 	if err != nil {
 		log.Printf("Failed to get gateway_domain: %v, falling back to default", err)
-		return "http://headscale:8080"
+		return "http://headscale:8080", ""
 	}
 
-	return fmt.Sprintf("https://%s-8080.%s", appID, gatewayDomain)
+	serverURL := fmt.Sprintf("https://%s-8080.%s", appID, gatewayDomain)
+	if err := validateServerURL(serverURL); err != nil {
+		log.Printf("Detected Headscale URL %q is invalid: %v, falling back to default", serverURL, err)
+		return "http://headscale:8080", ""
+	}
+	return serverURL, gatewayDomain
+}
+
+// validateServerURL checks that rawURL is an absolute http(s) URL with a
+// well-formed host, catching misconfigured gateway domains at startup rather
+// than at a node's first connection attempt.
+func validateServerURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("invalid host %q", host)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') && r != '-' {
+				return fmt.Errorf("invalid host %q", host)
+			}
+		}
+	}
+	return nil
+}
+
+// getHeadscaleAPIURL returns the URL of the Headscale API. In the cluster it
+// must be configured explicitly; with DEV_MODE=true it defaults to a
+// port-forwarded Headscale on localhost.
+func getHeadscaleAPIURL() (string, error) {
+	if url := os.Getenv("HEADSCALE_INTERNAL_URL"); url != "" {
+		return url, nil
+	}
+	if os.Getenv("DEV_MODE") == "true" {
+		log.Printf("DEV_MODE is set, defaulting Headscale API URL to http://localhost:8080")
+		return "http://localhost:8080", nil
+	}
+	return "", fmt.Errorf("HEADSCALE_INTERNAL_URL is not set (set DEV_MODE=true to use http://localhost:8080 for local development)")
+}
+
+// getEnvDuration parses a duration such as "30s" from the environment,
+// falling back to def when unset or invalid.
+func getEnvDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid %s %q, using default %s", name, value, def)
+		return def
+	}
+	return d
+}
+
+// getEnvInt parses a positive integer from the environment, falling back to
+// def when unset or invalid.
+func getEnvInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Warning: invalid %s %q, using default %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// getEnvBool parses a boolean from the environment, falling back to def when
+// unset or invalid.
+func getEnvBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using default %t", name, value, def)
+		return def
+	}
+	return b
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		if trimmed := strings.TrimSpace(item); trimmed != "" {
+			result = append(result, trimmed)
+		}
+	}
+	return result
 }
 
 func parseAllowedApps(allowedApps string) []string {
@@ -139,16 +519,41 @@ func parseAllowedApps(allowedApps string) []string {
 	apps := strings.Split(allowedApps, ",")
 	var result []string
 	for _, app := range apps {
-		if trimmed := strings.TrimSpace(app); trimmed != "" {
-			result = append(result, trimmed)
+		trimmed := strings.TrimSpace(app)
+		if trimmed == "" {
+			continue
 		}
+		if _, err := path.Match(trimmed, ""); err != nil {
+			log.Printf("Warning: ignoring invalid ALLOWED_APPS pattern %q: %v", trimmed, err)
+			continue
+		}
+		result = append(result, trimmed)
 	}
 	return result
 }
 
+// isAppAllowed matches appID against ALLOWED_APPS entries, which are exact
+// app ids, glob patterns such as "myorg-*" (path.Match syntax), or "any".
 func (s *AppState) isAppAllowed(appID string) bool {
+	return matchAppID(s.config.AllowedApps, appID)
+}
+
+// isAppAttested reports whether appID is pinned in ALLOWED_APPS rather than
+// admitted by "any" or a glob pattern. The app id header is set by the
+// service mesh only after it has verified the client's RA-TLS certificate,
+// so a pinned match means the caller passed dstack attestation as that app.
+func (s *AppState) isAppAttested(appID string) bool {
 	for _, allowed := range s.config.AllowedApps {
-		if allowed == "any" || allowed == appID {
+		if allowed == appID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *AppState) isNodeTypeAllowed(nodeType string) bool {
+	for _, allowed := range s.config.AllowedNodeTypes {
+		if allowed == nodeType {
 			return true
 		}
 	}
@@ -156,30 +561,64 @@ func (s *AppState) isAppAllowed(appID string) bool {
 }
 
 type HeadscaleNode struct {
-	ID          string   `json:"id"`
-	Name        string   `json:"name"`
-	User        string   `json:"user"`
-	IPAddresses []string `json:"ipAddresses"`
-	Online      bool     `json:"online"`
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	User        User       `json:"user"`
+	IPAddresses []string   `json:"ipAddresses"`
+	Online      bool       `json:"online"`
+	LastSeen    *time.Time `json:"lastSeen"`
+	CreatedAt   *time.Time `json:"createdAt"`
+	Expiry      *time.Time `json:"expiry"`
+
+	RegisterMethod string                   `json:"registerMethod"`
+	PreAuthKey     *HeadscaleNodeAuthKeyRef `json:"preAuthKey"`
+
+	ValidTags  []string `json:"validTags"`
+	ForcedTags []string `json:"forcedTags"`
+
+	AvailableRoutes []string `json:"availableRoutes"`
+	ApprovedRoutes  []string `json:"approvedRoutes"`
+	SubnetRoutes    []string `json:"subnetRoutes"`
+
+	// Releases before 0.23 used snake_case for this field.
+	LegacyIPAddresses []string `json:"ip_addresses"`
+}
+
+// HeadscaleNodeAuthKeyRef identifies the pre-auth key a node registered
+// with. The key itself is deliberately not decoded.
+type HeadscaleNodeAuthKeyRef struct {
+	ID        string   `json:"id"`
+	User      User     `json:"user"`
+	Reusable  bool     `json:"reusable"`
+	Ephemeral bool     `json:"ephemeral"`
+	AclTags   []string `json:"aclTags"`
+}
+
+type HeadscaleNodesResponse struct {
+	Nodes []HeadscaleNode `json:"nodes"`
 }
 
 type PreAuthKeyRequest struct {
-	User       string `json:"user"`
-	Reusable   bool   `json:"reusable"`
-	Ephemeral  bool   `json:"ephemeral"`
-	Expiration string `json:"expiration"`
+	User       string   `json:"user"`
+	Reusable   bool     `json:"reusable"`
+	Ephemeral  bool     `json:"ephemeral"`
+	Expiration string   `json:"expiration"`
+	AclTags    []string `json:"aclTags,omitempty"`
 }
 
 type User struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
 }
 
 type UsersResponse struct {
-	Users []User `json:"users"`
+	Users         []User `json:"users"`
+	NextPageToken string `json:"nextPageToken"`
 }
 
 type PreAuthKeyData struct {
+	ID  string `json:"id"`
 	Key string `json:"key"`
 }
 
@@ -187,147 +626,335 @@ type PreAuthKeyResponse struct {
 	PreAuthKey PreAuthKeyData `json:"preAuthKey"`
 }
 
+// getAPIKey returns the Headscale API key from HEADSCALE_API_KEY or, failing
+// that, from the key file written by vpc-server-entry.sh. The file is read on
+// every call so a rotated key is picked up without a restart.
 func getAPIKey() (string, error) {
 	if apiKey := os.Getenv("HEADSCALE_API_KEY"); apiKey != "" {
-		return apiKey, nil
+		if strings.TrimSpace(apiKey) == "" {
+			return "", fmt.Errorf("HEADSCALE_API_KEY is empty")
+		}
+		return strings.TrimSpace(apiKey), nil
 	}
-	return "", fmt.Errorf("HEADSCALE_API_KEY is not set")
-}
 
-func getUserID(username string) (string, error) {
-	apiKey, err := getAPIKey()
+	keyPath := os.Getenv("HEADSCALE_API_KEY_FILE")
+	if keyPath == "" {
+		keyPath = "/data/api_key"
+	}
+
+	keyBytes, err := os.ReadFile(keyPath)
 	if err != nil {
-		return "", err
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("HEADSCALE_API_KEY is not set and %s does not exist", keyPath)
+		}
+		return "", fmt.Errorf("failed to read Headscale API key file %s: %w", keyPath, err)
 	}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", headscaleInternalURL+"/api/v1/user", nil)
+	apiKey := strings.TrimSpace(string(keyBytes))
+	if apiKey == "" {
+		return "", fmt.Errorf("Headscale API key file is empty: %s", keyPath)
+	}
+	return apiKey, nil
+}
+
+// listUsersPage fetches a single page of Headscale users. An empty pageToken
+// requests the first page.
+func listUsersPage(ctx context.Context, apiKey, pageToken string) (*UsersResponse, error) {
+	reqURL := headscaleInternalURL + "/api/v1/user"
+	if pageToken != "" {
+		reqURL += "?pageToken=" + url.QueryEscape(pageToken)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 
-	resp, err := client.Do(req)
+	resp, err := headscaleClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("headscale API request failed: %w", err)
+		return nil, fmt.Errorf("headscale API request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("headscale API returned status %d: %s", resp.StatusCode, string(body))
+		return nil, newHeadscaleAPIError(resp)
 	}
 
 	var usersResp UsersResponse
 	if err := json.NewDecoder(resp.Body).Decode(&usersResp); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &usersResp, nil
+}
+
+func getUserID(ctx context.Context, username string) (string, error) {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return "", err
 	}
 
-	for _, user := range usersResp.Users {
-		if user.Name == username {
-			return user.ID, nil
+	// Follow nextPageToken until the user is found or the list is exhausted.
+	// Headscale versions that don't paginate simply never return a token.
+	pageToken := ""
+	for {
+		usersResp, err := listUsersPage(ctx, apiKey, pageToken)
+		if err != nil {
+			return "", err
+		}
+
+		for _, user := range usersResp.Users {
+			if user.Name == username {
+				return user.ID, nil
+			}
+		}
+
+		if usersResp.NextPageToken == "" || usersResp.NextPageToken == pageToken {
+			break
 		}
+		pageToken = usersResp.NextPageToken
 	}
 
-	return "", fmt.Errorf("user %s not found", username)
+	return "", fmt.Errorf("%w: %s", errUserNotFound, username)
 }
 
-func generatePreAuthKey() (string, error) {
+// PreAuthKeyOptions controls the pre-auth keys issued to bootstrapping nodes.
+type PreAuthKeyOptions struct {
+	// Reusable keys can register any number of nodes until they expire;
+	// single-use keys are consumed by the first registration.
+	Reusable bool
+	AclTags  []string
+
+	// User owns the key, created if missing. Defaults to "default".
+	User string
+}
+
+// preAuthKeyTTL is how long an issued pre-auth key can be used.
+const preAuthKeyTTL = 24 * time.Hour
+
+// generatePreAuthKey issues a pre-auth key and returns it with the expiry
+// it was issued with.
+func generatePreAuthKey(ctx context.Context, opts PreAuthKeyOptions) (string, time.Time, error) {
+	ctx, span := tracer.Start(ctx, "generatePreAuthKey")
+	defer span.End()
+
 	apiKey, err := getAPIKey()
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 
-	userID, err := getUserID("default")
+	user := opts.User
+	if user == "" {
+		user = "default"
+	}
+
+	userID, err := getOrCreateUserID(ctx, user)
 	if err != nil {
-		return "", fmt.Errorf("failed to get user ID: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to get user ID: %w", err)
 	}
 
-	expiration := time.Now().Add(24 * time.Hour).Format(time.RFC3339)
+	// Whole seconds, since that is all RFC3339 carries to Headscale.
+	expiresAt := time.Now().UTC().Add(preAuthKeyTTL).Truncate(time.Second)
 
 	reqBody := PreAuthKeyRequest{
 		User:       userID,
-		Reusable:   true,
+		Reusable:   opts.Reusable,
 		Ephemeral:  false,
-		Expiration: expiration,
+		Expiration: expiresAt.Format(time.RFC3339),
+		AclTags:    opts.AclTags,
 	}
 
 	jsonBody, err := json.Marshal(reqBody)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", headscaleInternalURL+"/api/v1/preauthkey", bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", headscaleInternalURL+"/api/v1/preauthkey", bytes.NewBuffer(jsonBody))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 
-	resp, err := client.Do(req)
+	resp, err := headscaleClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("headscale API request failed: %w", err)
+		return "", time.Time{}, fmt.Errorf("headscale API request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Pre-auth key creation failed with status %d: %s", resp.StatusCode, string(body))
-		return "", fmt.Errorf("headscale API returned status %d: %s", resp.StatusCode, string(body))
+		apiErr := newHeadscaleAPIError(resp)
+		log.Printf("Pre-auth key creation failed: %v", apiErr)
+		return "", time.Time{}, apiErr
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	log.Printf("Pre-auth key API response: %s", string(body))
 
 	var keyResp PreAuthKeyResponse
 	if err := json.Unmarshal(body, &keyResp); err != nil {
-		return "", fmt.Errorf("failed to decode response: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to decode response: %w", err)
 	}
 
 	if keyResp.PreAuthKey.Key == "" {
-		return "", fmt.Errorf("received empty pre-auth key")
+		return "", time.Time{}, fmt.Errorf("received empty pre-auth key")
+	}
+	issuedKeys.record(keyResp.PreAuthKey.ID, preAuthKeyLabel)
+
+	return keyResp.PreAuthKey.Key, expiresAt, nil
+}
+
+func getHeadscaleNodes(ctx context.Context) ([]HeadscaleNode, error) {
+	ctx, span := tracer.Start(ctx, "getHeadscaleNodes")
+	defer span.End()
+
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", headscaleInternalURL+"/api/v1/node", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHeadscaleAPIError(resp)
+	}
+
+	var nodesResp HeadscaleNodesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&nodesResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	for i := range nodesResp.Nodes {
+		if len(nodesResp.Nodes[i].IPAddresses) == 0 {
+			nodesResp.Nodes[i].IPAddresses = nodesResp.Nodes[i].LegacyIPAddresses
+		}
+	}
+
+	return nodesResp.Nodes, nil
+}
+
+func deleteHeadscaleNode(ctx context.Context, nodeID string) error {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", headscaleInternalURL+"/api/v1/node/"+url.PathEscape(nodeID), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
 	}
 
-	return keyResp.PreAuthKey.Key, nil
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHeadscaleAPIError(resp)
+	}
+
+	return nil
 }
 
-func getOrCreateSharedKey() string {
-	keyPath := "/data/shared_key"
-	
+// expireHeadscaleNode ends the node's current session. Unlike
+// deleteHeadscaleNode the node keeps its identity and can re-authenticate.
+func expireHeadscaleNode(ctx context.Context, nodeID string) error {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", headscaleInternalURL+"/api/v1/node/"+url.PathEscape(nodeID)+"/expire", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHeadscaleAPIError(resp)
+	}
+
+	return nil
+}
+
+func newSharedKey() string {
+	keyBytes := make([]byte, 64)
+	rand.Read(keyBytes)
+	return base64.StdEncoding.EncodeToString(keyBytes)
+}
+
+func getOrCreateSharedKey(keyPath string) string {
 	// Try to load existing key
 	if keyBytes, err := os.ReadFile(keyPath); err == nil {
 		key := strings.TrimSpace(string(keyBytes))
 		log.Printf("Loaded existing shared key from %s", keyPath)
 		return key
 	}
-	
+
 	// Generate new key if file doesn't exist
-	keyBytes := make([]byte, 64)
-	rand.Read(keyBytes)
-	sharedKey := base64.StdEncoding.EncodeToString(keyBytes)
-	
-	// Ensure /data directory exists
-	if err := os.MkdirAll("/data", 0755); err != nil {
-		log.Printf("Warning: failed to create /data directory: %v", err)
+	sharedKey := newSharedKey()
+
+	// Ensure the data directory exists
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0755); err != nil {
+		log.Printf("Warning: failed to create %s directory: %v", filepath.Dir(keyPath), err)
 	}
-	
+
 	// Save key to disk
 	if err := os.WriteFile(keyPath, []byte(sharedKey), 0600); err != nil {
 		log.Printf("Warning: failed to save shared key to %s: %v", keyPath, err)
 	} else {
 		log.Printf("Generated and saved new shared key to %s", keyPath)
 	}
-	
+
 	return sharedKey
 }
 
+// startupDelay waits for delay before startup continues, or returns
+// ctx.Err() if ctx is cancelled first.
+func startupDelay(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	log.Printf("Delaying startup by %s", delay)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func main() {
 	// Initialize global dstackMeshURL
 	dstackMeshURL = os.Getenv("DSTACK_MESH_URL")
@@ -336,10 +963,10 @@ func main() {
 		os.Exit(1)
 	}
 
-	headscaleInternalURL = os.Getenv("HEADSCALE_INTERNAL_URL")
-	if headscaleInternalURL == "" {
-		log.Fatal("HEADSCALE_INTERNAL_URL is not set")
-		os.Exit(1)
+	var err error
+	headscaleInternalURL, err = getHeadscaleAPIURL()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	allowedApps := os.Getenv("ALLOWED_APPS")
@@ -350,28 +977,266 @@ func main() {
 	}
 
 	config := Config{
-		AllowedApps:      parseAllowedApps(allowedApps),
-		AllowedNodeTypes: []string{"mongodb", "app"},
+		AllowedApps:       parseAllowedApps(allowedApps),
+		AllowedNodeTypes:  splitList(os.Getenv("ALLOWED_NODE_TYPES")),
+		DefaultNodeType:   strings.TrimSpace(os.Getenv("DEFAULT_NODE_TYPE")),
+		NodeNameTemplate:  os.Getenv("NODE_NAME_TEMPLATE"),
+		NodePollInterval:  getEnvDuration("NODE_POLL_INTERVAL", 10*time.Second),
+		ReusableKeys:      getEnvBool("REUSABLE_KEYS", true),
+		QuotaCountOffline: getEnvBool("QUOTA_COUNT_OFFLINE", true),
+		OperatorToken:     os.Getenv("OPERATOR_TOKEN"),
+		AuthEnforce:       getEnvBool("AUTH_ENFORCE", true),
+		NodeTypeTags:      getEnvBool("NODE_TYPE_TAGS", false),
+		AppIDTags:         getEnvBool("APP_ID_TAGS", false),
+		NamespacedUsers:   getEnvBool("HEADSCALE_NAMESPACED_USERS", false),
+		Environment:       os.Getenv("ENVIRONMENT"),
+		NodesCacheMaxAge:  getEnvDuration("NODES_CACHE_MAX_AGE", 0),
+		RetireGracePeriod: getEnvDuration("RETIRE_GRACE_PERIOD", 5*time.Minute),
+		DefaultPageSize:   getEnvInt("DEFAULT_PAGE_SIZE", 0),
+		MaxPageSize:       getEnvInt("MAX_PAGE_SIZE", 1000),
+	}
+	config.PendingGracePeriod = getEnvDuration("NODE_PENDING_GRACE", 2*time.Minute)
+	if len(config.AllowedNodeTypes) == 0 {
+		config.AllowedNodeTypes = []string{"mongodb", "app"}
+	}
+	if config.DefaultPageSize > config.MaxPageSize {
+		log.Printf("Warning: DEFAULT_PAGE_SIZE %d exceeds MAX_PAGE_SIZE, using %d", config.DefaultPageSize, config.MaxPageSize)
+		config.DefaultPageSize = config.MaxPageSize
+	}
+	nodeTypeAliases, err := parseNodeTypeAliases(os.Getenv("NODE_TYPE_ALIASES"), config.AllowedNodeTypes)
+	if err != nil {
+		log.Fatalf("Invalid NODE_TYPE_ALIASES: %v", err)
+	}
+	config.NodeTypeAliases = nodeTypeAliases
+	if canonical, ok := nodeTypeAliases[config.DefaultNodeType]; ok {
+		config.DefaultNodeType = canonical
+	}
+	if label := strings.TrimSpace(os.Getenv("PREAUTH_KEY_LABEL")); label != "" {
+		preAuthKeyLabel = label
+	}
+	maskNodeNames = getEnvBool("MASK_NODE_NAMES", false)
+	headscaleUserDefaults, err = parseUserDefaults(os.Getenv("HEADSCALE_USER_DEFAULTS"))
+	if err != nil {
+		log.Fatalf("Invalid HEADSCALE_USER_DEFAULTS: %v", err)
+	}
+	if !config.AuthEnforce {
+		log.Printf("Warning: AUTH_ENFORCE=false, requests from apps not in ALLOWED_APPS are logged but served")
+	}
+	if config.OperatorToken == "" {
+		log.Printf("Warning: OPERATOR_TOKEN is not set, admin endpoints are disabled")
+	}
+
+	nodeTypeQuotas, err := parseNodeTypeQuotas(os.Getenv("NODE_TYPE_QUOTAS"), config.AllowedNodeTypes)
+	if err != nil {
+		log.Fatalf("Invalid NODE_TYPE_QUOTAS: %v", err)
+	}
+	config.NodeTypeQuotas = nodeTypeQuotas
+
+	nodeTypeAppACL, err := parseNodeTypeAppACL(os.Getenv("NODE_TYPE_APP_ACL"), config.AllowedNodeTypes)
+	if err != nil {
+		log.Fatalf("Invalid NODE_TYPE_APP_ACL: %v", err)
 	}
+	config.NodeTypeAppACL = nodeTypeAppACL
 
-	sharedKey := getOrCreateSharedKey()
+	nodeTypeLifetimes, err := parseNodeTypeLifetimes(os.Getenv("NODE_TYPE_LIFETIMES"), config.AllowedNodeTypes)
+	if err != nil {
+		log.Fatalf("Invalid NODE_TYPE_LIFETIMES: %v", err)
+	}
+	config.NodeTypeLifetimes = nodeTypeLifetimes
 
-	ServerUrl := buildHeadscaleURL()
+	headscaleBreaker = newHeadscaleBreaker(
+		uint32(getEnvInt("HEADSCALE_BREAKER_FAILURES", 5)),
+		getEnvDuration("HEADSCALE_BREAKER_TIMEOUT", 30*time.Second),
+	)
+	extraHeaders, err := parseExtraHeaders(os.Getenv("HEADSCALE_EXTRA_HEADERS"))
+	if err != nil {
+		log.Fatalf("Invalid HEADSCALE_EXTRA_HEADERS: %v", err)
+	}
+	for name := range extraHeaders {
+		log.Printf("Adding header %s to Headscale requests", name)
+	}
+	headscaleClient = newHeadscaleClient(
+		headscaleBreaker,
+		getEnvInt("HEADSCALE_MAX_CONCURRENCY", 10),
+		getEnvDuration("HEADSCALE_QUEUE_TIMEOUT", 5*time.Second),
+		extraHeaders,
+	)
+
+	sharedKeys := newSharedKeyStore("/data", config.AllowedNodeTypes, splitList(os.Getenv("SHARED_KEY_NODE_TYPES")), getEnvBool("SHARED_KEY_PER_APP", false))
+	if err := issuedKeys.load("/data/issued_preauth_keys.json"); err != nil {
+		log.Fatalf("Failed to load issued pre-auth keys: %v", err)
+	}
+	if err := createdUsers.load("/data/created_users.json"); err != nil {
+		log.Fatalf("Failed to load created Headscale users: %v", err)
+	}
+
+	// Background tasks stop on SIGINT/SIGTERM; main waits for them after the
+	// HTTP server has drained.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Gives slower dependencies like Headscale a head start before the
+	// dstack-mesh retries below begin.
+	if err := startupDelay(ctx, getEnvDuration("STARTUP_DELAY", 0)); err != nil {
+		log.Printf("Shutting down during the startup delay")
+		return
+	}
+
+	ServerUrl, gatewayDomain := buildHeadscaleURL()
 	log.Printf("Using Headscale URL: %s", ServerUrl)
 
+	audit, err := newAuditLogger(os.Getenv("AUDIT_LOG_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	state := &AppState{
-		config:       config,
-		nodes:        make(map[string]NodeInfo),
-		sharedKey:    sharedKey,
-		ServerUrl: ServerUrl,
+		config:        config,
+		nodes:         make(map[string]NodeInfo),
+		sharedKeys:    sharedKeys,
+		ServerUrl:     ServerUrl,
+		gatewayDomain: gatewayDomain,
+		watcher:       newNodeWatcher(),
+		self:          &selfCache{name: selfNodeName()},
+		retirements:   newRetirementTracker(),
+		apps:          newAppSet(),
+		modified:      newModificationTracker(),
+		nonces:        newNonceStore(getEnvDuration("BOOTSTRAP_NONCE_TTL", 10*time.Minute)),
+		audit:         audit,
+	}
+
+	if config.DefaultNodeType != "" && !state.isNodeTypeAllowed(config.DefaultNodeType) {
+		log.Fatalf("DEFAULT_NODE_TYPE %q is not one of the allowed node types %v", config.DefaultNodeType, config.AllowedNodeTypes)
+	}
+
+	if err := validateNodeNameTemplate(config.NodeNameTemplate); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("API server %s starting with allowed apps: %v", buildVersion, config.AllowedApps)
+
+	if err := setupTracing(context.Background()); err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	metrics := newRequestMetrics()
+
+	r := newRouter(state, metrics)
+
+	waitForTasks, err := state.startBackgroundTasks(ctx, metrics)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := newHTTPServer(r)
+	// Shutdown waits for connections to go idle, which a watch stream never
+	// does on its own, so end the streams explicitly.
+	srv.RegisterOnShutdown(state.watcher.closeAll)
+	serve := func() error {
+		srv.Addr = ":" + port
+		log.Printf("API server listening on port %s", port)
+		return srv.ListenAndServe()
+	}
+	if socketPath := os.Getenv("LISTEN_SOCKET"); socketPath != "" {
+		listener, err := listenUnix(socketPath, socketMode())
+		if err != nil {
+			log.Fatal(err)
+		}
+		serve = func() error {
+			log.Printf("API server listening on unix socket %s", socketPath)
+			return srv.Serve(listener)
+		}
+	}
+
+	if err := serveUntilDone(ctx, srv, serve, getEnvDuration("SHUTDOWN_TIMEOUT", 10*time.Second)); err != nil {
+		log.Fatal(err)
+	}
+	waitForTasks()
+	log.Printf("Shut down cleanly")
+}
+
+// startBackgroundTasks starts the pollers, cleanups and emitters configured
+// in the environment. They run until ctx is cancelled; the returned function
+// waits for all of them to return and then closes what they used.
+func (s *AppState) startBackgroundTasks(ctx context.Context, metrics *requestMetrics) (func(), error) {
+	config := s.config
+	s.ctx = ctx
+
+	probeTargets, err := parseProbeTargets(os.Getenv("PROBE_PORTS"), os.Getenv("PROBE_INTERVALS"), config.AllowedNodeTypes, getEnvDuration("PROBE_INTERVAL", 30*time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROBE_PORTS or PROBE_INTERVALS: %w", err)
+	}
+	var statsd *statsdEmitter
+	if addr := os.Getenv("STATSD_ADDR"); addr != "" {
+		prefix := os.Getenv("STATSD_PREFIX")
+		if prefix == "" {
+			prefix = "vpc_api"
+		}
+		statsd, err = newStatsdEmitter(addr, prefix, metrics)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	log.Printf("API server starting with allowed apps: %v", config.AllowedApps)
+	// The prober must be set before the poller and handlers can read it.
+	if len(probeTargets) > 0 {
+		s.prober = newNodeProber(getEnvDuration("PROBE_TIMEOUT", 2*time.Second))
+		for nodeType, target := range probeTargets {
+			nodeType, target := nodeType, target
+			s.spawn(func() { s.runProbes(ctx, nodeType, target) })
+		}
+	}
 
-	r := gin.Default()
+	s.spawn(func() { s.warmUp(ctx) })
+	s.spawn(func() { checkHeadscaleVersion(ctx) })
+	s.spawn(func() { s.pollNodes(ctx, config.NodePollInterval) })
+	s.spawn(func() { s.nonces.runEviction(ctx, time.Minute) })
+	if config.NamespacedUsers && getEnvBool("USER_GC", true) {
+		s.spawn(func() {
+			runUserGC(ctx, getEnvDuration("USER_GC_INTERVAL", time.Hour), getEnvDuration("USER_GC_IDLE", 7*24*time.Hour))
+		})
+	}
+	if len(config.NodeTypeLifetimes) > 0 {
+		s.spawn(func() { s.runNodeExpiry(ctx, getEnvDuration("NODE_EXPIRY_INTERVAL", time.Minute)) })
+	}
+	if getEnvBool("PREAUTH_KEY_CLEANUP", true) {
+		s.spawn(func() { runPreAuthKeyCleanup(ctx, getEnvDuration("PREAUTH_KEY_CLEANUP_INTERVAL", time.Hour)) })
+	}
+	if statsd != nil {
+		interval := getEnvDuration("STATSD_FLUSH_INTERVAL", 10*time.Second)
+		log.Printf("Sending metrics to StatsD at %s every %s", os.Getenv("STATSD_ADDR"), interval)
+		s.spawn(func() { statsd.run(ctx, interval) })
+	}
+
+	return func() {
+		s.tasks.Wait()
+		if statsd != nil {
+			statsd.close()
+		}
+	}, nil
+}
+
+// newRouter sets up the middleware and routes of the API.
+func newRouter(state *AppState, metrics *requestMetrics) *gin.Engine {
+	r := gin.New()
+	// Without TRUSTED_PROXIES gin's default of trusting X-Forwarded-For from
+	// any peer stays in place.
+	if proxies := splitList(os.Getenv("TRUSTED_PROXIES")); len(proxies) > 0 {
+		if err := r.SetTrustedProxies(proxies); err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+		}
+	}
+	r.Use(requestLogger(splitList(os.Getenv("LOG_SAMPLE_PATHS")), getEnvInt("LOG_SAMPLE_RATE", 1)))
+	r.Use(metrics.middleware)
+	r.Use(gin.Recovery())
+	r.Use(environmentHeader(state.config.Environment))
+	r.Use(otelgin.Middleware(serviceName))
+	r.Use(prettyJSON(os.Getenv("DEV_MODE") == "true" && os.Getenv("PRETTY_JSON") == "true"))
+	r.Use(state.auditBootstrap)
+	r.Use(strictQuery(getEnvBool("STRICT_QUERY", false)))
 
 	r.Use(func(c *gin.Context) {
-		if c.Request.URL.Path == "/health" {
+		if c.Request.URL.Path == "/health" || c.Request.URL.Path == "/ready" {
 			c.Next()
 			return
 		}
@@ -384,6 +1249,11 @@ func main() {
 		}
 
 		if !state.isAppAllowed(appID) {
+			if !state.config.AuthEnforce {
+				log.Printf("auth would-reject app_id=%q method=%s path=%s client_ip=%s", appID, c.Request.Method, c.Request.URL.Path, c.ClientIP())
+				c.Next()
+				return
+			}
 			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
 			c.Abort()
 			return
@@ -392,52 +1262,392 @@ func main() {
 		c.Next()
 	})
 
-	r.GET("/api/register", func(c *gin.Context) {
+	faults := faultInjectionFromEnv()
+
+	r.GET("/api/register", state.rejectDuringMaintenance, faults.inject, func(c *gin.Context) {
 		instanceUUID := c.Query("instance_id")
 		nodeName := c.Query("node_name")
+		nodeType := state.canonicalNodeType(c.Query("node_type"))
 
 		if instanceUUID == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required parameters"})
 			return
 		}
 
-		preAuthKey, err := generatePreAuthKey()
+		if nodeType == "" {
+			nodeType = state.config.DefaultNodeType
+		}
+		if nodeType != "" && !state.isNodeTypeAllowed(nodeType) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid node_type, must be one of %v", state.config.AllowedNodeTypes)})
+			return
+		}
+		if appID := c.GetHeader("x-dstack-app-id"); !state.isAppAllowedForType(appID, nodeType) {
+			if !state.config.AuthEnforce {
+				log.Printf("auth would-reject app_id=%q node_type=%s, not in NODE_TYPE_APP_ACL", appID, nodeType)
+			} else {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error": fmt.Sprintf("App %s may not bootstrap %s nodes", appID, nodeType),
+					"code":  "node_type_not_allowed",
+				})
+				return
+			}
+		}
+
+		clientRef, err := sanitizeClientRef(c.Query("client_ref"))
 		if err != nil {
-			log.Printf("Failed to generate pre-auth key: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate pre-auth key"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// An optional nonce makes the request single-use within
+		// BOOTSTRAP_NONCE_TTL, so a captured request can't be replayed.
+		nonce := c.Query("nonce")
+		if len(nonce) > maxNonceLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("nonce must be at most %d characters long", maxNonceLength)})
+			return
+		}
+
+		keyfileFormat := c.Query("keyfile_format")
+		if !validKeyfileFormat(keyfileFormat) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid keyfile_format, must be one of base64, hex, raw"})
 			return
 		}
 
+		// node_key registers a node that generated its own keys and is
+		// waiting at its login URL, instead of issuing a pre-auth key.
+		nodeKey := c.Query("node_key")
+		if nodeKey != "" {
+			if !validRegistrationKey.MatchString(nodeKey) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid node_key, expected the registration key from the node's login URL"})
+				return
+			}
+			if c.Query("tags") != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "tags cannot be applied to nodes registered with node_key"})
+				return
+			}
+		}
+
+		priority := 0
+		if v := c.Query("priority"); v != "" {
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid priority, expected an integer"})
+				return
+			}
+			priority = p
+		}
+
+		// wait=active holds the response until the node has joined.
+		waitActive := false
+		switch c.Query("wait") {
+		case "":
+		case "active":
+			waitActive = true
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid wait, must be active"})
+			return
+		}
+		// SSE clients get progress events instead, which implies wait=active.
+		streamProgress := strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+		// A raw keyfile is the whole response body, which leaves no room to
+		// report the node's progress.
+		if keyfileFormat == keyfileRaw && (waitActive || streamProgress) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "keyfile_format=raw cannot be combined with wait=active or event streams"})
+			return
+		}
+		waitTimeout := defaultBootstrapWait
+		if v := c.Query("timeout"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > maxBootstrapWait {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid timeout, expected a duration up to %s", maxBootstrapWait)})
+				return
+			}
+			waitTimeout = d
+		}
+
 		if nodeName == "" {
-			nodeName = fmt.Sprintf("node-%s", instanceUUID)
+			if state.config.NodeNameTemplate != "" {
+				rendered, err := renderNodeName(state.config.NodeNameTemplate, nodeType, instanceUUID)
+				if err != nil {
+					log.Printf("Failed to render node name: %v", err)
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to derive node name, please provide node_name"})
+					return
+				}
+				nodeName = rendered
+			} else {
+				nodeName = fmt.Sprintf("node-%s", instanceUUID)
+			}
+		}
+
+		c.Set("node_type", nodeType)
+		c.Set("node_name", nodeName)
+
+		// The quota check only holds until the node is stored, so other
+		// bootstraps of the type wait for this one to finish or fail.
+		unlockQuota := func() {}
+		if _, ok := state.config.NodeTypeQuotas[nodeType]; ok {
+			unlockQuota = state.quotaLocks.lock(nodeType)
+			defer unlockQuota()
+		}
+		if exceeded, quota, count := state.quotaExceeded(c.Request.Context(), nodeType, instanceUUID); exceeded {
+			log.Printf("Rejecting bootstrap of %s (%s): node type %s is at its quota of %d", logName(nodeName), instanceUUID, nodeType, quota)
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": fmt.Sprintf("Quota of %d nodes for node type %s reached (%d registered)", quota, nodeType, count),
+				"code":  "quota_exceeded",
+			})
+			return
+		}
+
+		// The nonce is only spent by a bootstrap that succeeds, so a failed
+		// attempt can be retried with it.
+		bootstrapped := false
+		if nonce != "" {
+			if !state.nonces.use(c.GetHeader("x-dstack-app-id"), nonce, time.Now()) {
+				log.Printf("Rejecting bootstrap of %s (%s): nonce was already used", logName(nodeName), instanceUUID)
+				c.JSON(http.StatusConflict, gin.H{"error": "Nonce was already used", "code": "nonce_reused"})
+				return
+			}
+			defer func() {
+				if !bootstrapped {
+					state.nonces.release(c.GetHeader("x-dstack-app-id"), nonce)
+				}
+			}()
 		}
 
+		sharedKey, err := state.sharedKeys.forNode(c.GetHeader("x-dstack-app-id"), nodeType)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid app id for keyfile"})
+			return
+		}
+		encodedKey, err := encodeKeyfile(sharedKey, keyfileFormat)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sharedKey = string(encodedKey)
+
+		aclTags := splitList(c.Query("tags"))
+		if len(aclTags) > 0 {
+			invalid, err := headscalePolicy.invalidTags(c.Request.Context(), aclTags)
+			if err != nil {
+				// Leave the final say to Headscale if the policy is unavailable.
+				log.Printf("Skipping ACL tag validation, failed to load Headscale policy: %v", err)
+			} else if len(invalid) > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "ACL tags not defined in Headscale policy", "invalid_tags": invalid})
+				return
+			}
+		}
+
+		// Tags we add ourselves must be in the policy; a missing one is a
+		// server setup problem rather than a client error.
+		var autoTags []string
+		if state.config.NodeTypeTags && nodeType != "" {
+			autoTags = append(autoTags, nodeTypeTag(nodeType))
+		}
+		if state.config.AppIDTags {
+			if tag := appIDTag(c.GetHeader("x-dstack-app-id")); tag != "" {
+				autoTags = append(autoTags, tag)
+			}
+		}
+		if len(autoTags) > 0 {
+			invalid, err := headscalePolicy.invalidTags(c.Request.Context(), autoTags)
+			if err != nil {
+				log.Printf("Skipping automatic tag validation, failed to load Headscale policy: %v", err)
+			} else if len(invalid) > 0 {
+				log.Printf("Tags %v are not defined in the Headscale policy, add them to tagOwners", invalid)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Automatic ACL tags not defined in Headscale policy", "invalid_tags": invalid})
+				return
+			}
+			aclTags = append(aclTags, autoTags...)
+		}
+
+		var user string
+		if state.config.NamespacedUsers {
+			user, err = headscaleUserName(c.GetHeader("x-dstack-app-id"), nodeType)
+			if err != nil {
+				log.Printf("Rejecting bootstrap of %s (%s): %v", logName(nodeName), instanceUUID, err)
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		keyOptions := PreAuthKeyOptions{
+			Reusable: state.config.ReusableKeys,
+			AclTags:  aclTags,
+			User:     user,
+		}
+
+		var preAuthKey string
+		var keyExpiresAt time.Time
+		var registered *HeadscaleNode
+		if nodeKey != "" {
+			if len(aclTags) > 0 {
+				log.Printf("Tags %v are not applied to %s, it was registered with node_key", aclTags, logName(nodeName))
+			}
+			if user == "" {
+				user = "default"
+			}
+			hsNode, err := registerHeadscaleNode(c.Request.Context(), user, nodeKey)
+			if err != nil {
+				log.Printf("Failed to register node %s: %v", logName(nodeName), err)
+				c.JSON(headscaleErrorStatus(err), bootstrapErrorBody(err, "Failed to register node"))
+				return
+			}
+			registered = &hsNode
+		} else {
+			preAuthKey, keyExpiresAt, err = generatePreAuthKey(c.Request.Context(), keyOptions)
+			if err != nil {
+				log.Printf("Failed to generate pre-auth key: %v", err)
+				c.JSON(headscaleErrorStatus(err), bootstrapErrorBody(err, "Failed to generate pre-auth key"))
+				return
+			}
+		}
+
+		now := time.Now().UTC()
 		nodeInfo := NodeInfo{
+			ID:          instanceUUID,
 			UUID:        instanceUUID,
 			Name:        nodeName,
+			NodeType:    nodeType,
 			TailscaleIP: nil,
+			Source:      sourceBootstrap,
+			CreatedAt:   &now,
+			Priority:    priority,
+			Verified:    state.isAppAttested(c.GetHeader("x-dstack-app-id")),
+			AppID:       c.GetHeader("x-dstack-app-id"),
+			ClientRef:   clientRef,
+			BootstrapIP: c.ClientIP(),
+			authKey:     preAuthKey,
+			keyOptions:  keyOptions,
+		}
+
+		if registered != nil {
+			applyHeadscaleState(&nodeInfo, *registered)
 		}
 
-		state.mutex.Lock()
-		state.nodes[instanceUUID] = nodeInfo
-		state.mutex.Unlock()
+		state.putNode(nodeInfo)
+		state.apps.add(nodeInfo.AppID)
+		bootstrapped = true
+		unlockQuota()
 
 		response := BootstrapResponse{
-			PreAuthKey:   preAuthKey,
-			SharedKey:    state.sharedKey,
-			ServerUrl: state.ServerUrl,
+			PreAuthKey: preAuthKey,
+			SharedKey:  sharedKey,
+			ServerUrl:  state.ServerUrl,
+			ClientRef:  clientRef,
+		}
+		if preAuthKey != "" {
+			response.KeyExpiresAt = &keyExpiresAt
+		}
+		if registered != nil {
+			response.NodeID = registered.ID
+			if nodeInfo.TailscaleIP != nil {
+				response.TailscaleIP = *nodeInfo.TailscaleIP
+			}
+		}
+		if c.Query("include_gateway") == "true" {
+			response.GatewayDomain = state.gatewayDomain
+		}
+
+		log.Printf("Bootstrap request from %s (%s)", logName(nodeName), instanceUUID)
+
+		if keyfileFormat == keyfileRaw {
+			writeRawBootstrap(c, response)
+			return
+		}
+
+		if streamProgress {
+			state.streamBootstrap(c, response, instanceUUID, waitTimeout)
+			return
+		}
+
+		if waitActive {
+			// A node that didn't join in time isn't a failure, the key is
+			// still valid; report where it got to with 202.
+			node, active := state.waitForActive(c.Request.Context(), instanceUUID, waitTimeout, nil)
+			response.Node = &node
+			if !active {
+				log.Printf("Node %s (%s) not active after %s, status %s", logName(nodeName), instanceUUID, waitTimeout, node.Status)
+				c.JSON(http.StatusAccepted, response)
+				return
+			}
 		}
 
-		log.Printf("Bootstrap request from %s (%s)", nodeName, instanceUUID)
 		c.JSON(http.StatusOK, response)
 	})
 
+	r.POST("/api/bootstrap/validate", state.handleValidateBootstrap)
+
+	r.GET("/api/nodes", state.handleListNodes)
+	r.GET("/api/nodes/ips", state.handleNodeIPs)
+	r.GET("/api/nodes/watch", state.handleWatchNodes)
+	r.GET("/api/nodes/by-name/:name", state.handleNodeByName)
+	r.DELETE("/api/nodes", state.requireOperator, state.handleDeleteNodes)
+	r.POST("/api/nodes/rekey", state.requireOperator, state.handleRekeyNodes)
+	r.POST("/api/nodes/:name/expire", state.requireOperator, state.handleExpireNode)
+	r.POST("/api/nodes/:name/drain", state.requireOperator, state.handleDrainNode)
+	r.POST("/api/nodes/:name/undrain", state.requireOperator, state.handleUndrainNode)
+	r.POST("/api/nodes/:name/retire", state.requireOperator, state.handleRetireNode)
+	r.GET("/api/nodes/:name/retire", state.requireOperator, state.handleRetirementStatus)
+	// The wildcard must share its name with the routes above; it is an
+	// instance id here.
+	r.POST("/api/nodes/:name/rekey", state.rejectDuringMaintenance, state.handleRekeyNode)
+	r.POST("/api/nodes/:name/routes", state.requireOperator, state.handleApproveRoutes)
+
+	r.GET("/api/acl/hosts", state.handleACLHosts)
+	r.GET("/api/stats", state.handleStats)
+	r.GET("/api/health/node-type/:type", state.handleNodeTypeHealth)
+	r.GET("/api/debug/headscale/nodes", state.requireOperator, state.handleDebugHeadscaleNodes)
+	r.GET("/api/self", state.handleSelf)
+	r.GET("/api/config", state.handleConfig)
+	r.GET("/version", state.handleVersion)
+
+	r.GET("/api/preauthkeys", state.requireOperator, handleListPreAuthKeys)
+
+	r.GET("/api/keyfile", state.handleGetSharedKey)
+	r.POST("/api/keyfile/rotate", state.requireOperator, state.handleRotateSharedKey)
+
+	r.POST("/api/maintenance", state.requireOperator, state.handleEnableMaintenance)
+	r.DELETE("/api/maintenance", state.requireOperator, state.handleDisableMaintenance)
+
 	healthHandler := func(c *gin.Context) {
 		c.String(http.StatusOK, "OK")
 	}
 	r.GET("/health", healthHandler)
 	r.HEAD("/health", healthHandler)
 
-	log.Printf("API server listening on port %s", port)
-	r.Run(":" + port)
+	// Prometheus and StatsD export the same counters and can run together.
+	// Route names reveal what tenants call, so scrapers need an allowed app
+	// id like any other client.
+	if getEnvBool("PROMETHEUS_METRICS", true) {
+		r.GET("/metrics", metrics.handleMetrics)
+	}
+
+	readiness := newReadinessChecker(os.Getenv("VPC_SERVER_URL") == "")
+	r.GET("/ready", func(c *gin.Context) {
+		if !state.warm.Load() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":    "warming_up",
+				"headscale": headscaleBreaker.State().String(),
+			})
+			return
+		}
+		if failed, err := readiness.Run(c.Request.Context()); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":       "not_ready",
+				"failed_check": failed,
+				"error":        err.Error(),
+				"headscale":    headscaleBreaker.State().String(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status":      "ready",
+			"checks":      readiness.Names(),
+			"maintenance": state.maintenance.Load(),
+			"headscale":   headscaleBreaker.State().String(),
+		})
+	})
+
+	return r
 }
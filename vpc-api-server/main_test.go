@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetAPIKeyFromFile(t *testing.T) {
+	t.Setenv("HEADSCALE_API_KEY", "")
+	path := filepath.Join(t.TempDir(), "api_key")
+	t.Setenv("HEADSCALE_API_KEY_FILE", path)
+
+	if _, err := getAPIKey(); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("missing file: got %v, want a does-not-exist error", err)
+	}
+
+	if err := os.WriteFile(path, []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getAPIKey(); err == nil || !strings.Contains(err.Error(), "is empty") {
+		t.Errorf("empty file: got %v, want an is-empty error", err)
+	}
+
+	if err := os.WriteFile(path, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := getAPIKey(); err != nil || key != "secret" {
+		t.Errorf("got %q, %v, want the trimmed key", key, err)
+	}
+}
+
+func TestGetAPIKeyBlankEnv(t *testing.T) {
+	t.Setenv("HEADSCALE_API_KEY", "  ")
+	if _, err := getAPIKey(); err == nil || !strings.Contains(err.Error(), "is empty") {
+		t.Errorf("got %v, want an is-empty error", err)
+	}
+}
+
+func TestValidateServerURL(t *testing.T) {
+	valid := []string{
+		"https://abc-8080.gw.example.com",
+		"http://headscale:8080",
+		"http://10.0.0.1:8080",
+	}
+	for _, u := range valid {
+		if err := validateServerURL(u); err != nil {
+			t.Errorf("validateServerURL(%q): %v", u, err)
+		}
+	}
+
+	invalid := []string{
+		"https://abc-8080.gw..example.com",
+		"https://abc-8080.-gw.example.com",
+		"https://abc-8080.gw_example.com",
+		"https://",
+		"ftp://headscale:8080",
+	}
+	for _, u := range invalid {
+		if err := validateServerURL(u); err == nil {
+			t.Errorf("validateServerURL(%q): got no error", u)
+		}
+	}
+}
+
+// useDstackMesh points the dstack-mesh helpers at a fake answering with
+// appID and gatewayDomain.
+func useDstackMesh(t *testing.T, appID, gatewayDomain string) {
+	t.Helper()
+
+	mesh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/info":
+			writeFakeJSON(w, http.StatusOK, DstackInfo{AppID: appID})
+		case "/gateway":
+			writeFakeJSON(w, http.StatusOK, GatewayInfo{GatewayDomain: gatewayDomain})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(mesh.Close)
+
+	prev := dstackMeshURL
+	dstackMeshURL = mesh.URL
+	t.Cleanup(func() { dstackMeshURL = prev })
+}
+
+func TestBuildHeadscaleURLRejectsGarbageGateway(t *testing.T) {
+	t.Setenv("VPC_SERVER_URL", "")
+
+	useDstackMesh(t, "abc", "gw.example.com")
+	if serverURL, domain := buildHeadscaleURL(); serverURL != "https://abc-8080.gw.example.com" || domain != "gw.example.com" {
+		t.Errorf("got %q, %q, want the detected URL", serverURL, domain)
+	}
+
+	useDstackMesh(t, "abc", "gw example..com")
+	if serverURL, domain := buildHeadscaleURL(); serverURL != "http://headscale:8080" || domain != "" {
+		t.Errorf("got %q, %q, want the default URL", serverURL, domain)
+	}
+}
+
+func TestSoftAuthLogsInsteadOfRejecting(t *testing.T) {
+	newFakeHeadscale(t)
+	for _, enforce := range []bool{true, false} {
+		_, r := newTestServer(t, func(c *Config) {
+			c.AllowedApps = []string{"app-a"}
+			c.AuthEnforce = enforce
+		})
+		logs := captureLog(t)
+
+		req := newRequest("GET", "/api/nodes")
+		req.Header.Set("x-dstack-app-id", "intruder")
+		w := serve(r, req)
+		switch {
+		case enforce && w.Code != http.StatusForbidden:
+			t.Errorf("enforcing: got status %d, want 403", w.Code)
+		case !enforce && w.Code != http.StatusOK:
+			t.Errorf("not enforcing: got status %d, want 200", w.Code)
+		}
+		if logged := strings.Contains(logs.String(), `auth would-reject app_id="intruder"`); logged == enforce {
+			t.Errorf("enforce=%v: would-reject logged = %v", enforce, logged)
+		}
+
+		req = httptest.NewRequest("GET", "/api/nodes", nil)
+		if w := serve(r, req); w.Code != http.StatusUnauthorized {
+			t.Errorf("enforce=%v without an app id: got status %d, want 401", enforce, w.Code)
+		}
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	start := time.Now()
+	if err := startupDelay(context.Background(), 50*time.Millisecond); err != nil {
+		t.Fatalf("startupDelay: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("returned after %s, want at least 50ms", elapsed)
+	}
+
+	if err := startupDelay(context.Background(), 0); err != nil {
+		t.Errorf("no delay: %v", err)
+	}
+}
+
+func TestStartupDelayCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := startupDelay(ctx, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("returned after %s, want it to stop on cancel", elapsed)
+	}
+}
+
+func TestBackgroundTasksStopOnCancel(t *testing.T) {
+	newFakeHeadscale(t)
+	state, _ := newTestServer(t, func(c *Config) {
+		c.NamespacedUsers = true
+		c.NodeTypeLifetimes = map[string]time.Duration{"mongodb": time.Hour}
+		c.NodePollInterval = 10 * time.Millisecond
+	})
+	for name, value := range map[string]string{
+		"PROBE_PORTS":                  "mongodb=27017",
+		"PROBE_INTERVAL":               "10ms",
+		"STATSD_ADDR":                  "127.0.0.1:8125",
+		"STATSD_FLUSH_INTERVAL":        "10ms",
+		"USER_GC_INTERVAL":             "10ms",
+		"NODE_EXPIRY_INTERVAL":         "10ms",
+		"PREAUTH_KEY_CLEANUP_INTERVAL": "10ms",
+	} {
+		t.Setenv(name, value)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wait, err := state.startBackgroundTasks(ctx, newRequestMetrics())
+	if err != nil {
+		t.Fatalf("startBackgroundTasks: %v", err)
+	}
+	// Let every task get through a few rounds before shutting down.
+	time.Sleep(50 * time.Millisecond)
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("background tasks still running 2s after cancel")
+	}
+}
+
+func TestBackgroundTasksRejectBadConfig(t *testing.T) {
+	state, _ := newTestServer(t, nil)
+	t.Setenv("PROBE_PORTS", "redis=6379")
+	if _, err := state.startBackgroundTasks(context.Background(), newRequestMetrics()); err == nil {
+		t.Errorf("startBackgroundTasks accepted a probe for an unknown node type")
+	}
+}
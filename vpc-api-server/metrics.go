@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestKey labels a request count. Route is gin's route template, so
+// /api/nodes/:name/drain counts as one route whatever the name.
+type requestKey struct {
+	Route       string
+	Method      string
+	StatusClass string
+}
+
+// requestMetrics counts requests per route, method and status class and
+// serves them in the Prometheus text format.
+type requestMetrics struct {
+	mutex  sync.Mutex
+	counts map[requestKey]uint64
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{counts: make(map[requestKey]uint64)}
+}
+
+// statusClass turns 404 into "4xx".
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// middleware must run before gin.Recovery so recovered panics are counted as
+// the 500 they turn into.
+func (m *requestMetrics) middleware(c *gin.Context) {
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		// Unknown paths share one label instead of one per raw path.
+		route = "unmatched"
+	}
+	key := requestKey{Route: route, Method: c.Request.Method, StatusClass: statusClass(c.Writer.Status())}
+
+	m.mutex.Lock()
+	m.counts[key]++
+	m.mutex.Unlock()
+}
+
+// snapshot returns a copy of the counts.
+func (m *requestMetrics) snapshot() map[requestKey]uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counts := make(map[requestKey]uint64, len(m.counts))
+	for key, count := range m.counts {
+		counts[key] = count
+	}
+	return counts
+}
+
+func (m *requestMetrics) handleMetrics(c *gin.Context) {
+	counts := m.snapshot()
+	keys := make([]requestKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Route != keys[j].Route {
+			return keys[i].Route < keys[j].Route
+		}
+		if keys[i].Method != keys[j].Method {
+			return keys[i].Method < keys[j].Method
+		}
+		return keys[i].StatusClass < keys[j].StatusClass
+	})
+
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(c.Writer, "# HELP vpc_api_http_requests_total HTTP requests by route template, method and status class.")
+	fmt.Fprintln(c.Writer, "# TYPE vpc_api_http_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(c.Writer, "vpc_api_http_requests_total{route=%q,method=%q,status_class=%q} %d\n",
+			key.Route, key.Method, key.StatusClass, counts[key])
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRequireAppID(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.AllowedApps = []string{testAppID} })
+
+	if w := serve(r, httptest.NewRequest("GET", "/metrics", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("without an app id: got status %d, want 401", w.Code)
+	}
+	req := newRequest("GET", "/metrics")
+	req.Header.Set("x-dstack-app-id", "intruder")
+	if w := serve(r, req); w.Code != http.StatusForbidden {
+		t.Errorf("disallowed app: got status %d, want 403", w.Code)
+	}
+	if w := serve(r, newRequest("GET", "/metrics")); w.Code != http.StatusOK {
+		t.Errorf("allowed app: got status %d, want 200", w.Code)
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+
+	serve(r, newRequest("GET", "/api/nodes"))
+	serve(r, newRequest("GET", "/api/nodes"))
+	serve(r, newOperatorRequest("POST", "/api/nodes/mongo-1/drain"))
+	serve(r, newOperatorRequest("POST", "/api/nodes/missing/drain"))
+	serve(r, newRequest("GET", "/no/such/route"))
+	serve(r, newRequest("GET", "/another/missing/route"))
+
+	w := serve(r, newRequest("GET", "/metrics"))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	for _, line := range []string{
+		`vpc_api_http_requests_total{route="/api/nodes",method="GET",status_class="2xx"} 2`,
+		`vpc_api_http_requests_total{route="/api/nodes/:name/drain",method="POST",status_class="2xx"} 1`,
+		`vpc_api_http_requests_total{route="/api/nodes/:name/drain",method="POST",status_class="4xx"} 1`,
+		`vpc_api_http_requests_total{route="unmatched",method="GET",status_class="4xx"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, w.Body)
+		}
+	}
+	if strings.Contains(w.Body.String(), "mongo-1") || strings.Contains(w.Body.String(), "/no/such/route") {
+		t.Errorf("raw paths leaked into labels:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// modificationTracker remembers, by node ID, a fingerprint of every node it
+// has been shown and when that fingerprint last changed, for
+// /api/nodes?modified_since=. Times are lost on restart, so every node counts
+// as modified when it is first seen afterwards.
+type modificationTracker struct {
+	mutex sync.Mutex
+	seen  map[string]nodeModification
+}
+
+type nodeModification struct {
+	fingerprint uint64
+	at          time.Time
+}
+
+func newModificationTracker() *modificationTracker {
+	return &modificationTracker{seen: make(map[string]nodeModification)}
+}
+
+// nodeFingerprint hashes the fields a client can see. LastSeen and Debug are
+// left out: lastSeen moves on every Headscale heartbeat and would mark every
+// online node as modified on every poll.
+func nodeFingerprint(node NodeInfo) uint64 {
+	node.LastModified = nil
+	node.LastSeen = nil
+	node.Debug = nil
+	data, _ := json.Marshal(node)
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// stamp sets LastModified on each node, moving it to now for nodes that
+// changed since they were last stamped.
+func (t *modificationTracker) stamp(nodes []NodeInfo, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i := range nodes {
+		fingerprint := nodeFingerprint(nodes[i])
+		mod, ok := t.seen[nodes[i].ID]
+		if !ok || mod.fingerprint != fingerprint {
+			mod = nodeModification{fingerprint: fingerprint, at: now}
+			t.seen[nodes[i].ID] = mod
+		}
+		at := mod.at
+		nodes[i].LastModified = &at
+	}
+}
+
+// forget drops a deleted node so a node later registered under the same key
+// starts fresh.
+func (t *modificationTracker) forget(id string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.seen, id)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestModificationTrackerIgnoresLastSeen(t *testing.T) {
+	tracker := newModificationTracker()
+	t0 := time.Now()
+	t1 := t0.Add(time.Minute)
+	seen := t1
+
+	nodes := []NodeInfo{{ID: "i1", UUID: "i1", Name: "mongo-1", Online: true}}
+	tracker.stamp(nodes, t0)
+	nodes[0].LastSeen = &seen
+	tracker.stamp(nodes, t1)
+	if !nodes[0].LastModified.Equal(t0) {
+		t.Errorf("last_seen moved last_modified to %s, want %s", nodes[0].LastModified, t0)
+	}
+
+	nodes[0].Online = false
+	tracker.stamp(nodes, t1)
+	if !nodes[0].LastModified.Equal(t1) {
+		t.Errorf("going offline left last_modified at %s, want %s", nodes[0].LastModified, t1)
+	}
+
+	tracker.forget("i1")
+	nodes[0].LastModified = nil
+	t2 := t1.Add(time.Minute)
+	tracker.stamp(nodes, t2)
+	if !nodes[0].LastModified.Equal(t2) {
+		t.Errorf("forgotten node got last_modified %s, want %s", nodes[0].LastModified, t2)
+	}
+}
+
+func TestListNodesModifiedSince(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "mongo-2", NodeType: "mongodb"})
+
+	if w := serve(r, newRequest("GET", "/api/nodes")); w.Code != http.StatusOK {
+		t.Fatalf("list: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	since := time.Now()
+	hs.updateNodes("mongo-2", func(n *HeadscaleNode) { n.Online = false })
+
+	w := serve(r, newRequest("GET", "/api/nodes?modified_since="+url.QueryEscape(since.Format(time.RFC3339Nano))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp NodesResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if len(resp.Nodes) != 1 || resp.Nodes[0].UUID != "i2" {
+		t.Errorf("got nodes %+v, want only i2", resp.Nodes)
+	}
+
+	if w := serve(r, newRequest("GET", "/api/nodes?modified_since=yesterday")); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid modified_since: got status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+const mimeYAML = "application/yaml"
+
+// negotiateFormat picks JSON or YAML from the Accept header, returning "" if
+// the client accepts neither. JSON is the default.
+func negotiateFormat(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return gin.MIMEJSON
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case gin.MIMEJSON, "*/*", "application/*":
+			return gin.MIMEJSON
+		case mimeYAML, "application/x-yaml", "text/yaml":
+			return mimeYAML
+		}
+	}
+	return ""
+}
+
+// respondNegotiated writes obj as JSON or YAML depending on the Accept
+// header, or 406 if neither is acceptable. YAML is produced from the JSON
+// encoding so both formats use the same field names.
+func respondNegotiated(c *gin.Context, status int, obj any) {
+	switch negotiateFormat(c.GetHeader("Accept")) {
+	case gin.MIMEJSON:
+		c.JSON(status, obj)
+	case mimeYAML:
+		data, err := toYAML(obj)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+			return
+		}
+		c.Data(status, mimeYAML+"; charset=utf-8", data)
+	default:
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": "Unsupported Accept type, use application/json or application/yaml"})
+	}
+}
+
+func toYAML(obj any) ([]byte, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var generic any
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                                    "application/json",
+		"*/*":                                 "application/json",
+		"application/json":                    "application/json",
+		"application/yaml":                    mimeYAML,
+		"text/yaml; charset=utf-8":            mimeYAML,
+		"text/html, application/x-yaml;q=0.9": mimeYAML,
+		"text/html":                           "",
+	} {
+		if got := negotiateFormat(accept); got != want {
+			t.Errorf("negotiateFormat(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestStatsAsYAML(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	syncWatcher(t, state)
+
+	req := newRequest("GET", "/api/stats")
+	req.Header.Set("Accept", "application/yaml")
+	w := serve(r, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, mimeYAML) {
+		t.Errorf("Content-Type = %q, want YAML", ct)
+	}
+	var stats map[string]any
+	if err := yaml.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("invalid YAML: %v", err)
+	}
+	if stats["total"] != 1 {
+		t.Errorf("total = %v, want 1 under its JSON name", stats["total"])
+	}
+
+	req = newRequest("GET", "/api/stats")
+	req.Header.Set("Accept", "text/html")
+	if w := serve(r, req); w.Code != http.StatusNotAcceptable {
+		t.Errorf("Accept text/html: got status %d, want 406", w.Code)
+	}
+}
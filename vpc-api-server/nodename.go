@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxNodeNameLength is the DNS label limit; Headscale derives the node's
+// MagicDNS name from it.
+const maxNodeNameLength = 63
+
+// sanitizeNodeName lowercases name and replaces anything that isn't valid in
+// a DNS label with '-', trimming the result to maxNodeNameLength.
+func sanitizeNodeName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+
+	sanitized := b.String()
+	if len(sanitized) > maxNodeNameLength {
+		sanitized = sanitized[:maxNodeNameLength]
+	}
+	return strings.Trim(sanitized, "-")
+}
+
+// renderNodeName expands NODE_NAME_TEMPLATE placeholders ({node_type},
+// {instance_id}, {short_id}) and sanitizes the result.
+func renderNodeName(template, nodeType, instanceID string) (string, error) {
+	shortID := instanceID
+	if len(shortID) > 8 {
+		shortID = shortID[:8]
+	}
+
+	rendered := strings.NewReplacer(
+		"{node_type}", nodeType,
+		"{instance_id}", instanceID,
+		"{short_id}", shortID,
+	).Replace(template)
+
+	name := sanitizeNodeName(rendered)
+	if name == "" {
+		return "", fmt.Errorf("node name template %q rendered an empty name", template)
+	}
+	return name, nil
+}
+
+// validateNodeNameTemplate rejects templates with unknown placeholders.
+func validateNodeNameTemplate(template string) error {
+	rendered := strings.NewReplacer(
+		"{node_type}", "",
+		"{instance_id}", "",
+		"{short_id}", "",
+	).Replace(template)
+	if strings.ContainsAny(rendered, "{}") {
+		return fmt.Errorf("NODE_NAME_TEMPLATE %q contains an unknown placeholder, supported: {node_type}, {instance_id}, {short_id}", template)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRenderNodeName(t *testing.T) {
+	tests := []struct {
+		template, nodeType, instanceID string
+		want                           string
+	}{
+		{"{node_type}-{short_id}", "mongodb", "0123456789abcdef", "mongodb-01234567"},
+		{"{node_type}-{instance_id}", "app", "abc", "app-abc"},
+		{"VPC_{node_type}.{short_id}", "mongodb", "ABCDEF0123", "vpc-mongodb-abcdef01"},
+	}
+	for _, tt := range tests {
+		got, err := renderNodeName(tt.template, tt.nodeType, tt.instanceID)
+		if err != nil {
+			t.Errorf("renderNodeName(%q): %v", tt.template, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("renderNodeName(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+
+	if _, err := renderNodeName("{node_type}", "", "abc"); err == nil {
+		t.Errorf("rendering an empty name: got no error")
+	}
+	if err := validateNodeNameTemplate("{node_type}-{uuid}"); err == nil {
+		t.Errorf("validating an unknown placeholder: got no error")
+	}
+}
+
+func TestRegisterRendersNodeName(t *testing.T) {
+	newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.NodeNameTemplate = "{node_type}-{short_id}" })
+
+	serve(r, newRequest("GET", "/api/register?instance_id=0123456789abcdef&node_type=mongodb"))
+	node, ok := state.storedNode("0123456789abcdef")
+	if !ok {
+		t.Fatalf("node was not registered")
+	}
+	if node.Name != "mongodb-01234567" {
+		t.Errorf("got name %q, want mongodb-01234567", node.Name)
+	}
+
+	// An explicit node_name is used as is.
+	serve(r, newRequest("GET", "/api/register?instance_id=i2&node_type=mongodb&node_name=primary"))
+	if node, _ := state.storedNode("i2"); node.Name != "primary" {
+		t.Errorf("got name %q, want primary", node.Name)
+	}
+}
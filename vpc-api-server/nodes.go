@@ -0,0 +1,830 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The accessors below are the only code that touches s.nodes. Each takes
+// s.mutex for the duration of the map access only, so request handlers and
+// background tasks never race on the map or hold the lock across I/O.
+
+func (s *AppState) putNode(node NodeInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nodes[node.UUID] = node
+}
+
+func (s *AppState) deleteNode(uuid string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.nodes, uuid)
+	s.modified.forget(uuid)
+}
+
+// setDraining flags or clears every registered node with the given name and
+// reports how many were found.
+func (s *AppState) setDraining(name string, draining bool) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := 0
+	for uuid, node := range s.nodes {
+		if node.Name != name {
+			continue
+		}
+		node.Draining = draining
+		s.nodes[uuid] = node
+		count++
+	}
+	return count
+}
+
+// storedNode returns a copy of the registered node with the given uuid.
+func (s *AppState) storedNode(uuid string) (NodeInfo, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	node, ok := s.nodes[uuid]
+	return node, ok
+}
+
+// updateNode applies update to the registered node with the given uuid and
+// reports whether it exists.
+func (s *AppState) updateNode(uuid string, update func(*NodeInfo)) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	node, ok := s.nodes[uuid]
+	if !ok {
+		return false
+	}
+	update(&node)
+	s.nodes[uuid] = node
+	return true
+}
+
+// storedNodes returns a copy of the registered nodes.
+func (s *AppState) storedNodes() []NodeInfo {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	nodes := make([]NodeInfo, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// preferredIP picks the address clients should dial, preferring IPv4 over
+// IPv6 since most consumers (e.g. MongoDB connection strings) expect it.
+func preferredIP(addrs []string) string {
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+			return addr
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
+
+// applyHeadscaleState copies the live state Headscale reports for a node.
+func applyHeadscaleState(node *NodeInfo, hsNode HeadscaleNode) {
+	node.Online = hsNode.Online
+	// Nodes we have no record of may still carry their type as a tag.
+	if node.NodeType == "" {
+		node.NodeType = nodeTypeFromTags(hsNode.ValidTags)
+		if node.NodeType == "" {
+			node.NodeType = nodeTypeFromTags(hsNode.ForcedTags)
+		}
+	}
+	node.Tags = nodeTags(hsNode)
+	node.LastSeen = hsNode.LastSeen
+	node.addresses = hsNode.IPAddresses
+	if ip := preferredIP(hsNode.IPAddresses); ip != "" {
+		node.TailscaleIP = &ip
+	}
+
+	if len(hsNode.AvailableRoutes) > 0 || len(hsNode.ApprovedRoutes) > 0 {
+		node.Routes = &NodeRoutes{
+			Advertised: nonNil(hsNode.AvailableRoutes),
+			Approved:   nonNil(hsNode.ApprovedRoutes),
+			Serving:    nonNil(hsNode.SubnetRoutes),
+		}
+	}
+
+	node.Debug = &NodeDebugInfo{
+		HeadscaleID:    hsNode.ID,
+		User:           hsNode.User.Name,
+		RegisterMethod: hsNode.RegisterMethod,
+	}
+	if hsNode.PreAuthKey != nil {
+		node.Debug.AuthKeyID = hsNode.PreAuthKey.ID
+		node.Debug.AuthKeyUser = hsNode.PreAuthKey.User.Name
+		node.Debug.AuthKeyTags = hsNode.PreAuthKey.AclTags
+	}
+}
+
+// nodeTags combines a node's valid and forced tags, without duplicates.
+func nodeTags(hsNode HeadscaleNode) []string {
+	var tags []string
+	for _, tag := range append(append([]string{}, hsNode.ValidTags...), hsNode.ForcedTags...) {
+		if !hasTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// hasTag reports whether tags contains tag.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// nonNil turns a nil slice into an empty one so it encodes as [].
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// advertisesRoute reports whether node advertises the subnet prefix.
+func advertisesRoute(node NodeInfo, prefix netip.Prefix) bool {
+	if node.Routes == nil {
+		return false
+	}
+	for _, route := range node.Routes.Advertised {
+		if p, err := netip.ParsePrefix(route); err == nil && p.Masked() == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAddressIn reports whether any of node's Tailscale IPs is in prefix.
+func hasAddressIn(node NodeInfo, prefix netip.Prefix) bool {
+	addrs := node.addresses
+	if len(addrs) == 0 && node.TailscaleIP != nil {
+		addrs = []string{*node.TailscaleIP}
+	}
+	for _, addr := range addrs {
+		if ip, err := netip.ParseAddr(addr); err == nil && prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergedNodes returns the registered nodes with their Tailscale IP and online
+// status filled in from Headscale. Nodes are matched by name. With
+// includeUnmanaged, Headscale nodes that were never registered through us are
+// appended with only the data Headscale has about them.
+func (s *AppState) mergedNodes(ctx context.Context, includeUnmanaged bool) ([]NodeInfo, error) {
+	hsNodes, err := getHeadscaleNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]HeadscaleNode, len(hsNodes))
+	for _, hsNode := range hsNodes {
+		// Some Headscale versions report nodes without a name while they
+		// are still registering; they can't be matched to anything.
+		if hsNode.Name == "" {
+			log.Printf("Warning: skipping Headscale node %s with empty name", hsNode.ID)
+			continue
+		}
+		// A host that re-registered shows up more than once; the online
+		// entry is the one that reflects its current address.
+		if existing, ok := byName[hsNode.Name]; ok && existing.Online && !hsNode.Online {
+			continue
+		}
+		byName[hsNode.Name] = hsNode
+	}
+
+	stored := s.storedNodes()
+	nodes := make([]NodeInfo, 0, len(stored))
+	managed := make(map[string]bool, len(stored))
+	now := time.Now()
+	for _, node := range stored {
+		managed[node.Name] = true
+		hsNode, inHeadscale := byName[node.Name]
+		if inHeadscale {
+			applyHeadscaleState(&node, hsNode)
+			node.inHeadscale = true
+		}
+		node.Status = nodeStatus(node, inHeadscale, s.config.PendingGracePeriod, now)
+		node.Reachable = s.prober.result(node)
+		nodes = append(nodes, node)
+	}
+
+	if includeUnmanaged {
+		for name, hsNode := range byName {
+			if managed[name] {
+				continue
+			}
+			node := NodeInfo{
+				ID:        "headscale:" + hsNode.ID,
+				Name:      hsNode.Name,
+				Source:    sourceHeadscale,
+				CreatedAt: hsNode.CreatedAt,
+			}
+			applyHeadscaleState(&node, hsNode)
+			node.inHeadscale = true
+			node.Status = nodeStatus(node, true, s.config.PendingGracePeriod, now)
+			nodes = append(nodes, node)
+		}
+	}
+
+	s.modified.stamp(nodes, now)
+	return nodes, nil
+}
+
+// nodeStatus tells a node that is still joining apart from one that is down:
+// a node Headscale doesn't know yet is pending for grace after bootstrap.
+func nodeStatus(node NodeInfo, inHeadscale bool, grace time.Duration, now time.Time) string {
+	switch {
+	case inHeadscale && node.Online:
+		return statusActive
+	case !inHeadscale && node.CreatedAt != nil && now.Sub(*node.CreatedAt) < grace:
+		return statusPending
+	default:
+		return statusOffline
+	}
+}
+
+// nodeLess orders nodes by a sort key; ties are broken by name so the
+// output is stable.
+var nodeLess = map[string]func(a, b NodeInfo) bool{
+	"name": func(a, b NodeInfo) bool {
+		return a.Name < b.Name
+	},
+	"node_type": func(a, b NodeInfo) bool {
+		if a.NodeType != b.NodeType {
+			return a.NodeType < b.NodeType
+		}
+		return a.Name < b.Name
+	},
+	"online": func(a, b NodeInfo) bool {
+		if a.Online != b.Online {
+			return a.Online
+		}
+		return a.Name < b.Name
+	},
+	// Like online, the preferred nodes come first: highest priority.
+	"priority": func(a, b NodeInfo) bool {
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.Name < b.Name
+	},
+}
+
+// sortNodes sorts nodes by key, where a leading '-' reverses the order.
+// Unknown keys leave the order unchanged.
+func sortNodes(nodes []NodeInfo, key string) {
+	desc := strings.HasPrefix(key, "-")
+	less, ok := nodeLess[strings.TrimPrefix(key, "-")]
+	if !ok {
+		return
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if desc {
+			return less(nodes[j], nodes[i])
+		}
+		return less(nodes[i], nodes[j])
+	})
+}
+
+func (s *AppState) handleListNodes(c *gin.Context) {
+	nodeType := s.canonicalNodeType(c.Query("node_type"))
+	includeUnmanaged := c.Query("include_unmanaged") == "true"
+	includeDebug := c.Query("include_debug") == "true"
+	showBootstrapIP := includeDebug || s.isOperator(c)
+	onlyVerified := c.Query("only_verified") == "true"
+	onlyReachable := c.Query("reachable") == "true"
+	missingTag := c.Query("missing_tag")
+	sortKey := c.DefaultQuery("sort", "name")
+
+	var draining *bool
+	if v := c.Query("draining"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid draining, expected true or false"})
+			return
+		}
+		draining = &b
+	}
+
+	if nodeType != "" && !s.isNodeTypeAllowed(nodeType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid node_type, must be one of %v", s.config.AllowedNodeTypes)})
+		return
+	}
+
+	var createdBefore, createdAfter time.Time
+	for param, t := range map[string]*time.Time{"created_before": &createdBefore, "created_after": &createdAfter} {
+		if v := c.Query(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s, expected an RFC3339 timestamp", param)})
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	var modifiedSince time.Time
+	if v := c.Query("modified_since"); v != "" {
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid modified_since, expected an RFC3339 timestamp"})
+			return
+		}
+		modifiedSince = parsed
+	}
+
+	var lastSeenBefore time.Time
+	if v := c.Query("last_seen_before"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last_seen_before, expected a duration such as 1h"})
+			return
+		}
+		lastSeenBefore = time.Now().Add(-d)
+	}
+
+	if _, ok := nodeLess[strings.TrimPrefix(sortKey, "-")]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort, must be one of name, node_type, online, priority (prefix with - to reverse)"})
+		return
+	}
+
+	if missingTag != "" && !strings.HasPrefix(missingTag, "tag:") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid missing_tag, expected a tag such as tag:prod"})
+		return
+	}
+
+	format := c.Query("format")
+	if format != "" && format != "ndjson" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format, must be ndjson"})
+		return
+	}
+	if format == "ndjson" && c.Query("grouped") == "true" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format=ndjson cannot be combined with grouped=true"})
+		return
+	}
+
+	limit := s.config.DefaultPageSize
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit, expected a positive integer"})
+			return
+		}
+		limit = min(n, s.config.MaxPageSize)
+	}
+	offset := 0
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset, expected a non-negative integer"})
+			return
+		}
+		offset = n
+	}
+	// Grouped listings are never paged, DEFAULT_PAGE_SIZE included.
+	if c.Query("grouped") == "true" {
+		if c.Query("limit") != "" || c.Query("offset") != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit and offset cannot be combined with grouped=true"})
+			return
+		}
+		limit = 0
+	}
+
+	var route netip.Prefix
+	if v := c.Query("route"); v != "" {
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid route, expected a CIDR such as 10.0.0.0/24"})
+			return
+		}
+		route = p.Masked()
+	}
+
+	// Unlike route, which matches advertised routes, subnet matches the
+	// node's own Tailscale addresses.
+	var subnet netip.Prefix
+	if v := c.Query("subnet"); v != "" {
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subnet, expected a CIDR such as 100.64.0.0/10"})
+			return
+		}
+		subnet = p.Masked()
+	}
+
+	stale := false
+	nodes, err := s.mergedNodes(c.Request.Context(), includeUnmanaged)
+	if err != nil {
+		log.Printf("Failed to list nodes, serving stale data: %v", err)
+		nodes = s.fallbackNodes()
+		stale = true
+		c.Header("X-Data-Stale", "true")
+	}
+
+	filtered := make([]NodeInfo, 0, len(nodes))
+	for _, node := range nodes {
+		if nodeType != "" && node.NodeType != nodeType {
+			continue
+		}
+		if draining != nil && node.Draining != *draining {
+			continue
+		}
+		if onlyVerified && !node.Verified {
+			continue
+		}
+		if onlyReachable && (node.Reachable == nil || !*node.Reachable) {
+			continue
+		}
+		// Nodes that haven't joined yet have no tags and count as missing it.
+		if missingTag != "" && hasTag(node.Tags, missingTag) {
+			continue
+		}
+		if route.IsValid() && !advertisesRoute(node, route) {
+			continue
+		}
+		// Nodes without an IP yet are left out.
+		if subnet.IsValid() && !hasAddressIn(node, subnet) {
+			continue
+		}
+		// Nodes without a creation time are left out by either filter.
+		if !createdBefore.IsZero() && (node.CreatedAt == nil || !node.CreatedAt.Before(createdBefore)) {
+			continue
+		}
+		if !createdAfter.IsZero() && (node.CreatedAt == nil || !node.CreatedAt.After(createdAfter)) {
+			continue
+		}
+		// Nodes Headscale has never seen have no lastSeen and are left out.
+		if !lastSeenBefore.IsZero() && (node.LastSeen == nil || !node.LastSeen.Before(lastSeenBefore)) {
+			continue
+		}
+		// Inclusive, so a change in the same instant as the caller's last
+		// poll is not missed.
+		if !modifiedSince.IsZero() && node.LastModified != nil && node.LastModified.Before(modifiedSince) {
+			continue
+		}
+		if !includeDebug {
+			node.Debug = nil
+		}
+		if !showBootstrapIP {
+			node.BootstrapIP = ""
+		}
+		filtered = append(filtered, node)
+	}
+	sortNodes(filtered, sortKey)
+	filtered, nextOffset := pageNodes(filtered, limit, offset)
+
+	// Stale data is served as a stopgap and shouldn't be cached.
+	maxAge := s.config.NodesCacheMaxAge
+	if stale {
+		maxAge = 0
+	}
+
+	if format == "ndjson" {
+		if limit > 0 {
+			c.Header("X-Page-Limit", strconv.Itoa(limit))
+		}
+		if nextOffset != nil {
+			c.Header("X-Next-Offset", strconv.Itoa(*nextOffset))
+		}
+		writeNDJSON(c, filtered)
+		return
+	}
+
+	if c.Query("grouped") == "true" {
+		// Every allowed type is present so clients can index without
+		// checking; nodes without a type are grouped under "".
+		grouped := make(map[string][]NodeInfo, len(s.config.AllowedNodeTypes))
+		for _, nodeType := range s.config.AllowedNodeTypes {
+			grouped[nodeType] = []NodeInfo{}
+		}
+		for _, node := range filtered {
+			grouped[node.NodeType] = append(grouped[node.NodeType], node)
+		}
+		respondCacheable(c, maxAge, grouped)
+		return
+	}
+
+	respondCacheable(c, maxAge, NodesResponse{Nodes: filtered, Stale: stale, Limit: limit, NextOffset: nextOffset})
+}
+
+// pageNodes returns the page of sorted nodes starting at offset, and the
+// offset of the next page if there is one. A limit of 0 returns every node
+// from offset on.
+func pageNodes(nodes []NodeInfo, limit, offset int) ([]NodeInfo, *int) {
+	if offset >= len(nodes) {
+		return []NodeInfo{}, nil
+	}
+	nodes = nodes[offset:]
+	if limit <= 0 || len(nodes) <= limit {
+		return nodes, nil
+	}
+	next := offset + limit
+	return nodes[:limit], &next
+}
+
+// writeNDJSON streams nodes one JSON object per line, encoding each as it
+// goes instead of building the whole array. Staleness is only signalled by
+// the X-Data-Stale header.
+func writeNDJSON(c *gin.Context, nodes []NodeInfo) {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	enc := json.NewEncoder(c.Writer)
+	for _, node := range nodes {
+		if err := enc.Encode(node); err != nil {
+			// The client went away; nothing left to report it to.
+			log.Printf("Stopped streaming nodes: %v", err)
+			return
+		}
+	}
+}
+
+// fallbackNodes returns the registered nodes with the Headscale state seen
+// by the last successful poll, for when Headscale can't be reached. Nodes
+// registered since then have no IP yet.
+func (s *AppState) fallbackNodes() []NodeInfo {
+	polled, _ := s.watcher.snapshot()
+	byUUID := make(map[string]NodeInfo, len(polled))
+	for _, node := range polled {
+		byUUID[node.UUID] = node
+	}
+
+	nodes := s.storedNodes()
+	now := time.Now()
+	for i, node := range nodes {
+		if last, ok := byUUID[node.UUID]; ok && last.Status != statusPending {
+			nodes[i].TailscaleIP = last.TailscaleIP
+			nodes[i].addresses = last.addresses
+			nodes[i].Online = last.Online
+			nodes[i].LastSeen = last.LastSeen
+			nodes[i].Status = last.Status
+		} else {
+			nodes[i].Status = nodeStatus(node, false, s.config.PendingGracePeriod, now)
+		}
+		nodes[i].Reachable = s.prober.result(node)
+	}
+	s.modified.stamp(nodes, now)
+	return nodes
+}
+
+// handleNodeIPs returns the "ip:port" addresses of online nodes of a given
+// type, suitable for building a connection string. Draining nodes are left
+// out so clients stop sending them new work.
+func (s *AppState) handleNodeIPs(c *gin.Context) {
+	nodeType := s.canonicalNodeType(c.Query("node_type"))
+	port := c.Query("port")
+
+	if nodeType == "" || port == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required parameters"})
+		return
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid port"})
+		return
+	}
+
+	nodes, err := s.mergedNodes(c.Request.Context(), false)
+	if err != nil {
+		log.Printf("Failed to list nodes: %v", err)
+		c.JSON(headscaleErrorStatus(err), gin.H{"error": "Failed to list nodes"})
+		return
+	}
+
+	addrs := []string{}
+	for _, node := range nodes {
+		if node.NodeType != nodeType || !node.Online || node.Draining || node.TailscaleIP == nil {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(*node.TailscaleIP, port))
+	}
+	sort.Strings(addrs)
+
+	c.JSON(http.StatusOK, addrs)
+}
+
+// handleACLHosts groups the IPs of registered nodes by node type, for
+// templating Headscale ACL policies from live membership. Offline nodes are
+// included since they remain members; nodes without an IP yet are not.
+func (s *AppState) handleACLHosts(c *gin.Context) {
+	nodes, err := s.mergedNodes(c.Request.Context(), false)
+	if err != nil {
+		log.Printf("Failed to list nodes: %v", err)
+		c.JSON(headscaleErrorStatus(err), gin.H{"error": "Failed to list nodes"})
+		return
+	}
+
+	groups := make(map[string][]string)
+	for _, node := range nodes {
+		if node.NodeType == "" || node.TailscaleIP == nil {
+			continue
+		}
+		groups[node.NodeType] = append(groups[node.NodeType], *node.TailscaleIP)
+	}
+	for _, ips := range groups {
+		sort.Strings(ips)
+	}
+
+	c.JSON(http.StatusOK, groups)
+}
+
+type DeleteFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+type DeleteNodesResponse struct {
+	Deleted []string        `json:"deleted"`
+	Failed  []DeleteFailure `json:"failed"`
+}
+
+// handleDeleteNodes removes every node of a type from both Headscale and our
+// registry. It requires confirm=true to guard against accidental mass deletes.
+func (s *AppState) handleDeleteNodes(c *gin.Context) {
+	nodeType := s.canonicalNodeType(c.Query("node_type"))
+	if nodeType == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required parameters"})
+		return
+	}
+	if c.Query("confirm") != "true" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bulk deletion requires confirm=true"})
+		return
+	}
+
+	hsNodes, err := getHeadscaleNodes(c.Request.Context())
+	if err != nil {
+		log.Printf("Failed to list Headscale nodes: %v", err)
+		c.JSON(headscaleErrorStatus(err), gin.H{"error": "Failed to list nodes"})
+		return
+	}
+
+	hsIDs := make(map[string][]string)
+	for _, hsNode := range hsNodes {
+		if hsNode.Name == "" {
+			continue
+		}
+		hsIDs[hsNode.Name] = append(hsIDs[hsNode.Name], hsNode.ID)
+	}
+
+	var targets []NodeInfo
+	for _, node := range s.storedNodes() {
+		if node.NodeType == nodeType {
+			targets = append(targets, node)
+		}
+	}
+
+	result := DeleteNodesResponse{Deleted: []string{}, Failed: []DeleteFailure{}}
+	for _, node := range targets {
+		var deleteErr error
+		for _, id := range hsIDs[node.Name] {
+			if err := deleteHeadscaleNode(c.Request.Context(), id); err != nil {
+				deleteErr = err
+				break
+			}
+		}
+		if deleteErr != nil {
+			log.Printf("Failed to delete node %s: %v", logName(node.Name), deleteErr)
+			result.Failed = append(result.Failed, DeleteFailure{Name: node.Name, Error: deleteErr.Error()})
+			continue
+		}
+
+		s.deleteNode(node.UUID)
+		log.Printf("Deleted node %s from Headscale and registry", logName(node.Name))
+		result.Deleted = append(result.Deleted, node.Name)
+	}
+
+	log.Printf("Bulk delete of node_type %s: %d deleted, %d failed", nodeType, len(result.Deleted), len(result.Failed))
+	c.JSON(http.StatusOK, result)
+}
+
+// headscaleNodeIDs returns the Headscale IDs of all nodes registered under
+// name; a host that re-registered can have more than one.
+func headscaleNodeIDs(ctx context.Context, name string) ([]string, error) {
+	hsNodes, err := getHeadscaleNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, hsNode := range hsNodes {
+		if hsNode.Name == name {
+			ids = append(ids, hsNode.ID)
+		}
+	}
+	return ids, nil
+}
+
+// handleExpireNode revokes a node's session in Headscale without deleting it,
+// so the node keeps its identity and can re-authenticate later.
+func (s *AppState) handleExpireNode(c *gin.Context) {
+	name := c.Param("name")
+
+	ids, err := headscaleNodeIDs(c.Request.Context(), name)
+	if err != nil {
+		log.Printf("Failed to list Headscale nodes: %v", err)
+		c.JSON(headscaleErrorStatus(err), gin.H{"error": "Failed to list nodes"})
+		return
+	}
+	if len(ids) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+
+	for _, id := range ids {
+		if err := expireHeadscaleNode(c.Request.Context(), id); err != nil {
+			log.Printf("Failed to expire node %s (Headscale ID %s): %v", logName(name), id, err)
+			c.JSON(headscaleErrorStatus(err), gin.H{"error": "Failed to expire node"})
+			return
+		}
+		log.Printf("Expired session of node %s (Headscale ID %s), node kept for re-authentication", logName(name), id)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"name": name, "expired": ids})
+}
+
+// handleNodeByName returns the registered node with the given name, as
+// /api/nodes would list it, so clients that only know the name can find its
+// instance id. A name registered more than once resolves to the latest
+// registration.
+func (s *AppState) handleNodeByName(c *gin.Context) {
+	name := c.Param("name")
+
+	nodes, err := s.mergedNodes(c.Request.Context(), false)
+	if err != nil {
+		log.Printf("Failed to merge Headscale state, serving stale data: %v", err)
+		nodes = s.fallbackNodes()
+		c.Header("X-Data-Stale", "true")
+	}
+
+	var found *NodeInfo
+	for _, node := range nodes {
+		if node.Name != name {
+			continue
+		}
+		if found == nil || (node.CreatedAt != nil && (found.CreatedAt == nil || node.CreatedAt.After(*found.CreatedAt))) {
+			node := node
+			found = &node
+		}
+	}
+	if found == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+
+	found.Debug = nil
+	if !s.isOperator(c) {
+		found.BootstrapIP = ""
+	}
+	c.JSON(http.StatusOK, found)
+}
+
+// handleDrainNode marks a registered node as draining ahead of removal,
+// without touching it in Headscale.
+func (s *AppState) handleDrainNode(c *gin.Context) {
+	s.updateDraining(c, true)
+}
+
+func (s *AppState) handleUndrainNode(c *gin.Context) {
+	s.updateDraining(c, false)
+}
+
+func (s *AppState) updateDraining(c *gin.Context, draining bool) {
+	name := c.Param("name")
+
+	if s.setDraining(name, draining) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+
+	log.Printf("Set draining=%t on node %s", draining, logName(name))
+	c.JSON(http.StatusOK, gin.H{"name": name, "draining": draining})
+}
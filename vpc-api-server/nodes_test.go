@@ -0,0 +1,815 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addTestNode registers node with the state as a bootstrap would have and,
+// unless hs is nil, adds a Headscale node of the same name that is online.
+func addTestNode(state *AppState, hs *fakeHeadscale, node NodeInfo) HeadscaleNode {
+	if node.ID == "" {
+		node.ID = node.UUID
+	}
+	if node.Source == "" {
+		node.Source = sourceBootstrap
+	}
+	if node.CreatedAt == nil {
+		created := time.Now().UTC()
+		node.CreatedAt = &created
+	}
+	state.putNode(node)
+
+	if hs == nil {
+		return HeadscaleNode{}
+	}
+	return hs.addNode(HeadscaleNode{Name: node.Name, User: User{ID: "1", Name: "default"}, Online: true})
+}
+
+func TestDeleteNodesByType(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "mongo-2", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i3", Name: "app-1", NodeType: "app"})
+
+	if w := serve(r, newOperatorRequest("DELETE", "/api/nodes?node_type=mongodb")); w.Code != http.StatusBadRequest {
+		t.Errorf("without confirm=true: got status %d, want 400", w.Code)
+	}
+
+	w := serve(r, newOperatorRequest("DELETE", "/api/nodes?node_type=mongodb&confirm=true"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp DeleteNodesResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	sort.Strings(resp.Deleted)
+	if len(resp.Deleted) != 2 || resp.Deleted[0] != "mongo-1" || resp.Deleted[1] != "mongo-2" || len(resp.Failed) != 0 {
+		t.Errorf("got %+v, want mongo-1 and mongo-2 deleted", resp)
+	}
+
+	if names := hs.nodeNames(); len(names) != 1 || names[0] != "app-1" {
+		t.Errorf("Headscale still has %v, want only app-1", names)
+	}
+	stored := state.storedNodes()
+	if len(stored) != 1 || stored[0].Name != "app-1" {
+		t.Errorf("registry still has %v, want only app-1", stored)
+	}
+}
+
+func TestListNodesSkipsEmptyNames(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	// A nameless node added before the named one must not shadow it.
+	hs.nodes = append([]HeadscaleNode{{ID: "99", Online: false}}, hs.nodes...)
+	hs.addNode(HeadscaleNode{Name: "stray", Online: true})
+
+	w := serve(r, newRequest("GET", "/api/nodes?include_unmanaged=true"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp NodesResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+
+	if len(resp.Nodes) != 2 {
+		t.Fatalf("got %d nodes, want mongo-1 and stray: %+v", len(resp.Nodes), resp.Nodes)
+	}
+	for _, node := range resp.Nodes {
+		if node.Name == "" {
+			t.Errorf("empty-named node was listed: %+v", node)
+		}
+		if !node.Online || node.TailscaleIP == nil {
+			t.Errorf("node %s lost its Headscale state: %+v", node.Name, node)
+		}
+	}
+}
+
+// listNodes lists nodes with query through r and returns their names in
+// order.
+func listNodes(t *testing.T, r http.Handler, query string) []string {
+	t.Helper()
+	w := serve(r, newRequest("GET", "/api/nodes"+query))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/nodes%s: got status %d: %s", query, w.Code, w.Body)
+	}
+	var resp NodesResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+
+	names := []string{}
+	for _, node := range resp.Nodes {
+		names = append(names, node.Name)
+	}
+	return names
+}
+
+func TestListNodesSort(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "b", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "c", NodeType: "app"})
+	addTestNode(state, hs, NodeInfo{UUID: "i3", Name: "a", NodeType: "mongodb"})
+
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{"name", "a,b,c"},
+		{"-name", "c,b,a"},
+		{"node_type", "c,a,b"},
+		{"-node_type", "b,a,c"},
+	}
+	if got := strings.Join(listNodes(t, r, ""), ","); got != "a,b,c" {
+		t.Errorf("default sort: got %s, want a,b,c", got)
+	}
+	for _, tt := range tests {
+		if got := strings.Join(listNodes(t, r, "?sort="+tt.sort), ","); got != tt.want {
+			t.Errorf("sort=%s: got %s, want %s", tt.sort, got, tt.want)
+		}
+	}
+
+	if w := serve(r, newRequest("GET", "/api/nodes?sort=age")); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown sort key: got status %d, want 400", w.Code)
+	}
+}
+
+func TestListNodesByPriority(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	bootstrapNode(t, r, testAppID, "instance_id=i1&node_name=low&priority=-1")
+	bootstrapNode(t, r, testAppID, "instance_id=i2&node_name=high&priority=5")
+	bootstrapNode(t, r, testAppID, "instance_id=i3&node_name=default")
+	for _, node := range state.storedNodes() {
+		hs.addNode(HeadscaleNode{Name: node.Name, User: User{ID: "1", Name: "default"}, Online: true})
+	}
+
+	w := serve(r, newRequest("GET", "/api/nodes"))
+	var resp NodesResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	priorities := map[string]int{}
+	for _, node := range resp.Nodes {
+		priorities[node.Name] = node.Priority
+	}
+	if want := map[string]int{"low": -1, "high": 5, "default": 0}; !reflect.DeepEqual(priorities, want) {
+		t.Errorf("got priorities %v, want %v", priorities, want)
+	}
+
+	if got := strings.Join(listNodes(t, r, "?sort=priority"), ","); got != "high,default,low" {
+		t.Errorf("sort=priority: got %s, want high,default,low", got)
+	}
+	if got := strings.Join(listNodes(t, r, "?sort=-priority"), ","); got != "low,default,high" {
+		t.Errorf("sort=-priority: got %s, want low,default,high", got)
+	}
+
+	req := newRequest("GET", "/api/register?instance_id=i4&priority=high")
+	req.Header.Set("x-dstack-app-id", testAppID)
+	if w := serve(r, req); w.Code != http.StatusBadRequest {
+		t.Errorf("non-integer priority: got status %d, want 400", w.Code)
+	}
+}
+
+func TestListNodesMissingTag(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	addTestNode(state, nil, NodeInfo{UUID: "i1", Name: "valid", NodeType: "mongodb"})
+	addTestNode(state, nil, NodeInfo{UUID: "i2", Name: "forced", NodeType: "mongodb"})
+	addTestNode(state, nil, NodeInfo{UUID: "i3", Name: "untagged", NodeType: "mongodb"})
+	hs.addNode(HeadscaleNode{Name: "valid", Online: true, ValidTags: []string{"tag:prod", "tag:db"}})
+	hs.addNode(HeadscaleNode{Name: "forced", Online: true, ForcedTags: []string{"tag:prod"}})
+	hs.addNode(HeadscaleNode{Name: "untagged", Online: true, ValidTags: []string{"tag:db"}})
+
+	if got := strings.Join(listNodes(t, r, "?missing_tag=tag:prod"), ","); got != "untagged" {
+		t.Errorf("missing_tag=tag:prod: got %s, want untagged", got)
+	}
+	if got := strings.Join(listNodes(t, r, "?missing_tag=tag:db"), ","); got != "forced" {
+		t.Errorf("missing_tag=tag:db: got %s, want forced", got)
+	}
+	if w := serve(r, newRequest("GET", "/api/nodes?missing_tag=prod")); w.Code != http.StatusBadRequest {
+		t.Errorf("missing_tag without the tag: prefix: got status %d, want 400", w.Code)
+	}
+}
+
+func TestExpireNodeCallsHeadscale(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "other", NodeType: "mongodb"})
+	hsNode := addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "mongo-1", NodeType: "mongodb"})
+
+	w := serve(r, newOperatorRequest("POST", "/api/nodes/mongo-1/expire"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if n := len(hs.requestsTo("POST", "/api/v1/node/"+hsNode.ID+"/expire")); n != 1 {
+		t.Errorf("expired Headscale node %s %d times, want once", hsNode.ID, n)
+	}
+	if n := len(hs.requestsTo("DELETE", "/api/v1/node/"+hsNode.ID)); n != 0 {
+		t.Errorf("expiring deleted the node")
+	}
+
+	if w := serve(r, newOperatorRequest("POST", "/api/nodes/missing/expire")); w.Code != http.StatusNotFound {
+		t.Errorf("unknown node: got status %d, want 404", w.Code)
+	}
+}
+
+// TestNodeRegistryConcurrentAccess bootstraps, lists, polls and prunes nodes
+// at the same time. It is meant to be run with -race.
+func TestNodeRegistryConcurrentAccess(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	addTestNode(state, hs, NodeInfo{UUID: "seed", Name: "seed", NodeType: "app"})
+
+	const rounds = 20
+	var wg sync.WaitGroup
+	run := func(name string, do func(i int) *http.Request, wantStatus int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if w := serve(r, do(i)); w.Code != wantStatus {
+					t.Errorf("%s %d: got status %d, want %d: %s", name, i, w.Code, wantStatus, w.Body)
+					return
+				}
+			}
+		}()
+	}
+	for g := 0; g < 4; g++ {
+		g := g
+		run("bootstrap", func(i int) *http.Request {
+			return newRequest("GET", fmt.Sprintf("/api/register?instance_id=i%d-%d&node_name=mongo-%d-%d&node_type=mongodb", g, i, g, i))
+		}, http.StatusOK)
+	}
+	run("list", func(int) *http.Request { return newRequest("GET", "/api/nodes") }, http.StatusOK)
+	run("list by name", func(int) *http.Request { return newRequest("GET", "/api/nodes/by-name/seed") }, http.StatusOK)
+	run("drain", func(int) *http.Request { return newOperatorRequest("POST", "/api/nodes/seed/drain") }, http.StatusOK)
+	run("prune", func(int) *http.Request {
+		return newOperatorRequest("DELETE", "/api/nodes?node_type=mongodb&confirm=true")
+	}, http.StatusOK)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			if nodes, err := state.mergedNodes(context.Background(), true); err == nil {
+				state.watcher.update(nodes)
+			}
+		}
+	}()
+	wg.Wait()
+
+	// A final prune leaves only the seed node.
+	serve(r, newOperatorRequest("DELETE", "/api/nodes?node_type=mongodb&confirm=true"))
+	if stored := state.storedNodes(); len(stored) != 1 || stored[0].Name != "seed" {
+		t.Errorf("registry has %d nodes after pruning, want only seed", len(stored))
+	}
+}
+
+func TestListNodesLastSeen(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	recent := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	old := time.Now().UTC().Add(-48 * time.Hour).Truncate(time.Second)
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "recent", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "old", NodeType: "mongodb"})
+	addTestNode(state, nil, NodeInfo{UUID: "i3", Name: "never", NodeType: "mongodb"})
+	hs.updateNodes("recent", func(n *HeadscaleNode) { n.LastSeen = &recent })
+	hs.updateNodes("old", func(n *HeadscaleNode) { n.LastSeen = &old })
+
+	w := serve(r, newRequest("GET", "/api/nodes"))
+	var resp NodesResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	for _, node := range resp.Nodes {
+		var want *time.Time
+		switch node.Name {
+		case "recent":
+			want = &recent
+		case "old":
+			want = &old
+		}
+		if (node.LastSeen == nil) != (want == nil) || (want != nil && !node.LastSeen.Equal(*want)) {
+			t.Errorf("node %s: got last_seen %v, want %v", node.Name, node.LastSeen, want)
+		}
+	}
+
+	if got := strings.Join(listNodes(t, r, "?last_seen_before=1h"), ","); got != "old" {
+		t.Errorf("last_seen_before=1h: got %s, want old", got)
+	}
+	if w := serve(r, newRequest("GET", "/api/nodes?last_seen_before=yesterday")); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid last_seen_before: got status %d, want 400", w.Code)
+	}
+}
+
+func TestACLHostsGroupsByType(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	mongo2 := addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "mongo-2", NodeType: "mongodb"})
+	mongo1 := addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	app := addTestNode(state, hs, NodeInfo{UUID: "i3", Name: "app-1", NodeType: "app"})
+	hs.updateNodes("mongo-2", func(node *HeadscaleNode) { node.Online = false })
+	addTestNode(state, nil, NodeInfo{UUID: "i4", Name: "pending", NodeType: "app"})
+
+	w := serve(r, newRequest("GET", "/api/acl/hosts"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var groups map[string][]string
+	decodeJSON(t, w.Body.Bytes(), &groups)
+
+	want := map[string][]string{
+		"mongodb": {mongo2.IPAddresses[0], mongo1.IPAddresses[0]},
+		"app":     {app.IPAddresses[0]},
+	}
+	sort.Strings(want["mongodb"])
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("got %v, want %v", groups, want)
+	}
+}
+
+func TestListNodesRejectsUnknownNodeType(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "app-1", NodeType: "app"})
+
+	w := serve(r, newRequest("GET", "/api/nodes?node_type=mongo"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown node_type: got status %d, want 400", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "mongodb") {
+		t.Errorf("error does not list the valid node types: %s", w.Body)
+	}
+
+	if got := listNodes(t, r, "?node_type=mongodb"); !reflect.DeepEqual(got, []string{"mongo-1"}) {
+		t.Errorf("node_type=mongodb: got %v", got)
+	}
+	if got := listNodes(t, r, "?node_type="); len(got) != 2 {
+		t.Errorf("empty node_type: got %v, want every node", got)
+	}
+}
+
+func TestListNodesCreatedFilters(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, name := range []string{"old", "mid", "new"} {
+		created := now.Add(time.Duration(i-2) * time.Hour)
+		addTestNode(state, hs, NodeInfo{UUID: name, Name: name, NodeType: "app", CreatedAt: &created})
+	}
+
+	stamp := func(d time.Duration) string { return url.QueryEscape(now.Add(d).Format(time.RFC3339)) }
+	for query, want := range map[string][]string{
+		"?created_before=" + stamp(-90*time.Minute):                                           {"old"},
+		"?created_after=" + stamp(-90*time.Minute):                                            {"mid", "new"},
+		"?created_after=" + stamp(-3*time.Hour) + "&created_before=" + stamp(-30*time.Minute): {"mid", "old"},
+	} {
+		if got := listNodes(t, r, query); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", query, got, want)
+		}
+	}
+
+	if w := serve(r, newRequest("GET", "/api/nodes?created_before=yesterday")); w.Code != http.StatusBadRequest {
+		t.Errorf("non-RFC3339 timestamp: got status %d, want 400", w.Code)
+	}
+}
+
+func TestListNodesGrouped(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-2", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "mongo-1", NodeType: "mongodb"})
+
+	w := serve(r, newRequest("GET", "/api/nodes?grouped=true"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var grouped map[string][]NodeInfo
+	decodeJSON(t, w.Body.Bytes(), &grouped)
+
+	if apps, ok := grouped["app"]; !ok || len(apps) != 0 {
+		t.Errorf("app group: got %v (present %v), want an empty list", apps, ok)
+	}
+	var names []string
+	for _, node := range grouped["mongodb"] {
+		names = append(names, node.Name)
+	}
+	if want := []string{"mongo-1", "mongo-2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("mongodb group: got %v, want %v", names, want)
+	}
+
+	for _, query := range []string{"?grouped=true&limit=1", "?grouped=true&format=ndjson"} {
+		if w := serve(r, newRequest("GET", "/api/nodes"+query)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestListNodesNDJSON(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	for _, name := range []string{"a", "b", "c"} {
+		addTestNode(state, hs, NodeInfo{UUID: name, Name: name, NodeType: "app"})
+	}
+
+	w := serve(r, newRequest("GET", "/api/nodes?format=ndjson&limit=2"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if w.Header().Get("X-Page-Limit") != "2" || w.Header().Get("X-Next-Offset") != "2" {
+		t.Errorf("got X-Page-Limit %q and X-Next-Offset %q, want 2 and 2", w.Header().Get("X-Page-Limit"), w.Header().Get("X-Next-Offset"))
+	}
+
+	var names []string
+	dec := json.NewDecoder(w.Body)
+	for dec.More() {
+		var node NodeInfo
+		if err := dec.Decode(&node); err != nil {
+			t.Fatalf("decoding line: %v", err)
+		}
+		names = append(names, node.Name)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	w = serve(r, newRequest("GET", "/api/nodes?format=ndjson&limit=2&offset=2"))
+	if w.Header().Get("X-Next-Offset") != "" || strings.Count(w.Body.String(), "\n") != 1 {
+		t.Errorf("last page: got X-Next-Offset %q and body %q", w.Header().Get("X-Next-Offset"), w.Body)
+	}
+	if w := serve(r, newRequest("GET", "/api/nodes?format=xml")); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: got status %d, want 400", w.Code)
+	}
+}
+
+func TestNodeStatus(t *testing.T) {
+	now := time.Now()
+	recent, old := now.Add(-time.Minute), now.Add(-time.Hour)
+	grace := 2 * time.Minute
+
+	for _, tc := range []struct {
+		name        string
+		node        NodeInfo
+		inHeadscale bool
+		want        string
+	}{
+		{"online", NodeInfo{Online: true, CreatedAt: &old}, true, statusActive},
+		{"just bootstrapped", NodeInfo{CreatedAt: &recent}, false, statusPending},
+		{"never joined", NodeInfo{CreatedAt: &old}, false, statusOffline},
+		{"joined but offline", NodeInfo{CreatedAt: &recent}, true, statusOffline},
+		{"no creation time", NodeInfo{}, false, statusOffline},
+	} {
+		if got := nodeStatus(tc.node, tc.inHeadscale, grace, now); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestListNodesPendingStatus(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	bootstrapNode(t, r, testAppID, "instance_id=i1&node_name=joining")
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "joined", NodeType: "app"})
+
+	var resp NodesResponse
+	decodeJSON(t, serve(r, newRequest("GET", "/api/nodes")).Body.Bytes(), &resp)
+	status := map[string]string{}
+	for _, node := range resp.Nodes {
+		status[node.Name] = node.Status
+	}
+	if want := map[string]string{"joining": statusPending, "joined": statusActive}; !reflect.DeepEqual(status, want) {
+		t.Errorf("got %v, want %v", status, want)
+	}
+}
+
+func TestNodeByName(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	older, newer := time.Now().Add(-time.Hour), time.Now()
+	addTestNode(state, hs, NodeInfo{UUID: "i-old", Name: "mongo-1", NodeType: "mongodb", CreatedAt: &older})
+	addTestNode(state, nil, NodeInfo{UUID: "i-new", Name: "mongo-1", NodeType: "mongodb", CreatedAt: &newer, BootstrapIP: "10.0.0.9"})
+	addTestNode(state, nil, NodeInfo{UUID: "i-other", Name: "mongo-2", NodeType: "mongodb"})
+
+	w := serve(r, newRequest("GET", "/api/nodes/by-name/mongo-1"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var node NodeInfo
+	decodeJSON(t, w.Body.Bytes(), &node)
+	if node.UUID != "i-new" {
+		t.Errorf("got instance %q, want the latest registration i-new", node.UUID)
+	}
+	if node.BootstrapIP != "" {
+		t.Errorf("bootstrap_ip %q shown to a non-operator", node.BootstrapIP)
+	}
+
+	if w := serve(r, newRequest("GET", "/api/nodes/by-name/missing")); w.Code != http.StatusNotFound {
+		t.Errorf("unknown name: got status %d, want 404", w.Code)
+	}
+}
+
+func TestBootstrapIPOnlyShownToOperators(t *testing.T) {
+	newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+
+	req := newRequest("GET", "/api/register?instance_id=i1&node_name=mongo-1&node_type=mongodb")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if w := serve(r, req); w.Code != http.StatusOK {
+		t.Fatalf("register: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if node, _ := state.storedNode("i1"); node.BootstrapIP != "203.0.113.7" {
+		t.Fatalf("got bootstrap IP %q, want 203.0.113.7", node.BootstrapIP)
+	}
+
+	for _, tc := range []struct {
+		req  *http.Request
+		want string
+	}{
+		{newRequest("GET", "/api/nodes"), ""},
+		{newRequest("GET", "/api/nodes?include_debug=true"), "203.0.113.7"},
+		{newOperatorRequest("GET", "/api/nodes"), "203.0.113.7"},
+	} {
+		w := serve(r, tc.req)
+		var resp NodesResponse
+		decodeJSON(t, w.Body.Bytes(), &resp)
+		if len(resp.Nodes) != 1 || resp.Nodes[0].BootstrapIP != tc.want {
+			t.Errorf("%s: got nodes %+v, want bootstrap IP %q", tc.req.URL, resp.Nodes, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		req  *http.Request
+		want string
+	}{
+		{newRequest("GET", "/api/nodes/by-name/mongo-1"), ""},
+		{newOperatorRequest("GET", "/api/nodes/by-name/mongo-1"), "203.0.113.7"},
+	} {
+		w := serve(r, tc.req)
+		var node NodeInfo
+		decodeJSON(t, w.Body.Bytes(), &node)
+		if node.BootstrapIP != tc.want {
+			t.Errorf("%s with operator token %q: got bootstrap IP %q, want %q", tc.req.URL, tc.req.Header.Get("X-Operator-Token"), node.BootstrapIP, tc.want)
+		}
+	}
+}
+
+func TestListNodesPaging(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) {
+		c.DefaultPageSize = 2
+		c.MaxPageSize = 3
+	})
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		addTestNode(state, hs, NodeInfo{UUID: "i-" + name, Name: name, NodeType: "mongodb"})
+	}
+
+	for _, tc := range []struct {
+		query     string
+		wantNames []string
+		wantLimit int
+		wantNext  *int
+	}{
+		{"", []string{"a", "b"}, 2, intPtr(2)},
+		{"?offset=2", []string{"c", "d"}, 2, intPtr(4)},
+		{"?offset=4", []string{"e"}, 2, nil},
+		{"?limit=10", []string{"a", "b", "c"}, 3, intPtr(3)},
+		{"?offset=9", []string{}, 2, nil},
+	} {
+		w := serve(r, newRequest("GET", "/api/nodes"+tc.query))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: got status %d, want 200: %s", tc.query, w.Code, w.Body)
+		}
+		var resp NodesResponse
+		decodeJSON(t, w.Body.Bytes(), &resp)
+		names := []string{}
+		for _, node := range resp.Nodes {
+			names = append(names, node.Name)
+		}
+		if !reflect.DeepEqual(names, tc.wantNames) || resp.Limit != tc.wantLimit || !reflect.DeepEqual(resp.NextOffset, tc.wantNext) {
+			t.Errorf("%q: got names %v, limit %d, next offset %v; want %v, %d, %v", tc.query, names, resp.Limit, resp.NextOffset, tc.wantNames, tc.wantLimit, tc.wantNext)
+		}
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=x", "?offset=-1"} {
+		if w := serve(r, newRequest("GET", "/api/nodes"+query)); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func intPtr(n int) *int {
+	return &n
+}
+
+func TestListNodesStableID(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=mongo-1&node_type=mongodb")); w.Code != http.StatusOK {
+		t.Fatalf("register: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	unmanaged := hs.addNode(HeadscaleNode{Name: "gateway", User: User{ID: "1", Name: "default"}})
+
+	list := func() map[string]string {
+		t.Helper()
+		w := serve(r, newRequest("GET", "/api/nodes?include_unmanaged=true"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("list: got status %d, want 200: %s", w.Code, w.Body)
+		}
+		var resp NodesResponse
+		decodeJSON(t, w.Body.Bytes(), &resp)
+		ids := map[string]string{}
+		for _, node := range resp.Nodes {
+			ids[node.Name] = node.ID
+		}
+		return ids
+	}
+
+	want := map[string]string{"mongo-1": "i1", "gateway": "headscale:" + unmanaged.ID}
+	if got := list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got ids %v, want %v", got, want)
+	}
+
+	hs.updateNodes("gateway", func(n *HeadscaleNode) { n.Name = "gateway-2" })
+	want = map[string]string{"mongo-1": "i1", "gateway-2": "headscale:" + unmanaged.ID}
+	if got := list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after renaming in Headscale: got ids %v, want %v", got, want)
+	}
+}
+
+func TestListNodesBySubnetAndRoute(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	for _, node := range []struct {
+		name   string
+		ips    []string
+		routes []string
+	}{
+		{"a", []string{"100.64.0.1", "fd7a:115c:a1e0::1"}, []string{"10.0.0.0/24"}},
+		{"b", []string{"100.65.0.1", "fd7a:115c:a1e0::2"}, nil},
+		{"c", []string{"100.64.9.1"}, []string{"10.1.0.0/24"}},
+	} {
+		addTestNode(state, nil, NodeInfo{UUID: "i-" + node.name, Name: node.name, NodeType: "mongodb"})
+		hs.addNode(HeadscaleNode{Name: node.name, IPAddresses: node.ips, AvailableRoutes: node.routes})
+	}
+	addTestNode(state, nil, NodeInfo{UUID: "i-d", Name: "d", NodeType: "mongodb"})
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"subnet=100.64.0.0/16", []string{"a", "c"}},
+		{"subnet=100.64.0.0/24", []string{"a"}},
+		{"subnet=100.64.0.7/10", []string{"a", "b", "c"}},
+		{"subnet=fd7a:115c:a1e0::2/128", []string{"b"}},
+		{"route=10.0.0.0/24", []string{"a"}},
+		{"route=10.1.0.9/24", []string{"c"}},
+		{"route=10.0.0.0/16", []string{}},
+		{"subnet=100.64.0.0/16&route=10.1.0.0/24", []string{"c"}},
+	} {
+		w := serve(r, newRequest("GET", "/api/nodes?"+tc.query))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want 200: %s", tc.query, w.Code, w.Body)
+		}
+		var resp NodesResponse
+		decodeJSON(t, w.Body.Bytes(), &resp)
+		names := []string{}
+		for _, node := range resp.Nodes {
+			names = append(names, node.Name)
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.query, names, tc.want)
+		}
+	}
+
+	for _, query := range []string{"subnet=100.64.0.0", "subnet=bogus", "route=10.0.0.0/33"} {
+		if w := serve(r, newRequest("GET", "/api/nodes?"+query)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestNodeIPs(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	for _, node := range []struct {
+		name     string
+		nodeType string
+		ip       string
+		online   bool
+		draining bool
+	}{
+		{"mongo-1", "mongodb", "100.64.0.2", true, false},
+		{"mongo-2", "mongodb", "100.64.0.1", true, false},
+		{"mongo-3", "mongodb", "100.64.0.3", false, false},
+		{"mongo-4", "mongodb", "100.64.0.4", true, true},
+		{"app-1", "app", "100.64.0.5", true, false},
+	} {
+		addTestNode(state, nil, NodeInfo{UUID: "i-" + node.name, Name: node.name, NodeType: node.nodeType, Draining: node.draining})
+		hs.addNode(HeadscaleNode{Name: node.name, IPAddresses: []string{node.ip}, Online: node.online})
+	}
+	addTestNode(state, nil, NodeInfo{UUID: "i-mongo-5", Name: "mongo-5", NodeType: "mongodb"})
+
+	w := serve(r, newRequest("GET", "/api/nodes/ips?node_type=mongodb&port=27017"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var addrs []string
+	decodeJSON(t, w.Body.Bytes(), &addrs)
+	if want := []string{"100.64.0.1:27017", "100.64.0.2:27017"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("got %v, want %v", addrs, want)
+	}
+
+	for _, query := range []string{"node_type=mongodb", "port=27017", "node_type=mongodb&port=0", "node_type=mongodb&port=x"} {
+		if w := serve(r, newRequest("GET", "/api/nodes/ips?"+query)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestListNodesIncludeDebug(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	addTestNode(state, nil, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	hsNode := hs.addNode(HeadscaleNode{
+		Name:           "mongo-1",
+		User:           User{ID: "1", Name: "default"},
+		RegisterMethod: "REGISTER_METHOD_AUTH_KEY",
+		PreAuthKey:     &HeadscaleNodeAuthKeyRef{ID: "7", User: User{ID: "2", Name: "app-a-mongodb"}, AclTags: []string{"tag:db"}},
+	})
+
+	list := func(query string) NodeInfo {
+		t.Helper()
+		var resp NodesResponse
+		decodeJSON(t, serve(r, newRequest("GET", "/api/nodes"+query)).Body.Bytes(), &resp)
+		if len(resp.Nodes) != 1 {
+			t.Fatalf("%q: got %d nodes, want 1", query, len(resp.Nodes))
+		}
+		return resp.Nodes[0]
+	}
+
+	if node := list(""); node.Debug != nil {
+		t.Errorf("got debug details without include_debug: %+v", node.Debug)
+	}
+	want := NodeDebugInfo{
+		HeadscaleID:    hsNode.ID,
+		User:           "default",
+		RegisterMethod: "REGISTER_METHOD_AUTH_KEY",
+		AuthKeyID:      "7",
+		AuthKeyUser:    "app-a-mongodb",
+		AuthKeyTags:    []string{"tag:db"},
+	}
+	if node := list("?include_debug=true"); node.Debug == nil || !reflect.DeepEqual(*node.Debug, want) {
+		t.Errorf("got debug details %+v, want %+v", node.Debug, want)
+	}
+}
+
+func TestDrainNode(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "mongo-2", NodeType: "mongodb"})
+
+	names := func(query string) []string {
+		t.Helper()
+		var resp NodesResponse
+		decodeJSON(t, serve(r, newRequest("GET", "/api/nodes"+query)).Body.Bytes(), &resp)
+		names := []string{}
+		for _, node := range resp.Nodes {
+			names = append(names, node.Name)
+		}
+		return names
+	}
+
+	if w := serve(r, newOperatorRequest("POST", "/api/nodes/mongo-1/drain")); w.Code != http.StatusOK {
+		t.Fatalf("drain: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if got := names("?draining=true"); !reflect.DeepEqual(got, []string{"mongo-1"}) {
+		t.Errorf("draining=true: got %v, want mongo-1", got)
+	}
+	if got := names("?draining=false"); !reflect.DeepEqual(got, []string{"mongo-2"}) {
+		t.Errorf("draining=false: got %v, want mongo-2", got)
+	}
+
+	if w := serve(r, newOperatorRequest("POST", "/api/nodes/mongo-1/undrain")); w.Code != http.StatusOK {
+		t.Fatalf("undrain: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if got := names("?draining=true"); len(got) != 0 {
+		t.Errorf("after undrain: got draining nodes %v", got)
+	}
+
+	if w := serve(r, newOperatorRequest("POST", "/api/nodes/missing/drain")); w.Code != http.StatusNotFound {
+		t.Errorf("unknown node: got status %d, want 404", w.Code)
+	}
+	if w := serve(r, newRequest("GET", "/api/nodes?draining=maybe")); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid draining: got status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxNonceLength bounds the bootstrap nonce, which is kept in memory for
+// BOOTSTRAP_NONCE_TTL.
+const maxNonceLength = 128
+
+// nonceStore remembers the bootstrap nonces used within the last ttl, per
+// app, so a captured bootstrap request can't be replayed. Nonces are only
+// kept in memory: after a restart, or on another replica, a nonce can be
+// used once more.
+type nonceStore struct {
+	mutex sync.Mutex
+	ttl   time.Duration
+	seen  map[string]time.Time
+}
+
+func newNonceStore(ttl time.Duration) *nonceStore {
+	return &nonceStore{ttl: ttl, seen: make(map[string]time.Time)}
+}
+
+func nonceKey(appID, nonce string) string {
+	return appID + "\x00" + nonce
+}
+
+// use records nonce for appID and reports whether it was unused. Scoping by
+// app keeps one app from burning another's nonces.
+func (n *nonceStore) use(appID, nonce string, now time.Time) bool {
+	key := nonceKey(appID, nonce)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if usedAt, ok := n.seen[key]; ok && now.Sub(usedAt) < n.ttl {
+		return false
+	}
+	n.seen[key] = now
+	return true
+}
+
+// release forgets a nonce recorded by use, for a bootstrap that failed
+// after using it.
+func (n *nonceStore) release(appID, nonce string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.seen, nonceKey(appID, nonce))
+}
+
+// evict forgets nonces older than the ttl and returns how many there were.
+func (n *nonceStore) evict(now time.Time) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	evicted := 0
+	for key, usedAt := range n.seen {
+		if now.Sub(usedAt) >= n.ttl {
+			delete(n.seen, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// runEviction periodically evicts expired nonces until ctx is cancelled.
+func (n *nonceStore) runEviction(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n.evict(now)
+		}
+	}
+}
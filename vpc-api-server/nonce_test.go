@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBootstrapRejectsReusedNonce(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	bootstrapNode(t, r, testAppID, "instance_id=i1&nonce=n-1")
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i2&nonce=n-1"))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("replay: got status %d, want 409: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Code string `json:"code"`
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp.Code != "nonce_reused" {
+		t.Errorf("replay: got code %q, want nonce_reused", resp.Code)
+	}
+
+	// Nonces are scoped by app.
+	bootstrapNode(t, r, "app-b", "instance_id=i3&nonce=n-1")
+}
+
+func TestBootstrapNonceReleasedOnFailure(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/preauthkey" {
+			return false
+		}
+		writeFakeJSON(w, http.StatusInternalServerError, map[string]any{"message": "database is locked"})
+		return true
+	})
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i1&nonce=n-1")); w.Code == http.StatusOK {
+		t.Fatalf("bootstrap succeeded with a failing Headscale")
+	}
+
+	hs.setIntercept(nil)
+	bootstrapNode(t, r, testAppID, "instance_id=i1&nonce=n-1")
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i1&nonce=n-1")); w.Code != http.StatusConflict {
+		t.Errorf("replay after the retry: got status %d, want 409", w.Code)
+	}
+}
+
+func TestNonceStoreEviction(t *testing.T) {
+	nonces := newNonceStore(time.Minute)
+	now := time.Now()
+
+	nonces.use("app-a", "old", now)
+	nonces.use("app-a", "new", now.Add(30*time.Second))
+	if evicted := nonces.evict(now.Add(time.Minute)); evicted != 1 {
+		t.Errorf("evicted %d nonces, want 1", evicted)
+	}
+	if !nonces.use("app-a", "old", now.Add(time.Minute)) {
+		t.Errorf("an evicted nonce was rejected")
+	}
+	if nonces.use("app-a", "new", now.Add(time.Minute)) {
+		t.Errorf("a nonce within its ttl was accepted again")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/hujson"
+)
+
+const policyCacheTTL = 30 * time.Second
+
+type PolicyResponse struct {
+	Policy string `json:"policy"`
+}
+
+// aclPolicy is the subset of the Headscale ACL policy we care about.
+type aclPolicy struct {
+	TagOwners map[string][]string `json:"tagOwners"`
+}
+
+// policyCache holds the set of tags defined in the Headscale policy so that
+// bootstrap requests don't fetch the policy every time.
+type policyCache struct {
+	mutex     sync.Mutex
+	tags      map[string]bool
+	fetchedAt time.Time
+}
+
+var headscalePolicy policyCache
+
+func getHeadscalePolicy(ctx context.Context) (*aclPolicy, error) {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", headscaleInternalURL+"/api/v1/policy", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHeadscaleAPIError(resp)
+	}
+
+	var policyResp PolicyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&policyResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	// Headscale policies are HuJSON (JSON with comments and trailing commas).
+	standard, err := hujson.Standardize([]byte(policyResp.Policy))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+
+	var policy aclPolicy
+	if err := json.Unmarshal(standard, &policy); err != nil {
+		return nil, fmt.Errorf("failed to decode policy: %w", err)
+	}
+
+	return &policy, nil
+}
+
+// definedTags returns the tags declared in the policy's tagOwners, refreshing
+// the cached copy once it is older than policyCacheTTL. The policy is fetched
+// without the mutex held, so concurrent callers may each refresh it.
+func (p *policyCache) definedTags(ctx context.Context) (map[string]bool, error) {
+	p.mutex.Lock()
+	if p.tags != nil && time.Since(p.fetchedAt) < policyCacheTTL {
+		tags := p.tags
+		p.mutex.Unlock()
+		return tags, nil
+	}
+	p.mutex.Unlock()
+
+	policy, err := getHeadscalePolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]bool, len(policy.TagOwners))
+	for tag := range policy.TagOwners {
+		tags[tag] = true
+	}
+	p.mutex.Lock()
+	p.tags = tags
+	p.fetchedAt = time.Now()
+	p.mutex.Unlock()
+
+	return tags, nil
+}
+
+// invalidTags returns the requested tags that Headscale would reject, either
+// because they are malformed or not defined in the policy.
+func (p *policyCache) invalidTags(ctx context.Context, tags []string) ([]string, error) {
+	defined, err := p.definedTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	invalid := []string{}
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "tag:") || !defined[tag] {
+			invalid = append(invalid, tag)
+		}
+	}
+	return invalid, nil
+}
+
+// nodeTypeTagPrefix marks the ACL tag that records a node's type in
+// Headscale, e.g. tag:type-mongodb.
+const nodeTypeTagPrefix = "tag:type-"
+
+func nodeTypeTag(nodeType string) string {
+	return nodeTypeTagPrefix + nodeType
+}
+
+// appIDTag derives the ACL tag for an app, e.g. tag:app-1a2b3c, or "" if
+// nothing usable is left of the app id after sanitizing.
+func appIDTag(appID string) string {
+	if id := sanitizeNodeName(appID); id != "" {
+		return "tag:app-" + id
+	}
+	return ""
+}
+
+// nodeTypeFromTags returns the node type recorded in a node's tags, if any.
+func nodeTypeFromTags(tags []string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, nodeTypeTagPrefix) {
+			return strings.TrimPrefix(tag, nodeTypeTagPrefix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPolicyFetchedWithoutLock(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	hs.policy = `{"tagOwners": {"tag:db": ["admin"]}}`
+	arrived, release := hs.holdRequests(t, "/api/v1/policy")
+	cache := &policyCache{}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cache.definedTags(context.Background())
+		done <- err
+	}()
+	select {
+	case <-arrived:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the policy was never fetched")
+	}
+
+	if !cache.mutex.TryLock() {
+		t.Fatal("the policy cache is locked while fetching")
+	}
+	cache.mutex.Unlock()
+
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("definedTags: %v", err)
+	}
+	if tags, _ := cache.definedTags(context.Background()); !tags["tag:db"] {
+		t.Errorf("got tags %v, want tag:db", tags)
+	}
+}
+
+func TestBootstrapValidatesACLTags(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	hs.policy = `{
+		// HuJSON comments and trailing commas are allowed.
+		"tagOwners": {"tag:db": ["admin"],},
+	}`
+	_, r := newTestServer(t, nil)
+
+	bootstrapNode(t, r, testAppID, "instance_id=i1&tags=tag:db")
+	keys := hs.preAuthKeys()
+	if len(keys) != 1 || !reflect.DeepEqual(keys[0].AclTags, []string{"tag:db"}) {
+		t.Errorf("got keys %+v, want one tagged tag:db", keys)
+	}
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i2&tags=tag:db,tag:web,db"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("undefined tags: got status %d, want 400: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		InvalidTags []string `json:"invalid_tags"`
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if want := []string{"tag:web", "db"}; !reflect.DeepEqual(resp.InvalidTags, want) {
+		t.Errorf("got invalid tags %v, want %v", resp.InvalidTags, want)
+	}
+}
+
+func TestBootstrapTagsWithoutPolicy(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/api/v1/policy" {
+			return false
+		}
+		writeFakeJSON(w, http.StatusNotFound, map[string]any{"message": "no policy"})
+		return true
+	})
+	_, r := newTestServer(t, nil)
+
+	// Headscale has the final say when the policy can't be loaded.
+	bootstrapNode(t, r, testAppID, "instance_id=i1&tags=tag:web")
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// preAuthKeyLabel marks the keys this server issues, PREAUTH_KEY_LABEL.
+var preAuthKeyLabel = "vpc-api-server"
+
+// issuedKeyStore remembers the label of every pre-auth key we issued, by
+// Headscale key ID. Headscale keys have no label or comment field, and
+// encoding one as an ACL tag would tag the nodes too, so the label is kept
+// here. Once loaded from a file, every change is written back to it so that
+// cleanup still recognizes our keys after a restart.
+type issuedKeyStore struct {
+	mutex  sync.Mutex
+	path   string
+	labels map[string]string
+}
+
+var issuedKeys issuedKeyStore
+
+// load reads the keys recorded in path and keeps path to save changes to.
+func (k *issuedKeyStore) load(path string) error {
+	labels := make(map[string]string)
+	if err := readStateFile(path, &labels); err != nil {
+		return err
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.path = path
+	k.labels = labels
+	return nil
+}
+
+// save writes the recorded keys back to the file they were loaded from, if
+// any. The caller must hold the mutex.
+func (k *issuedKeyStore) save() {
+	if k.path == "" {
+		return
+	}
+	if err := writeStateFile(k.path, k.labels); err != nil {
+		log.Printf("Warning: failed to save issued pre-auth keys: %v", err)
+	}
+}
+
+func (k *issuedKeyStore) record(id, label string) {
+	if id == "" {
+		return
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.labels == nil {
+		k.labels = make(map[string]string)
+	}
+	k.labels[id] = label
+	k.save()
+}
+
+func (k *issuedKeyStore) label(id string) string {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.labels[id]
+}
+
+// issued reports whether we issued the key with the given ID.
+func (k *issuedKeyStore) issued(id string) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	_, ok := k.labels[id]
+	return ok
+}
+
+func (k *issuedKeyStore) forget(id string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if _, ok := k.labels[id]; !ok {
+		return
+	}
+	delete(k.labels, id)
+	k.save()
+}
+
+type HeadscalePreAuthKey struct {
+	ID         string     `json:"id"`
+	Key        string     `json:"key"`
+	Reusable   bool       `json:"reusable"`
+	Used       bool       `json:"used"`
+	Expiration *time.Time `json:"expiration"`
+	CreatedAt  *time.Time `json:"createdAt"`
+}
+
+type HeadscalePreAuthKeysResponse struct {
+	PreAuthKeys []HeadscalePreAuthKey `json:"preAuthKeys"`
+}
+
+func listPreAuthKeys(ctx context.Context, userID string) ([]HeadscalePreAuthKey, error) {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", headscaleInternalURL+"/api/v1/preauthkey?user="+url.QueryEscape(userID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHeadscaleAPIError(resp)
+	}
+
+	var keysResp HeadscalePreAuthKeysResponse
+	if err := json.NewDecoder(resp.Body).Decode(&keysResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return keysResp.PreAuthKeys, nil
+}
+
+func deletePreAuthKey(ctx context.Context, userID, key string) error {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"user": {userID}, "key": {key}}
+	req, err := http.NewRequestWithContext(ctx, "DELETE", headscaleInternalURL+"/api/v1/preauthkey?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHeadscaleAPIError(resp)
+	}
+
+	return nil
+}
+
+// PreAuthKeyInfo describes a pre-auth key without the key itself. Label is
+// empty for keys this server didn't issue.
+type PreAuthKeyInfo struct {
+	ID         string     `json:"id"`
+	User       string     `json:"user"`
+	Reusable   bool       `json:"reusable"`
+	Used       bool       `json:"used"`
+	Expiration *time.Time `json:"expiration"`
+	Label      string     `json:"label"`
+}
+
+// handleListPreAuthKeys lists the pre-auth keys of every Headscale user.
+// label filters by the label we recorded; an empty label selects the keys
+// we didn't issue.
+func handleListPreAuthKeys(c *gin.Context) {
+	labelFilter, filterByLabel := c.GetQuery("label")
+
+	users, err := listUsers(c.Request.Context())
+	if err != nil {
+		log.Printf("Failed to list Headscale users: %v", err)
+		c.JSON(headscaleErrorStatus(err), gin.H{"error": "Failed to list users"})
+		return
+	}
+
+	result := []PreAuthKeyInfo{}
+	for _, user := range users {
+		keys, err := listPreAuthKeys(c.Request.Context(), user.ID)
+		if err != nil {
+			log.Printf("Failed to list pre-auth keys of user %s: %v", user.Name, err)
+			c.JSON(headscaleErrorStatus(err), gin.H{"error": "Failed to list pre-auth keys"})
+			return
+		}
+		for _, key := range keys {
+			label := issuedKeys.label(key.ID)
+			if filterByLabel && label != labelFilter {
+				continue
+			}
+			result = append(result, PreAuthKeyInfo{
+				ID:         key.ID,
+				User:       user.Name,
+				Reusable:   key.Reusable,
+				Used:       key.Used,
+				Expiration: key.Expiration,
+				Label:      label,
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"preauthkeys": result})
+}
+
+// cleanupPreAuthKeys deletes unused pre-auth keys we issued that are past
+// their expiration; keys in that state can no longer register anything. Every
+// user is checked since namespaced users are created on demand, but keys
+// issued by anyone else are left alone.
+func cleanupPreAuthKeys(ctx context.Context) (int, error) {
+	users, err := listUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	deleted := 0
+	for _, user := range users {
+		keys, err := listPreAuthKeys(ctx, user.ID)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list pre-auth keys of user %s: %w", user.Name, err)
+		}
+
+		for _, key := range keys {
+			if !issuedKeys.issued(key.ID) || key.Used || key.Expiration == nil || key.Expiration.After(now) {
+				continue
+			}
+			if err := deletePreAuthKey(ctx, user.ID, key.Key); err != nil {
+				return deleted, fmt.Errorf("failed to delete pre-auth key %s of user %s: %w", key.ID, user.Name, err)
+			}
+			issuedKeys.forget(key.ID)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// runPreAuthKeyCleanup periodically removes expired, unused pre-auth keys.
+// Headscale releases without a delete endpoint answer 404, 405 or 501, in
+// which case cleanup is turned off rather than retried forever. It stops
+// when ctx is cancelled.
+func runPreAuthKeyCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		deleted, err := cleanupPreAuthKeys(ctx)
+		if status := headscaleAPIStatus(err); status == http.StatusNotFound || status == http.StatusMethodNotAllowed || status == http.StatusNotImplemented {
+			log.Printf("Warning: Headscale does not support deleting pre-auth keys, disabling cleanup: %v", err)
+			return
+		}
+		if err != nil {
+			log.Printf("Pre-auth key cleanup failed after deleting %d keys: %v", deleted, err)
+			continue
+		}
+		log.Printf("Pre-auth key cleanup deleted %d expired unused keys", deleted)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanupPreAuthKeysOnlyDeletesIssuedKeys(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	user := hs.addUser("mongodb", time.Now())
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	expired := hs.addKey(user.ID, HeadscalePreAuthKey{Expiration: &past})
+	used := hs.addKey(user.ID, HeadscalePreAuthKey{Expiration: &past, Used: true})
+	live := hs.addKey(user.ID, HeadscalePreAuthKey{Expiration: &future})
+	foreign := hs.addKey(user.ID, HeadscalePreAuthKey{Expiration: &past})
+	for _, key := range []HeadscalePreAuthKey{expired, used, live} {
+		issuedKeys.record(key.ID, preAuthKeyLabel)
+	}
+
+	deleted, err := cleanupPreAuthKeys(context.Background())
+	if err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("deleted %d keys, want 1", deleted)
+	}
+
+	remaining := map[string]bool{}
+	for _, key := range hs.preAuthKeys() {
+		remaining[key.ID] = true
+	}
+	if remaining[expired.ID] {
+		t.Errorf("expired unused key we issued was kept")
+	}
+	for name, key := range map[string]HeadscalePreAuthKey{"used": used, "unexpired": live, "foreign": foreign} {
+		if !remaining[key.ID] {
+			t.Errorf("%s key was deleted", name)
+		}
+	}
+	if issuedKeys.issued(expired.ID) {
+		t.Errorf("deleted key is still recorded as issued")
+	}
+}
+
+func TestCleanupPreAuthKeysAfterRestart(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	path := filepath.Join(t.TempDir(), "issued_preauth_keys.json")
+	if err := issuedKeys.load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	user := hs.addUser("default", time.Now())
+	past := time.Now().Add(-time.Hour)
+	ours := hs.addKey(user.ID, HeadscalePreAuthKey{Expiration: &past})
+	kept := hs.addKey(user.ID, HeadscalePreAuthKey{Expiration: &past})
+	issuedKeys.record(ours.ID, preAuthKeyLabel)
+
+	// A restart starts from an empty store and loads the file again.
+	issuedKeys = issuedKeyStore{}
+	if err := issuedKeys.load(path); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := issuedKeys.label(ours.ID); got != preAuthKeyLabel {
+		t.Errorf("got label %q after restart, want %q", got, preAuthKeyLabel)
+	}
+
+	if deleted, err := cleanupPreAuthKeys(context.Background()); err != nil || deleted != 1 {
+		t.Fatalf("deleted %d keys (%v), want 1", deleted, err)
+	}
+	if keys := hs.preAuthKeys(); len(keys) != 1 || keys[0].ID != kept.ID {
+		t.Errorf("remaining keys %+v, want only the one we didn't issue", keys)
+	}
+
+	issuedKeys = issuedKeyStore{}
+	if err := issuedKeys.load(path); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if issuedKeys.issued(ours.ID) {
+		t.Errorf("deleted key is still recorded in %s", path)
+	}
+}
+
+func TestIssuedKeysLoadRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "issued_preauth_keys.json")
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var store issuedKeyStore
+	if err := store.load(path); err == nil {
+		t.Errorf("load accepted a corrupt file")
+	}
+}
+
+func TestListPreAuthKeysByLabel(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	user := hs.addUser("manual", time.Now())
+	manual := hs.addKey(user.ID, HeadscalePreAuthKey{})
+	bootstrapNode(t, r, testAppID, "instance_id=i1&node_name=n1")
+
+	list := func(query string) []PreAuthKeyInfo {
+		t.Helper()
+		w := serve(r, newOperatorRequest("GET", "/api/preauthkeys"+query))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /api/preauthkeys%s: got status %d: %s", query, w.Code, w.Body)
+		}
+		var resp struct {
+			PreAuthKeys []PreAuthKeyInfo `json:"preauthkeys"`
+		}
+		decodeJSON(t, w.Body.Bytes(), &resp)
+		return resp.PreAuthKeys
+	}
+
+	if keys := list(""); len(keys) != 2 {
+		t.Errorf("got %d keys, want 2", len(keys))
+	}
+	if keys := list("?label=" + preAuthKeyLabel); len(keys) != 1 || keys[0].ID == manual.ID || keys[0].Label != preAuthKeyLabel {
+		t.Errorf("label=%s: got %+v, want only the bootstrap key", preAuthKeyLabel, keys)
+	}
+	if keys := list("?label="); len(keys) != 1 || keys[0].ID != manual.ID || keys[0].User != "manual" {
+		t.Errorf("empty label: got %+v, want only the manual key", keys)
+	}
+	if keys := list("?label=other"); len(keys) != 0 {
+		t.Errorf("label=other: got %+v, want none", keys)
+	}
+}
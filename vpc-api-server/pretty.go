@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// prettyJSONWriter buffers JSON responses so they can be re-indented once the
+// handler is done. Anything that isn't JSON (e.g. the SSE watch stream) is
+// passed straight through.
+type prettyJSONWriter struct {
+	gin.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *prettyJSONWriter) isJSON() bool {
+	return strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+}
+
+func (w *prettyJSONWriter) Write(data []byte) (int, error) {
+	if !w.isJSON() {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.buf.Write(data)
+}
+
+func (w *prettyJSONWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// prettyJSON indents JSON responses when the request has pretty=true, or for
+// every request when always is set (PRETTY_JSON in DEV_MODE).
+func prettyJSON(always bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !always && c.Query("pretty") != "true" {
+			c.Next()
+			return
+		}
+
+		w := &prettyJSONWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		if w.buf.Len() == 0 {
+			return
+		}
+
+		var out bytes.Buffer
+		if err := json.Indent(&out, w.buf.Bytes(), "", "  "); err != nil {
+			w.ResponseWriter.Write(w.buf.Bytes())
+			return
+		}
+		out.WriteByte('\n')
+		w.ResponseWriter.Write(out.Bytes())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPrettyJSON(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	compact := serve(r, newRequest("GET", "/api/config"))
+	pretty := serve(r, newRequest("GET", "/api/config?pretty=true"))
+	if pretty.Code != http.StatusOK || !strings.Contains(pretty.Body.String(), "\n  \"") {
+		t.Fatalf("pretty=true: got status %d and body %q, want indented JSON", pretty.Code, pretty.Body)
+	}
+	if strings.Contains(compact.Body.String(), "\n  \"") {
+		t.Errorf("got indented JSON without pretty=true: %q", compact.Body)
+	}
+
+	var want, got any
+	decodeJSON(t, compact.Body.Bytes(), &want)
+	decodeJSON(t, pretty.Body.Bytes(), &got)
+	wantJSON, _ := json.Marshal(want)
+	gotJSON, _ := json.Marshal(got)
+	if string(wantJSON) != string(gotJSON) {
+		t.Errorf("pretty=true changed the response: got %s, want %s", gotJSON, wantJSON)
+	}
+}
+
+func TestPrettyJSONAlwaysInDevMode(t *testing.T) {
+	t.Setenv("DEV_MODE", "true")
+	t.Setenv("PRETTY_JSON", "true")
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	if w := serve(r, newRequest("GET", "/api/config")); !strings.Contains(w.Body.String(), "\n  \"") {
+		t.Errorf("got %q, want indented JSON", w.Body)
+	}
+}
+
+func TestPrettyJSONPassesThroughEventStreams(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	w := serve(r, newRequest("GET", "/api/nodes/watch?timeout=10ms&pretty=true"))
+	if event := readSSE(t, bufio.NewReader(w.Body)); event.name != "snapshot" {
+		t.Errorf("got event %q, want the snapshot", event.name)
+	}
+}
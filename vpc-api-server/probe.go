@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// probeTarget is the port dialed on nodes of one type, and how often.
+type probeTarget struct {
+	port     int
+	interval time.Duration
+}
+
+// parseProbeTargets combines PROBE_PORTS (node_type=port) with the optional
+// PROBE_INTERVALS (node_type=duration); types without an interval use
+// defaultInterval.
+func parseProbeTargets(ports, intervals string, allowedTypes []string, defaultInterval time.Duration) (map[string]probeTarget, error) {
+	portEntries, err := parseKeyValueList(ports)
+	if err != nil {
+		return nil, err
+	}
+	intervalEntries, err := parseKeyValueList(intervals)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool, len(allowedTypes))
+	for _, nodeType := range allowedTypes {
+		allowed[nodeType] = true
+	}
+
+	targets := make(map[string]probeTarget, len(portEntries))
+	for nodeType, value := range portEntries {
+		if !allowed[nodeType] {
+			return nil, fmt.Errorf("unknown node type %q", nodeType)
+		}
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q for node type %s", value, nodeType)
+		}
+		targets[nodeType] = probeTarget{port: port, interval: defaultInterval}
+	}
+	for nodeType, value := range intervalEntries {
+		target, ok := targets[nodeType]
+		if !ok {
+			return nil, fmt.Errorf("interval for node type %q without a probe port", nodeType)
+		}
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid interval %q for node type %s", value, nodeType)
+		}
+		target.interval = interval
+		targets[nodeType] = target
+	}
+	return targets, nil
+}
+
+// nodeProber records whether nodes accept TCP connections on their
+// service port over the tailnet. Headscale's online flag only tells us the
+// node is connected to the control plane.
+type nodeProber struct {
+	mutex   sync.RWMutex
+	byType  map[string]map[string]bool
+	timeout time.Duration
+}
+
+func newNodeProber(timeout time.Duration) *nodeProber {
+	return &nodeProber{byType: make(map[string]map[string]bool), timeout: timeout}
+}
+
+// result returns the last probe result for a node, or nil if it has not
+// been probed.
+func (p *nodeProber) result(node NodeInfo) *bool {
+	if p == nil {
+		return nil
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	reachable, ok := p.byType[node.NodeType][node.UUID]
+	if !ok {
+		return nil
+	}
+	return &reachable
+}
+
+// probe dials every node of nodeType in parallel and replaces the results
+// for that type, so nodes that are gone are forgotten.
+func (p *nodeProber) probe(nodes []NodeInfo, nodeType string, port int) {
+	results := make(map[string]bool)
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, node := range nodes {
+		if node.NodeType != nodeType {
+			continue
+		}
+		if node.TailscaleIP == nil {
+			resultsMutex.Lock()
+			results[node.UUID] = false
+			resultsMutex.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(uuid, addr string) {
+			defer wg.Done()
+			reachable := false
+			if conn, err := net.DialTimeout("tcp", addr, p.timeout); err == nil {
+				conn.Close()
+				reachable = true
+			}
+			resultsMutex.Lock()
+			results[uuid] = reachable
+			resultsMutex.Unlock()
+		}(node.UUID, net.JoinHostPort(*node.TailscaleIP, strconv.Itoa(port)))
+	}
+	wg.Wait()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.byType[nodeType] = results
+}
+
+// runProbes probes one node type on its own interval, using the node set
+// from the last background poll, until ctx is cancelled.
+func (s *AppState) runProbes(ctx context.Context, nodeType string, target probeTarget) {
+	log.Printf("Probing %s nodes on port %d every %s", nodeType, target.port, target.interval)
+
+	ticker := time.NewTicker(target.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		nodes, _ := s.watcher.snapshot()
+		s.prober.probe(nodes, nodeType, target.port)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseProbeTargets(t *testing.T) {
+	allowed := []string{"mongodb", "app"}
+
+	targets, err := parseProbeTargets("mongodb=27017,app=8080", "app=5s", allowed, time.Minute)
+	if err != nil {
+		t.Fatalf("parseProbeTargets failed: %v", err)
+	}
+	if got := targets["mongodb"]; got != (probeTarget{port: 27017, interval: time.Minute}) {
+		t.Errorf("mongodb: got %+v", got)
+	}
+	if got := targets["app"]; got != (probeTarget{port: 8080, interval: 5 * time.Second}) {
+		t.Errorf("app: got %+v", got)
+	}
+
+	for _, tc := range []struct{ ports, intervals string }{
+		{"redis=6379", ""},
+		{"mongodb=0", ""},
+		{"mongodb=70000", ""},
+		{"mongodb=27017", "app=5s"},
+		{"mongodb=27017", "mongodb=-1s"},
+	} {
+		if _, err := parseProbeTargets(tc.ports, tc.intervals, allowed, time.Minute); err == nil {
+			t.Errorf("parseProbeTargets(%q, %q) succeeded, want an error", tc.ports, tc.intervals)
+		}
+	}
+}
+
+func TestNodeProberDialsNodes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	listening, closed := "127.0.0.1", "127.0.0.2"
+	up := NodeInfo{UUID: "up", NodeType: "mongodb", TailscaleIP: &listening}
+	down := NodeInfo{UUID: "down", NodeType: "mongodb", TailscaleIP: &closed}
+	noIP := NodeInfo{UUID: "no-ip", NodeType: "mongodb"}
+	other := NodeInfo{UUID: "other", NodeType: "app", TailscaleIP: &listening}
+
+	prober := newNodeProber(time.Second)
+	prober.probe([]NodeInfo{up, down, noIP, other}, "mongodb", port)
+
+	for _, tc := range []struct {
+		node NodeInfo
+		want bool
+	}{{up, true}, {down, false}, {noIP, false}} {
+		got := prober.result(tc.node)
+		if got == nil || *got != tc.want {
+			t.Errorf("node %s on port %d: got %v, want %v", tc.node.UUID, port, got, tc.want)
+		}
+	}
+	if got := prober.result(other); got != nil {
+		t.Errorf("node of another type was probed: %v", *got)
+	}
+
+	prober.probe([]NodeInfo{up}, "mongodb", port)
+	if got := prober.result(down); got != nil {
+		t.Errorf("removed node kept its result")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// parseKeyValueList parses "a=1,b=2" into a map.
+func parseKeyValueList(list string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, item := range splitList(list) {
+		key, value, ok := strings.Cut(item, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected key=value", item)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
+
+// parseNodeTypeQuotas parses NODE_TYPE_QUOTAS, e.g. "app=50,mongodb=7".
+func parseNodeTypeQuotas(list string, allowedTypes []string) (map[string]int, error) {
+	entries, err := parseKeyValueList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool, len(allowedTypes))
+	for _, nodeType := range allowedTypes {
+		allowed[nodeType] = true
+	}
+
+	quotas := make(map[string]int, len(entries))
+	for nodeType, value := range entries {
+		if !allowed[nodeType] {
+			return nil, fmt.Errorf("unknown node type %q", nodeType)
+		}
+		quota, err := strconv.Atoi(value)
+		if err != nil || quota < 0 {
+			return nil, fmt.Errorf("invalid quota %q for node type %s", value, nodeType)
+		}
+		quotas[nodeType] = quota
+	}
+	return quotas, nil
+}
+
+// quotaExceeded reports whether registering instanceID as nodeType would go
+// over the configured quota, along with the quota and current count. A node
+// re-registering under the same instance id doesn't count against itself.
+func (s *AppState) quotaExceeded(ctx context.Context, nodeType, instanceID string) (bool, int, int) {
+	quota, ok := s.config.NodeTypeQuotas[nodeType]
+	if !ok {
+		return false, 0, 0
+	}
+
+	nodes := s.storedNodes()
+	onlyOnline := !s.config.QuotaCountOffline
+	if onlyOnline {
+		merged, err := s.mergedNodes(ctx, false)
+		if err != nil {
+			// Without live state, count every stored node to stay on the
+			// safe side of the quota.
+			log.Printf("Failed to get online state for quota check, counting all nodes: %v", err)
+			onlyOnline = false
+		} else {
+			nodes = merged
+		}
+	}
+
+	count := 0
+	for _, node := range nodes {
+		if node.NodeType != nodeType || node.UUID == instanceID {
+			continue
+		}
+		// A node that just bootstrapped is still pending; it counts so that
+		// back-to-back bootstraps can't overshoot the quota.
+		if onlyOnline && !node.Online && node.Status != statusPending {
+			continue
+		}
+		count++
+	}
+
+	return count >= quota, quota, count
+}
+
+// nodeTypeLocks hands out one mutex per node type. Bootstraps of a type with
+// a quota hold it from the quota check until the node is stored, so that
+// concurrent bootstraps can't all pass the check and overshoot the quota.
+type nodeTypeLocks struct {
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks nodeType and returns the function that unlocks it, which may
+// be called more than once.
+func (l *nodeTypeLocks) lock(nodeType string) func() {
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := l.locks[nodeType]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[nodeType] = lock
+	}
+	l.mutex.Unlock()
+
+	lock.Lock()
+	var once sync.Once
+	return func() { once.Do(lock.Unlock) }
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegisterQuota(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.NodeTypeQuotas = map[string]int{"mongodb": 2} })
+
+	for _, id := range []string{"i1", "i2"} {
+		if w := serve(r, newRequest("GET", "/api/register?node_type=mongodb&instance_id="+id)); w.Code != http.StatusOK {
+			t.Fatalf("bootstrap %s: got status %d: %s", id, w.Code, w.Body)
+		}
+	}
+
+	w := serve(r, newRequest("GET", "/api/register?node_type=mongodb&instance_id=i3"))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("bootstrap over quota: got status %d, want 403", w.Code)
+	}
+	var body struct{ Code string }
+	decodeJSON(t, w.Body.Bytes(), &body)
+	if body.Code != "quota_exceeded" {
+		t.Errorf("got code %q, want quota_exceeded", body.Code)
+	}
+
+	// Re-registering a counted instance and other types are not limited.
+	if w := serve(r, newRequest("GET", "/api/register?node_type=mongodb&instance_id=i2")); w.Code != http.StatusOK {
+		t.Errorf("re-registering i2: got status %d, want 200", w.Code)
+	}
+	if w := serve(r, newRequest("GET", "/api/register?node_type=app&instance_id=i4")); w.Code != http.StatusOK {
+		t.Errorf("bootstrap of another type: got status %d, want 200", w.Code)
+	}
+}
+
+func TestRegisterQuotaOnlineOnly(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) {
+		c.NodeTypeQuotas = map[string]int{"mongodb": 1}
+		c.QuotaCountOffline = false
+	})
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	hs.updateNodes("mongo-1", func(n *HeadscaleNode) { n.Online = false })
+
+	if w := serve(r, newRequest("GET", "/api/register?node_type=mongodb&instance_id=i2")); w.Code != http.StatusOK {
+		t.Fatalf("offline node counted against the quota: got status %d", w.Code)
+	}
+	hs.updateNodes("mongo-1", func(n *HeadscaleNode) { n.Online = true })
+	if w := serve(r, newRequest("GET", "/api/register?node_type=mongodb&instance_id=i3")); w.Code != http.StatusForbidden {
+		t.Errorf("online node not counted: got status %d, want 403", w.Code)
+	}
+}
+
+func TestRegisterQuotaConcurrent(t *testing.T) {
+	for _, countOffline := range []bool{true, false} {
+		hs := newFakeHeadscale(t)
+		_, r := newTestServer(t, func(c *Config) {
+			c.NodeTypeQuotas = map[string]int{"mongodb": 3}
+			c.QuotaCountOffline = countOffline
+		})
+		// Widen the window between the quota check and storing the node.
+		hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+			if r.URL.Path == "/api/v1/preauthkey" {
+				time.Sleep(20 * time.Millisecond)
+			}
+			return false
+		})
+
+		var wg sync.WaitGroup
+		codes := make(chan int, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				w := serve(r, newRequest("GET", fmt.Sprintf("/api/register?node_type=mongodb&instance_id=i%d", i)))
+				codes <- w.Code
+			}(i)
+		}
+		wg.Wait()
+		close(codes)
+
+		counts := map[int]int{}
+		for code := range codes {
+			counts[code]++
+		}
+		if counts[http.StatusOK] != 3 || counts[http.StatusForbidden] != 7 {
+			t.Errorf("QuotaCountOffline=%v: got statuses %v, want 3 OK and 7 forbidden", countOffline, counts)
+		}
+	}
+}
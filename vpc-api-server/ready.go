@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds each readiness check so /ready always answers.
+const readinessTimeout = 3 * time.Second
+
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// ReadinessChecker runs named dependency checks in registration order and
+// stops at the first failure, so /ready names the dependency furthest
+// upstream that is broken.
+type ReadinessChecker struct {
+	checks []ReadinessCheck
+}
+
+func (r *ReadinessChecker) Register(name string, check func(ctx context.Context) error) {
+	r.checks = append(r.checks, ReadinessCheck{Name: name, Check: check})
+}
+
+// Names lists the registered checks in the order they run.
+func (r *ReadinessChecker) Names() []string {
+	names := make([]string, 0, len(r.checks))
+	for _, check := range r.checks {
+		names = append(names, check.Name)
+	}
+	return names
+}
+
+// Run returns the name and error of the first failing check, or "" and nil
+// if all pass.
+func (r *ReadinessChecker) Run(ctx context.Context) (string, error) {
+	for _, check := range r.checks {
+		checkCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+		err := check.Check(checkCtx)
+		cancel()
+		if err != nil {
+			return check.Name, err
+		}
+	}
+	return "", nil
+}
+
+func checkDstackMesh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", dstackMeshURL+"/info", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("dstack-mesh unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("dstack-mesh Info returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func checkHeadscaleAPIKey(ctx context.Context) error {
+	_, err := getAPIKey()
+	return err
+}
+
+func checkHeadscaleAPI(ctx context.Context) error {
+	_, err := getHeadscaleNodes(ctx)
+	return err
+}
+
+// newReadinessChecker registers the default checks: dstack-mesh, then the
+// Headscale API key, then the Headscale API itself. dstack-mesh is skipped
+// when the Headscale URL is configured explicitly, since it is then only
+// consulted at startup.
+func newReadinessChecker(checkMesh bool) *ReadinessChecker {
+	r := &ReadinessChecker{}
+	if checkMesh {
+		r.Register("dstack-mesh", checkDstackMesh)
+	}
+	r.Register("headscale-api-key", checkHeadscaleAPIKey)
+	r.Register("headscale-api", checkHeadscaleAPI)
+	return r
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestReadinessCheckerStopsAtFirstFailure(t *testing.T) {
+	var ran []string
+	check := func(name string, err error) func(context.Context) error {
+		return func(context.Context) error {
+			ran = append(ran, name)
+			return err
+		}
+	}
+
+	r := &ReadinessChecker{}
+	r.Register("first", check("first", nil))
+	r.Register("second", check("second", errors.New("down")))
+	r.Register("third", check("third", errors.New("also down")))
+
+	if got := r.Names(); !reflect.DeepEqual(got, []string{"first", "second", "third"}) {
+		t.Errorf("Names() = %v", got)
+	}
+	failed, err := r.Run(context.Background())
+	if failed != "second" || err == nil || err.Error() != "down" {
+		t.Errorf("Run() = %q, %v; want the second check's failure", failed, err)
+	}
+	if !reflect.DeepEqual(ran, []string{"first", "second"}) {
+		t.Errorf("ran %v, want the checks up to the first failure", ran)
+	}
+}
+
+func TestReadyNamesFailedCheck(t *testing.T) {
+	t.Setenv("VPC_SERVER_URL", "https://headscale.example")
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	state.warm.Store(true)
+
+	var resp struct {
+		Status      string   `json:"status"`
+		FailedCheck string   `json:"failed_check"`
+		Checks      []string `json:"checks"`
+	}
+	w := serve(r, httptest.NewRequest("GET", "/ready", nil))
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || !reflect.DeepEqual(resp.Checks, []string{"headscale-api-key", "headscale-api"}) {
+		t.Errorf("got status %d with checks %v", w.Code, resp.Checks)
+	}
+
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		writeFakeJSON(w, http.StatusBadGateway, map[string]any{"message": "down"})
+		return true
+	})
+	w = serve(r, httptest.NewRequest("GET", "/ready", nil))
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.FailedCheck != "headscale-api" {
+		t.Errorf("Headscale down: got status %d, failed_check %q", w.Code, resp.FailedCheck)
+	}
+
+	t.Setenv("HEADSCALE_API_KEY", "")
+	t.Setenv("HEADSCALE_API_KEY_FILE", "/nonexistent/api_key")
+	w = serve(r, httptest.NewRequest("GET", "/ready", nil))
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if w.Code != http.StatusServiceUnavailable || resp.FailedCheck != "headscale-api-key" {
+		t.Errorf("no API key: got status %d, failed_check %q", w.Code, resp.FailedCheck)
+	}
+}
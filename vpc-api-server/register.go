@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// validRegistrationKey matches the registration key Headscale puts in a
+// node's login URL (/register/<key>): 24 URL-safe base64 characters.
+var validRegistrationKey = regexp.MustCompile(`^[A-Za-z0-9_-]{24}$`)
+
+type HeadscaleNodeResponse struct {
+	Node HeadscaleNode `json:"node"`
+}
+
+// registerHeadscaleNode registers a node that is waiting in Headscale's
+// interactive login flow under user, creating the user if missing. The node
+// keeps the keys it generated itself; no pre-auth key is involved.
+func registerHeadscaleNode(ctx context.Context, user, key string) (HeadscaleNode, error) {
+	ctx, span := tracer.Start(ctx, "registerHeadscaleNode")
+	defer span.End()
+
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return HeadscaleNode{}, err
+	}
+
+	if _, err := getOrCreateUserID(ctx, user); err != nil {
+		return HeadscaleNode{}, fmt.Errorf("failed to get user ID: %w", err)
+	}
+
+	query := url.Values{"user": {user}, "key": {key}}
+	req, err := http.NewRequestWithContext(ctx, "POST", headscaleInternalURL+"/api/v1/node/register?"+query.Encode(), nil)
+	if err != nil {
+		return HeadscaleNode{}, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return HeadscaleNode{}, fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return HeadscaleNode{}, newHeadscaleAPIError(resp)
+	}
+
+	var nodeResp HeadscaleNodeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&nodeResp); err != nil {
+		return HeadscaleNode{}, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(nodeResp.Node.IPAddresses) == 0 {
+		nodeResp.Node.IPAddresses = nodeResp.Node.LegacyIPAddresses
+	}
+
+	return nodeResp.Node, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterDefaultNodeType(t *testing.T) {
+	newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.DefaultNodeType = "mongodb" })
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if node, _ := state.storedNode("i1"); node.NodeType != "mongodb" {
+		t.Errorf("got node_type %q, want the default mongodb", node.NodeType)
+	}
+
+	// An explicit type still wins over the default.
+	serve(r, newRequest("GET", "/api/register?instance_id=i2&node_name=n2&node_type=app"))
+	if node, _ := state.storedNode("i2"); node.NodeType != "app" {
+		t.Errorf("got node_type %q, want app", node.NodeType)
+	}
+}
+
+func TestRegisterWithoutNodeType(t *testing.T) {
+	newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+
+	// Without a default, node_type stays optional and empty.
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if node, _ := state.storedNode("i1"); node.NodeType != "" {
+		t.Errorf("got node_type %q, want none", node.NodeType)
+	}
+
+	// The instance id is still required, and the type must be allowed.
+	if w := serve(r, newRequest("GET", "/api/register?node_type=mongodb")); w.Code != http.StatusBadRequest {
+		t.Errorf("without instance_id: got status %d, want 400", w.Code)
+	}
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i2&node_type=redis")); w.Code != http.StatusBadRequest {
+		t.Errorf("with a disallowed node_type: got status %d, want 400", w.Code)
+	}
+}
+
+func TestRegisterKeyReusability(t *testing.T) {
+	for _, reusable := range []bool{true, false} {
+		hs := newFakeHeadscale(t)
+		_, r := newTestServer(t, func(c *Config) { c.ReusableKeys = reusable })
+
+		w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("REUSABLE_KEYS=%t: got status %d: %s", reusable, w.Code, w.Body)
+		}
+		keys := hs.preAuthKeys()
+		if len(keys) != 1 {
+			t.Fatalf("REUSABLE_KEYS=%t: issued %d keys, want 1", reusable, len(keys))
+		}
+		if keys[0].Reusable != reusable {
+			t.Errorf("REUSABLE_KEYS=%t: issued a key with reusable=%t", reusable, keys[0].Reusable)
+		}
+	}
+}
+
+func TestAppIDTag(t *testing.T) {
+	for appID, want := range map[string]string{
+		"1a2b3c":  "tag:app-1a2b3c",
+		"My_App.": "tag:app-my-app",
+		"__":      "",
+	} {
+		if got := appIDTag(appID); got != want {
+			t.Errorf("appIDTag(%q) = %q, want %q", appID, got, want)
+		}
+	}
+}
+
+func TestRegisterAppIDTags(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	hs.policy = `{"tagOwners": {"tag:db": [], "tag:app-app-a": []}}`
+	_, r := newTestServer(t, func(c *Config) { c.AppIDTags = true })
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1&tags=tag:db"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	keys := hs.preAuthKeys()
+	if len(keys) != 1 {
+		t.Fatalf("issued %d keys, want 1", len(keys))
+	}
+	if want := []string{"tag:db", "tag:app-app-a"}; !reflect.DeepEqual(keys[0].AclTags, want) {
+		t.Errorf("key tags %v, want %v", keys[0].AclTags, want)
+	}
+
+	req := newRequest("GET", "/api/register?instance_id=i2&node_name=n2")
+	req.Header.Set("x-dstack-app-id", "app-b")
+	if w := serve(r, req); w.Code != http.StatusInternalServerError {
+		t.Errorf("app tag missing from the policy: got status %d, want 500", w.Code)
+	}
+}
+
+func TestRegisterNodeTypeTags(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	hs.policy = `{"tagOwners": {"tag:type-mongodb": []}}`
+	_, r := newTestServer(t, func(c *Config) { c.NodeTypeTags = true })
+
+	bootstrapNode(t, r, testAppID, "instance_id=i1&node_name=n1&node_type=mongodb")
+	keys := hs.preAuthKeys()
+	if len(keys) != 1 || !reflect.DeepEqual(keys[0].AclTags, []string{"tag:type-mongodb"}) {
+		t.Fatalf("got keys %+v, want one tagged tag:type-mongodb", keys)
+	}
+	if got := nodeTypeFromTags(keys[0].AclTags); got != "mongodb" {
+		t.Errorf("nodeTypeFromTags(%v) = %q, want mongodb", keys[0].AclTags, got)
+	}
+
+	req := newRequest("GET", "/api/register?instance_id=i2&node_name=n2&node_type=app")
+	req.Header.Set("x-dstack-app-id", testAppID)
+	if w := serve(r, req); w.Code != http.StatusInternalServerError {
+		t.Errorf("type tag missing from the policy: got status %d, want 500", w.Code)
+	}
+}
+
+func TestRegisterReturnsKeyExpiry(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var resp BootstrapResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp.KeyExpiresAt == nil {
+		t.Fatalf("key_expires_at missing")
+	}
+
+	keys := hs.preAuthKeys()
+	if len(keys) != 1 || keys[0].Expiration == nil {
+		t.Fatalf("got keys %+v, want one with an expiration", keys)
+	}
+	if !resp.KeyExpiresAt.Equal(*keys[0].Expiration) {
+		t.Errorf("key_expires_at %s, but Headscale has %s", resp.KeyExpiresAt, keys[0].Expiration)
+	}
+	if !resp.KeyExpiresAt.After(time.Now()) {
+		t.Errorf("key_expires_at %s is not in the future", resp.KeyExpiresAt)
+	}
+}
+
+func TestRegisterIncludeGateway(t *testing.T) {
+	newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	state.gatewayDomain = "gw.example.com"
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"instance_id=i1", ""},
+		{"instance_id=i2&include_gateway=true", "gw.example.com"},
+	} {
+		w := serve(r, newRequest("GET", "/api/register?"+tc.query))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want 200: %s", tc.query, w.Code, w.Body)
+		}
+		var resp BootstrapResponse
+		decodeJSON(t, w.Body.Bytes(), &resp)
+		if resp.GatewayDomain != tc.want {
+			t.Errorf("%s: got gateway domain %q, want %q", tc.query, resp.GatewayDomain, tc.want)
+		}
+	}
+}
+
+func TestRegisterClientRef(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1&client_ref="+url.QueryEscape("order/42 <x>")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp BootstrapResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp.ClientRef != "order/42__x_" {
+		t.Errorf("got client_ref %q, want order/42__x_", resp.ClientRef)
+	}
+
+	hs.addNode(HeadscaleNode{Name: "n1", User: User{ID: "1", Name: "default"}, Online: true})
+	w = serve(r, newRequest("GET", "/api/nodes"))
+	var nodes NodesResponse
+	decodeJSON(t, w.Body.Bytes(), &nodes)
+	if len(nodes.Nodes) != 1 || nodes.Nodes[0].ClientRef != "order/42__x_" {
+		t.Errorf("got nodes %+v, want n1 with the sanitized client_ref", nodes.Nodes)
+	}
+
+	long := strings.Repeat("a", maxClientRefLength+1)
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i2&client_ref="+long)); w.Code != http.StatusBadRequest {
+		t.Errorf("over-long client_ref: got status %d, want 400", w.Code)
+	}
+	if stored := state.storedNodes(); len(stored) != 1 {
+		t.Errorf("got %d registered nodes, want the rejected bootstrap not to add one", len(stored))
+	}
+}
+
+func TestRegisterWithNodeKey(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	nodeKey := "AbCdEfGhIjKlMnOpQrSt_-12"
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1&node_key="+nodeKey))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp BootstrapResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp.PreAuthKey != "" || resp.KeyExpiresAt != nil {
+		t.Errorf("got pre-auth key %q expiring %v, want none", resp.PreAuthKey, resp.KeyExpiresAt)
+	}
+	if resp.NodeID == "" || resp.TailscaleIP != "100.64.0."+resp.NodeID {
+		t.Errorf("got node %q at %q, want the registered node and its IP", resp.NodeID, resp.TailscaleIP)
+	}
+
+	calls := hs.requestsTo("POST", "/api/v1/node/register")
+	if len(calls) != 1 || calls[0].Query.Get("key") != nodeKey || calls[0].Query.Get("user") != "default" {
+		t.Errorf("got register calls %v, want one for %s under default", calls, nodeKey)
+	}
+	if keys := hs.preAuthKeys(); len(keys) != 0 {
+		t.Errorf("issued %d pre-auth keys, want none", len(keys))
+	}
+	if stored := state.storedNodes(); len(stored) != 1 || stored[0].TailscaleIP == nil {
+		t.Errorf("got stored nodes %+v, want n1 with its Tailscale IP", stored)
+	}
+
+	for _, query := range []string{
+		"instance_id=i2&node_key=short",
+		"instance_id=i2&node_key=" + nodeKey + "&tags=tag:db",
+	} {
+		if w := serve(r, newRequest("GET", "/api/register?"+query)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, w.Code)
+		}
+	}
+}
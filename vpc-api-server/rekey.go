@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ExpirePreAuthKeyRequest struct {
+	User string `json:"user"`
+	Key  string `json:"key"`
+}
+
+func expirePreAuthKey(ctx context.Context, userID, key string) error {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return err
+	}
+
+	jsonBody, err := json.Marshal(ExpirePreAuthKeyRequest{User: userID, Key: key})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", headscaleInternalURL+"/api/v1/preauthkey/expire", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHeadscaleAPIError(resp)
+	}
+
+	return nil
+}
+
+// handleRekeyNode issues a fresh pre-auth key for a registered node whose
+// key expired before it joined, without registering it again. Only the app
+// that bootstrapped the node may rekey it, or an operator if no app was
+// recorded. The previous key is expired on a best-effort basis.
+func (s *AppState) handleRekeyNode(c *gin.Context) {
+	instanceID := c.Param("name")
+
+	node, ok := s.storedNode(instanceID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+	appID := c.GetHeader("x-dstack-app-id")
+	switch {
+	case node.AppID == "":
+		// Nothing ties the node to an app, e.g. it was bootstrapped without
+		// the header while AUTH_ENFORCE was off, so only operators may
+		// rekey it.
+		if !s.isOperator(c) {
+			log.Printf("Rejecting rekey of %s (%s) by app %s, it has no app and no operator token was given", logName(node.Name), instanceID, appID)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Operator token required to rekey a node without an app"})
+			return
+		}
+	case node.AppID != appID:
+		log.Printf("Rejecting rekey of %s (%s) by app %s, it was registered by app %s", logName(node.Name), instanceID, appID, node.AppID)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Node belongs to another app"})
+		return
+	}
+
+	preAuthKey, keyExpiresAt, err := s.rekeyNode(c.Request.Context(), node)
+	if errors.Is(err, errNodeGone) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to generate pre-auth key: %v", err)
+		c.JSON(headscaleErrorStatus(err), bootstrapErrorBody(err, "Failed to generate pre-auth key"))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pre_auth_key": preAuthKey, "key_expires_at": keyExpiresAt})
+}
+
+// errNodeGone is returned by rekeyNode when the node was deleted while its
+// new key was being issued.
+var errNodeGone = errors.New("node was deleted")
+
+// rekeyNode issues a fresh pre-auth key for a registered node with the
+// options of its previous one, stores it and expires the previous key on a
+// best-effort basis.
+func (s *AppState) rekeyNode(ctx context.Context, node NodeInfo) (string, time.Time, error) {
+	preAuthKey, keyExpiresAt, err := generatePreAuthKey(ctx, node.keyOptions)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if !s.updateNode(node.UUID, func(n *NodeInfo) { n.authKey = preAuthKey }) {
+		return "", time.Time{}, errNodeGone
+	}
+
+	if node.authKey != "" {
+		if err := expireOldKey(ctx, node); err != nil {
+			log.Printf("Failed to expire previous pre-auth key of %s (%s): %v", logName(node.Name), node.UUID, err)
+		}
+	}
+
+	log.Printf("Rekeyed node %s (%s)", logName(node.Name), node.UUID)
+	return preAuthKey, keyExpiresAt, nil
+}
+
+type RekeyFailure struct {
+	InstanceID string `json:"instance_id"`
+	Error      string `json:"error"`
+}
+
+type RekeyNodesResponse struct {
+	// Keys maps the instance id of every rekeyed node to its new key.
+	Keys   map[string]string `json:"keys"`
+	Failed []RekeyFailure    `json:"failed"`
+}
+
+// handleRekeyNodes issues fresh pre-auth keys for every registered node of a
+// type, e.g. after a policy change. A failure for one node doesn't stop the
+// others; failures are reported alongside the new keys.
+func (s *AppState) handleRekeyNodes(c *gin.Context) {
+	nodeType := s.canonicalNodeType(c.Query("node_type"))
+	if nodeType == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required parameters"})
+		return
+	}
+
+	result := RekeyNodesResponse{Keys: make(map[string]string), Failed: []RekeyFailure{}}
+	for _, node := range s.storedNodes() {
+		if node.NodeType != nodeType {
+			continue
+		}
+		preAuthKey, _, err := s.rekeyNode(c.Request.Context(), node)
+		if errors.Is(err, errNodeGone) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to rekey node %s (%s): %v", logName(node.Name), node.UUID, err)
+			result.Failed = append(result.Failed, RekeyFailure{InstanceID: node.UUID, Error: err.Error()})
+			continue
+		}
+		result.Keys[node.UUID] = preAuthKey
+	}
+
+	log.Printf("Bulk rekey of node_type %s: %d rekeyed, %d failed", nodeType, len(result.Keys), len(result.Failed))
+	c.JSON(http.StatusOK, result)
+}
+
+func expireOldKey(ctx context.Context, node NodeInfo) error {
+	user := node.keyOptions.User
+	if user == "" {
+		user = "default"
+	}
+	userID, err := getUserID(ctx, user)
+	if err != nil {
+		return err
+	}
+	return expirePreAuthKey(ctx, userID, node.authKey)
+}
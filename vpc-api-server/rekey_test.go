@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// bootstrapNode registers a node through /api/register as app and returns
+// its pre-auth key.
+func bootstrapNode(t *testing.T, r http.Handler, app, query string) string {
+	t.Helper()
+	req := newRequest("GET", "/api/register?"+query)
+	req.Header.Set("x-dstack-app-id", app)
+	w := serve(r, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("bootstrap %s: got status %d: %s", query, w.Code, w.Body)
+	}
+	var resp BootstrapResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	return resp.PreAuthKey
+}
+
+func TestRekeyNode(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+	oldKey := bootstrapNode(t, r, testAppID, "instance_id=i1&node_name=n1")
+
+	w := serve(r, newRequest("POST", "/api/nodes/i1/rekey"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		PreAuthKey string `json:"pre_auth_key"`
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp.PreAuthKey == "" || resp.PreAuthKey == oldKey {
+		t.Errorf("got key %q, want a new one", resp.PreAuthKey)
+	}
+
+	for _, key := range hs.preAuthKeys() {
+		expired := key.Expiration != nil && !key.Expiration.After(time.Now())
+		if key.Key == oldKey && !expired {
+			t.Errorf("previous key was not expired")
+		}
+		if key.Key == resp.PreAuthKey && expired {
+			t.Errorf("new key is already expired")
+		}
+	}
+
+	req := newRequest("POST", "/api/nodes/i1/rekey")
+	req.Header.Set("x-dstack-app-id", "app-b")
+	if w := serve(r, req); w.Code != http.StatusForbidden {
+		t.Errorf("rekey by another app: got status %d, want 403", w.Code)
+	}
+	if w := serve(r, newRequest("POST", "/api/nodes/missing/rekey")); w.Code != http.StatusNotFound {
+		t.Errorf("unknown node: got status %d, want 404", w.Code)
+	}
+}
+
+func TestRekeyNodeWithoutAppNeedsOperator(t *testing.T) {
+	newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	// As bootstrapped without the app id header while AUTH_ENFORCE was off.
+	addTestNode(state, nil, NodeInfo{UUID: "i1", Name: "n1", NodeType: "mongodb"})
+
+	if w := serve(r, newRequest("POST", "/api/nodes/i1/rekey")); w.Code != http.StatusForbidden {
+		t.Errorf("rekey by an app: got status %d, want 403", w.Code)
+	}
+	w := serve(r, newOperatorRequest("POST", "/api/nodes/i1/rekey"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("rekey by an operator: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		PreAuthKey string `json:"pre_auth_key"`
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp.PreAuthKey == "" {
+		t.Errorf("operator rekey returned no key")
+	}
+}
+
+func TestRekeyNodesByType(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	oldKeys := map[string]string{
+		"i1": bootstrapNode(t, r, testAppID, "instance_id=i1&node_name=n1&node_type=mongodb"),
+		"i2": bootstrapNode(t, r, testAppID, "instance_id=i2&node_name=n2&node_type=mongodb"),
+	}
+	bootstrapNode(t, r, testAppID, "instance_id=i3&node_name=n3&node_type=app")
+
+	w := serve(r, newOperatorRequest("POST", "/api/nodes/rekey?node_type=mongodb"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp RekeyNodesResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if len(resp.Keys) != 2 || len(resp.Failed) != 0 {
+		t.Fatalf("got %+v, want new keys for i1 and i2", resp)
+	}
+	for id, oldKey := range oldKeys {
+		if key := resp.Keys[id]; key == "" || key == oldKey {
+			t.Errorf("%s: got key %q, want a new one", id, key)
+		}
+	}
+
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/preauthkey" {
+			return false
+		}
+		writeFakeJSON(w, http.StatusInternalServerError, map[string]any{"message": "database is locked"})
+		return true
+	})
+	w = serve(r, newOperatorRequest("POST", "/api/nodes/rekey?node_type=mongodb"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("with failing key creation: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	resp = RekeyNodesResponse{}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if len(resp.Keys) != 0 || len(resp.Failed) != 2 {
+		t.Errorf("with failing key creation: got %+v, want both nodes failed", resp)
+	}
+
+	if w := serve(r, newOperatorRequest("POST", "/api/nodes/rekey")); w.Code != http.StatusBadRequest {
+		t.Errorf("without node_type: got status %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Retirement states.
+const (
+	retirePending   = "pending"
+	retireDeleted   = "deleted"
+	retireCancelled = "cancelled"
+	retireFailed    = "failed"
+)
+
+// Retirement tracks a node being drained and then deleted.
+type Retirement struct {
+	Name     string    `json:"name"`
+	Status   string    `json:"status"`
+	DeleteAt time.Time `json:"delete_at"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// retirementTracker keeps the latest retirement per node name so its status
+// can be polled after the request returns.
+type retirementTracker struct {
+	mutex  sync.Mutex
+	byName map[string]Retirement
+}
+
+func newRetirementTracker() *retirementTracker {
+	return &retirementTracker{byName: make(map[string]Retirement)}
+}
+
+func (t *retirementTracker) get(name string) (Retirement, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	r, ok := t.byName[name]
+	return r, ok
+}
+
+// start records a pending retirement, or returns false if one is already
+// pending for name.
+func (t *retirementTracker) start(name string, deleteAt time.Time) (Retirement, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if r, ok := t.byName[name]; ok && r.Status == retirePending {
+		return r, false
+	}
+	r := Retirement{Name: name, Status: retirePending, DeleteAt: deleteAt}
+	t.byName[name] = r
+	return r, true
+}
+
+func (t *retirementTracker) finish(name, status string, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	r := t.byName[name]
+	r.Status = status
+	if err != nil {
+		r.Error = err.Error()
+	}
+	t.byName[name] = r
+}
+
+func retirementStatusURL(name string) string {
+	return "/api/nodes/" + url.PathEscape(name) + "/retire"
+}
+
+// handleRetireNode drains a registered node and deletes it from Headscale
+// and the registry once RETIRE_GRACE_PERIOD has passed, returning 202 right
+// away. Undraining the node during the grace period cancels the deletion.
+func (s *AppState) handleRetireNode(c *gin.Context) {
+	name := c.Param("name")
+
+	if s.setDraining(name, true) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+
+	deleteAt := time.Now().UTC().Add(s.config.RetireGracePeriod)
+	retirement, ok := s.retirements.start(name, deleteAt)
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Node is already being retired", "status_url": retirementStatusURL(name)})
+		return
+	}
+
+	log.Printf("Retiring node %s, draining until %s", logName(name), deleteAt.Format(time.RFC3339))
+	s.spawn(func() { s.retireNode(s.ctx, name, s.config.RetireGracePeriod) })
+
+	c.Header("Location", retirementStatusURL(name))
+	c.JSON(http.StatusAccepted, gin.H{"retirement": retirement, "status_url": retirementStatusURL(name)})
+}
+
+func (s *AppState) handleRetirementStatus(c *gin.Context) {
+	retirement, ok := s.retirements.get(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No retirement for this node"})
+		return
+	}
+	c.JSON(http.StatusOK, retirement)
+}
+
+// retireNode waits out the grace period and deletes the node, unless it was
+// undrained in the meantime. It gives up if ctx is done first.
+func (s *AppState) retireNode(ctx context.Context, name string, grace time.Duration) {
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		log.Printf("Retirement of node %s abandoned: %v", logName(name), ctx.Err())
+		s.retirements.finish(name, retireCancelled, ctx.Err())
+		return
+	case <-timer.C:
+	}
+
+	var uuids []string
+	stillDraining := false
+	for _, node := range s.storedNodes() {
+		if node.Name != name {
+			continue
+		}
+		uuids = append(uuids, node.UUID)
+		stillDraining = stillDraining || node.Draining
+	}
+	if !stillDraining {
+		log.Printf("Retirement of node %s cancelled, it is no longer draining", logName(name))
+		s.retirements.finish(name, retireCancelled, nil)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	ids, err := headscaleNodeIDs(ctx, name)
+	if err != nil {
+		log.Printf("Failed to retire node %s: %v", logName(name), err)
+		s.retirements.finish(name, retireFailed, err)
+		return
+	}
+	for _, id := range ids {
+		if err := deleteHeadscaleNode(ctx, id); err != nil {
+			log.Printf("Failed to retire node %s (Headscale ID %s): %v", logName(name), id, err)
+			s.retirements.finish(name, retireFailed, err)
+			return
+		}
+	}
+	for _, uuid := range uuids {
+		s.deleteNode(uuid)
+	}
+
+	log.Printf("Retired node %s, deleted from Headscale and registry", logName(name))
+	s.retirements.finish(name, retireDeleted, nil)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetireNodeDeletesAfterGracePeriod(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) {
+		c.OperatorToken = testOperatorToken
+		c.RetireGracePeriod = 10 * time.Millisecond
+	})
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "mongo-2", NodeType: "mongodb"})
+
+	if w := serve(r, newOperatorRequest("POST", "/api/nodes/mongo-1/retire")); w.Code != http.StatusAccepted {
+		t.Fatalf("retire: got status %d, want 202: %s", w.Code, w.Body)
+	}
+	if node, _ := state.storedNode("i1"); !node.Draining {
+		t.Errorf("retiring node is not draining")
+	}
+	state.tasks.Wait()
+
+	if retirement, _ := state.retirements.get("mongo-1"); retirement.Status != retireDeleted {
+		t.Errorf("got retirement %+v, want status %s", retirement, retireDeleted)
+	}
+	if _, ok := state.storedNode("i1"); ok {
+		t.Errorf("retired node is still registered")
+	}
+	if names := hs.nodeNames(); len(names) != 1 || names[0] != "mongo-2" {
+		t.Errorf("Headscale has nodes %v, want only mongo-2", names)
+	}
+}
+
+func TestRetireNodeStopsOnShutdown(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) {
+		c.OperatorToken = testOperatorToken
+		c.RetireGracePeriod = time.Hour
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	state.ctx = ctx
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+
+	if w := serve(r, newOperatorRequest("POST", "/api/nodes/mongo-1/retire")); w.Code != http.StatusAccepted {
+		t.Fatalf("retire: got status %d, want 202: %s", w.Code, w.Body)
+	}
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		state.tasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retirement did not return after the context was cancelled")
+	}
+
+	retirement, _ := state.retirements.get("mongo-1")
+	if retirement.Status != retireCancelled || retirement.Error != context.Canceled.Error() {
+		t.Errorf("got retirement %+v, want it cancelled by the context", retirement)
+	}
+	if names := hs.nodeNames(); len(names) != 1 {
+		t.Errorf("Headscale has nodes %v, want mongo-1 kept", names)
+	}
+}
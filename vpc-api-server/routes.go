@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ApproveRoutesRequest struct {
+	Routes []string `json:"routes"`
+}
+
+// approveHeadscaleRoutes sets the approved subnet routes of a node. Headscale
+// replaces the node's whole approved set with routes.
+func approveHeadscaleRoutes(ctx context.Context, nodeID string, routes []string) error {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return err
+	}
+
+	jsonBody, err := json.Marshal(ApproveRoutesRequest{Routes: routes})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", headscaleInternalURL+"/api/v1/node/"+url.PathEscape(nodeID)+"/approve_routes", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHeadscaleAPIError(resp)
+	}
+
+	return nil
+}
+
+// handleApproveRoutes approves the subnet routes in the request body for a
+// node, replacing any previously approved ones; an empty list revokes them
+// all.
+func (s *AppState) handleApproveRoutes(c *gin.Context) {
+	name := c.Param("name")
+
+	var body ApproveRoutesRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body, expected {\"routes\": [\"<cidr>\", ...]}"})
+		return
+	}
+
+	routes := make([]string, 0, len(body.Routes))
+	for _, route := range body.Routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid route %q, expected a CIDR", route)})
+			return
+		}
+		routes = append(routes, prefix.Masked().String())
+	}
+
+	ids, err := headscaleNodeIDs(c.Request.Context(), name)
+	if err != nil {
+		log.Printf("Failed to list Headscale nodes: %v", err)
+		c.JSON(headscaleErrorStatus(err), gin.H{"error": "Failed to list nodes"})
+		return
+	}
+	if len(ids) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Node not found"})
+		return
+	}
+
+	for _, id := range ids {
+		if err := approveHeadscaleRoutes(c.Request.Context(), id, routes); err != nil {
+			log.Printf("Failed to approve routes %v for node %s (Headscale ID %s): %v", routes, logName(name), id, err)
+			c.JSON(headscaleErrorStatus(err), gin.H{"error": "Failed to approve routes"})
+			return
+		}
+		log.Printf("Approved routes %v for node %s (Headscale ID %s)", routes, logName(name), id)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"name": name, "approved": routes})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newRoutesRequest(name, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/api/nodes/"+name+"/routes", strings.NewReader(body))
+	req.Header.Set("x-dstack-app-id", testAppID)
+	req.Header.Set("X-Operator-Token", testOperatorToken)
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestApproveRoutes(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	hsNode := addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "gw-1", NodeType: "app"})
+	hs.updateNodes("gw-1", func(node *HeadscaleNode) { node.AvailableRoutes = []string{"10.0.0.0/24"} })
+
+	w := serve(r, newRoutesRequest("gw-1", `{"routes": ["10.0.0.7/24"]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	reqs := hs.requestsTo("POST", "/api/v1/node/"+hsNode.ID+"/approve_routes")
+	if len(reqs) != 1 {
+		t.Fatalf("approved routes %d times, want once", len(reqs))
+	}
+	var sent ApproveRoutesRequest
+	json.Unmarshal(reqs[0].Body, &sent)
+	if want := []string{"10.0.0.0/24"}; !reflect.DeepEqual(sent.Routes, want) {
+		t.Errorf("sent routes %v, want the masked %v", sent.Routes, want)
+	}
+
+	var resp NodesResponse
+	decodeJSON(t, serve(r, newRequest("GET", "/api/nodes")).Body.Bytes(), &resp)
+	if len(resp.Nodes) != 1 || resp.Nodes[0].Routes == nil || !reflect.DeepEqual(resp.Nodes[0].Routes.Approved, []string{"10.0.0.0/24"}) {
+		t.Errorf("listing does not show the approved route: %+v", resp.Nodes)
+	}
+
+	if w := serve(r, newRoutesRequest("gw-1", `{"routes": []}`)); w.Code != http.StatusOK {
+		t.Errorf("revoking routes: got status %d, want 200", w.Code)
+	}
+	if w := serve(r, newRoutesRequest("gw-1", `{"routes": ["10.0.0.0"]}`)); w.Code != http.StatusBadRequest {
+		t.Errorf("route without a prefix length: got status %d, want 400", w.Code)
+	}
+	if w := serve(r, newRoutesRequest("gw-1", `not json`)); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid body: got status %d, want 400", w.Code)
+	}
+	if w := serve(r, newRoutesRequest("missing", `{"routes": []}`)); w.Code != http.StatusNotFound {
+		t.Errorf("unknown node: got status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const selfCacheTTL = time.Minute
+
+// selfCache holds the api-server's own node, looked up in Headscale by
+// name. A lookup that finds no node is cached too, as most deployments
+// don't join the server to the tailnet.
+type selfCache struct {
+	mutex     sync.Mutex
+	name      string
+	node      *NodeInfo
+	fetchedAt time.Time
+}
+
+// selfNodeName is SELF_NODE_NAME, or the host name the node would register
+// with by default.
+func selfNodeName() string {
+	if name := os.Getenv("SELF_NODE_NAME"); name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		log.Printf("Warning: failed to get hostname: %v", err)
+		return ""
+	}
+	return name
+}
+
+// lookup returns the cached node, looking it up again once the cache is
+// older than selfCacheTTL. Headscale is queried without the mutex held.
+func (s *selfCache) lookup(ctx context.Context) (*NodeInfo, error) {
+	s.mutex.Lock()
+	if !s.fetchedAt.IsZero() && time.Since(s.fetchedAt) < selfCacheTTL {
+		node := s.node
+		s.mutex.Unlock()
+		return node, nil
+	}
+	s.mutex.Unlock()
+
+	hsNodes, err := getHeadscaleNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var self *NodeInfo
+	for _, hsNode := range hsNodes {
+		if s.name == "" || hsNode.Name != s.name {
+			continue
+		}
+		// Prefer the online entry if the server re-registered.
+		if self != nil && self.Online {
+			continue
+		}
+		node := NodeInfo{ID: "headscale:" + hsNode.ID, Name: hsNode.Name, Source: sourceHeadscale}
+		applyHeadscaleState(&node, hsNode)
+		node.Debug = nil
+		self = &node
+	}
+
+	s.mutex.Lock()
+	s.node = self
+	s.fetchedAt = time.Now()
+	s.mutex.Unlock()
+	return self, nil
+}
+
+// handleSelf returns the api-server's own node on the tailnet, so clients
+// can reach it over the overlay network.
+func (s *AppState) handleSelf(c *gin.Context) {
+	node, err := s.self.lookup(c.Request.Context())
+	if err != nil {
+		log.Printf("Failed to look up own node: %v", err)
+		c.JSON(headscaleErrorStatus(err), gin.H{"error": "Failed to list nodes"})
+		return
+	}
+	if node == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API server is not a node on the tailnet", "name": s.self.name})
+		return
+	}
+
+	c.JSON(http.StatusOK, node)
+}
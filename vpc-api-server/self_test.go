@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSelfLookupWithoutLock(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	hs.addNode(HeadscaleNode{Name: "api-server", Online: true})
+	arrived, release := hs.holdRequests(t, "/api/v1/node")
+	cache := &selfCache{name: "api-server"}
+
+	type result struct {
+		node *NodeInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		node, err := cache.lookup(context.Background())
+		done <- result{node, err}
+	}()
+	select {
+	case <-arrived:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Headscale was never queried")
+	}
+
+	if !cache.mutex.TryLock() {
+		t.Fatal("the self cache is locked while querying Headscale")
+	}
+	cache.mutex.Unlock()
+
+	release()
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("lookup: %v", res.err)
+	}
+	if res.node == nil || res.node.Name != "api-server" {
+		t.Errorf("got %+v, want the api-server node", res.node)
+	}
+}
+
+func TestSelfEndpoint(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	state.self.name = "api-server"
+
+	if w := serve(r, newRequest("GET", "/api/self")); w.Code != http.StatusNotFound {
+		t.Fatalf("not on the tailnet: got status %d, want 404: %s", w.Code, w.Body)
+	}
+
+	// The negative lookup is cached until the TTL runs out.
+	hs.addNode(HeadscaleNode{Name: "api-server", Online: false})
+	hs.addNode(HeadscaleNode{Name: "api-server", Online: true, IPAddresses: []string{"100.64.0.9"}})
+	if w := serve(r, newRequest("GET", "/api/self")); w.Code != http.StatusNotFound {
+		t.Errorf("cached lookup: got status %d, want 404", w.Code)
+	}
+
+	state.self.fetchedAt = time.Time{}
+	w := serve(r, newRequest("GET", "/api/self"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var node NodeInfo
+	decodeJSON(t, w.Body.Bytes(), &node)
+	if node.Name != "api-server" || !node.Online || node.TailscaleIP == nil || *node.TailscaleIP != "100.64.0.9" {
+		t.Errorf("got %+v, want the online api-server node at 100.64.0.9", node)
+	}
+}
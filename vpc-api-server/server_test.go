@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testAppID is the app id newRequest sends, admitted by the default
+// ALLOWED_APPS of newTestServer.
+const testAppID = "app-a"
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a state configured like main does with an empty
+// environment, adjusted by configure if set, and the router serving it.
+// Shared keys are kept in a temporary directory. Spawned tasks are cancelled
+// and waited for when the test ends.
+func newTestServer(t *testing.T, configure func(*Config)) (*AppState, *gin.Engine) {
+	t.Helper()
+
+	config := Config{
+		AllowedApps:        []string{"any"},
+		AllowedNodeTypes:   []string{"mongodb", "app"},
+		NodePollInterval:   10 * time.Second,
+		ReusableKeys:       true,
+		QuotaCountOffline:  true,
+		AuthEnforce:        true,
+		RetireGracePeriod:  5 * time.Minute,
+		PendingGracePeriod: 2 * time.Minute,
+		MaxPageSize:        1000,
+	}
+	if configure != nil {
+		configure(&config)
+	}
+
+	state := &AppState{
+		config:      config,
+		nodes:       make(map[string]NodeInfo),
+		sharedKeys:  newSharedKeyStore(t.TempDir(), config.AllowedNodeTypes, nil, false),
+		ServerUrl:   "https://headscale.example",
+		watcher:     newNodeWatcher(),
+		self:        &selfCache{},
+		retirements: newRetirementTracker(),
+		apps:        newAppSet(),
+		modified:    newModificationTracker(),
+		nonces:      newNonceStore(10 * time.Minute),
+		audit:       &auditLogger{w: io.Discard},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	state.ctx = ctx
+	t.Cleanup(func() {
+		cancel()
+		state.tasks.Wait()
+	})
+	return state, newRouter(state, newRequestMetrics())
+}
+
+// newRequest returns a request from testAppID.
+func newRequest(method, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("x-dstack-app-id", testAppID)
+	return req
+}
+
+// serve sends req through handler and returns the recorded response.
+func serve(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// decodeJSON decodes a response body into v, failing the test if it can't.
+func decodeJSON(t *testing.T, body []byte, v any) {
+	t.Helper()
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("failed to decode %q: %v", body, err)
+	}
+}
+
+// captureLog collects the standard logger's output until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return &buf
+}
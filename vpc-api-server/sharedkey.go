@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sharedKeyStore holds the shared key (the keyfile handed out at bootstrap)
+// and any node-type-specific keys that override it. With perApp set, every
+// app id gets its own keys instead, created on first use.
+type sharedKeyStore struct {
+	// mutex guards the key maps and is never held across disk I/O.
+	// writeMutex serializes key file writes, so that a key file and its
+	// in-memory copy always agree.
+	mutex      sync.RWMutex
+	writeMutex sync.Mutex
+
+	dir        string
+	defaultKey string
+	byType     map[string]string
+	perApp     bool
+	byApp      map[string]string
+}
+
+// Keyfile encodings selectable with keyfile_format. Keys are stored
+// base64-encoded, so base64 returns them unchanged.
+const (
+	keyfileBase64 = "base64"
+	keyfileHex    = "hex"
+	keyfileRaw    = "raw"
+)
+
+func validKeyfileFormat(format string) bool {
+	return format == "" || format == keyfileBase64 || format == keyfileHex || format == keyfileRaw
+}
+
+// encodeKeyfile re-encodes a stored key in format. hex and raw work on the
+// decoded bytes, so they need the key to be base64, which a key file
+// provisioned by hand may not be.
+func encodeKeyfile(key, format string) ([]byte, error) {
+	if format == "" || format == keyfileBase64 {
+		return []byte(key), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile is not base64-encoded, only keyfile_format=base64 is available")
+	}
+	if format == keyfileHex {
+		return []byte(hex.EncodeToString(decoded)), nil
+	}
+	return decoded, nil
+}
+
+// App ids become part of a file name, so only allow the characters dstack
+// app ids are made of.
+var validAppID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func (k *sharedKeyStore) path(nodeType string) string {
+	if nodeType == "" {
+		return filepath.Join(k.dir, "shared_key")
+	}
+	return filepath.Join(k.dir, "shared_key."+nodeType)
+}
+
+// newSharedKeyStore loads the default key and a key for every node type that
+// is listed in separateTypes or already has a key file in dir, generating
+// any that are missing. Key files may be provisioned ahead of time.
+func newSharedKeyStore(dir string, nodeTypes, separateTypes []string, perApp bool) *sharedKeyStore {
+	k := &sharedKeyStore{
+		dir:    dir,
+		byType: make(map[string]string),
+		perApp: perApp,
+		byApp:  make(map[string]string),
+	}
+	k.defaultKey = getOrCreateSharedKey(k.path(""))
+
+	separate := make(map[string]bool, len(separateTypes))
+	for _, nodeType := range separateTypes {
+		separate[nodeType] = true
+	}
+
+	for _, nodeType := range nodeTypes {
+		_, err := os.Stat(k.path(nodeType))
+		if separate[nodeType] || err == nil {
+			k.byType[nodeType] = getOrCreateSharedKey(k.path(nodeType))
+		}
+		delete(separate, nodeType)
+	}
+	for nodeType := range separate {
+		log.Printf("Warning: ignoring separate shared key for unknown node type %s", nodeType)
+	}
+
+	return k
+}
+
+// forNodeType returns the key for nodeType, falling back to the default key
+// for types without their own.
+func (k *sharedKeyStore) forNodeType(nodeType string) string {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	if key, ok := k.byType[nodeType]; ok {
+		return key
+	}
+	return k.defaultKey
+}
+
+// appKeyName returns the byApp entry for an app and node type. Node types
+// with their own key get one per app as well. The caller holds the mutex.
+func (k *sharedKeyStore) appKeyName(appID, nodeType string) string {
+	if _, ok := k.byType[nodeType]; ok {
+		return appID + "." + nodeType
+	}
+	return appID
+}
+
+func (k *sharedKeyStore) appPath(name string) string {
+	return filepath.Join(k.dir, "shared_key.app."+name)
+}
+
+// forNode returns the key a node of the given app and type should use. Without
+// per-app keys this is the same as forNodeType.
+func (k *sharedKeyStore) forNode(appID, nodeType string) (string, error) {
+	if !k.perApp {
+		return k.forNodeType(nodeType), nil
+	}
+	if !validAppID.MatchString(appID) {
+		return "", fmt.Errorf("invalid app id %q", appID)
+	}
+
+	k.mutex.RLock()
+	name := k.appKeyName(appID, nodeType)
+	key, ok := k.byApp[name]
+	k.mutex.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	// First use by this app. Check again under writeMutex in case a
+	// concurrent bootstrap created the key in the meantime.
+	k.writeMutex.Lock()
+	defer k.writeMutex.Unlock()
+
+	k.mutex.RLock()
+	key, ok = k.byApp[name]
+	k.mutex.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	key = getOrCreateSharedKey(k.appPath(name))
+	k.mutex.Lock()
+	k.byApp[name] = key
+	k.mutex.Unlock()
+	return key, nil
+}
+
+// rotate replaces the key for nodeType (or the default key when empty) and
+// persists it. A node type without its own key gets one.
+func (k *sharedKeyStore) rotate(nodeType string) error {
+	k.writeMutex.Lock()
+	defer k.writeMutex.Unlock()
+
+	key := newSharedKey()
+	if err := os.WriteFile(k.path(nodeType), []byte(key), 0600); err != nil {
+		return fmt.Errorf("failed to save shared key: %w", err)
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if nodeType == "" {
+		k.defaultKey = key
+	} else {
+		k.byType[nodeType] = key
+	}
+	return nil
+}
+
+// rotateApp replaces the key of a single app for nodeType.
+func (k *sharedKeyStore) rotateApp(appID, nodeType string) error {
+	if !validAppID.MatchString(appID) {
+		return fmt.Errorf("invalid app id %q", appID)
+	}
+
+	k.writeMutex.Lock()
+	defer k.writeMutex.Unlock()
+
+	k.mutex.RLock()
+	name := k.appKeyName(appID, nodeType)
+	k.mutex.RUnlock()
+
+	key := newSharedKey()
+	if err := os.WriteFile(k.appPath(name), []byte(key), 0600); err != nil {
+		return fmt.Errorf("failed to save shared key: %w", err)
+	}
+
+	k.mutex.Lock()
+	k.byApp[name] = key
+	k.mutex.Unlock()
+	return nil
+}
+
+// handleRotateSharedKey rotates the keyfile of a single node type, or the
+// default keyfile when node_type is omitted. With per-app keys, app_id is
+// required and only that app's keyfile is rotated. Nodes pick up the new key
+// on their next bootstrap.
+func (s *AppState) handleRotateSharedKey(c *gin.Context) {
+	nodeType := s.canonicalNodeType(c.Query("node_type"))
+	if nodeType != "" && !s.isNodeTypeAllowed(nodeType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid node_type, must be one of %v", s.config.AllowedNodeTypes)})
+		return
+	}
+
+	appID := c.Query("app_id")
+	if s.sharedKeys.perApp {
+		if !validAppID.MatchString(appID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid app_id"})
+			return
+		}
+		if err := s.sharedKeys.rotateApp(appID, nodeType); err != nil {
+			log.Printf("Failed to rotate shared key for app %s, node type %q: %v", appID, nodeType, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate keyfile"})
+			return
+		}
+		log.Printf("Rotated shared key for app %s, node type %q", appID, nodeType)
+		c.JSON(http.StatusOK, gin.H{"app_id": appID, "node_type": nodeType, "rotated": true})
+		return
+	}
+	if appID != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "app_id requires SHARED_KEY_PER_APP"})
+		return
+	}
+
+	if err := s.sharedKeys.rotate(nodeType); err != nil {
+		log.Printf("Failed to rotate shared key for node type %q: %v", nodeType, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate keyfile"})
+		return
+	}
+
+	log.Printf("Rotated shared key for node type %q", nodeType)
+	c.JSON(http.StatusOK, gin.H{"node_type": nodeType, "rotated": true})
+}
+
+// handleGetSharedKey returns the current keyfile for a node type without
+// registering a node, so a node that lost its local copy can re-fetch it
+// without a new pre-auth key being issued.
+func (s *AppState) handleGetSharedKey(c *gin.Context) {
+	nodeType := s.canonicalNodeType(c.Query("node_type"))
+	if nodeType == "" {
+		nodeType = s.config.DefaultNodeType
+	}
+	if nodeType != "" && !s.isNodeTypeAllowed(nodeType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid node_type, must be one of %v", s.config.AllowedNodeTypes)})
+		return
+	}
+
+	format := c.Query("keyfile_format")
+	if !validKeyfileFormat(format) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid keyfile_format, must be one of base64, hex, raw"})
+		return
+	}
+
+	appID := c.GetHeader("x-dstack-app-id")
+	sharedKey, err := s.sharedKeys.forNode(appID, nodeType)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid app id for keyfile"})
+		return
+	}
+	encoded, err := encodeKeyfile(sharedKey, format)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("Keyfile retrieved by app %s for node type %q from %s", appID, nodeType, c.ClientIP())
+	s.audit.record(AuditEntry{
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Event:      auditEventKeyfile,
+		AppID:      appID,
+		InstanceID: c.Query("instance_id"),
+		NodeType:   nodeType,
+		Outcome:    auditSuccess,
+		Status:     http.StatusOK,
+		ClientIP:   c.ClientIP(),
+	})
+
+	// Raw bytes can't go in a JSON string, so they are the whole body.
+	if format == keyfileRaw {
+		c.Data(http.StatusOK, "application/octet-stream", encoded)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"shared_key": string(encoded)})
+}
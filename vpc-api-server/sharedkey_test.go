@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bootstrapSharedKey bootstraps an instance as appID and returns the shared
+// key in the response.
+func bootstrapSharedKey(t *testing.T, r http.Handler, appID, query string) string {
+	t.Helper()
+	req := newRequest("GET", "/api/register?"+query)
+	req.Header.Set("x-dstack-app-id", appID)
+	w := serve(r, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("bootstrap as %s: got status %d: %s", appID, w.Code, w.Body)
+	}
+	var resp BootstrapResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	return resp.SharedKey
+}
+
+func TestPerAppSharedKeys(t *testing.T) {
+	newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.OperatorToken = testOperatorToken })
+	state.sharedKeys = newSharedKeyStore(t.TempDir(), state.config.AllowedNodeTypes, nil, true)
+
+	keyA := bootstrapSharedKey(t, r, "app-a", "instance_id=i1")
+	keyB := bootstrapSharedKey(t, r, "app-b", "instance_id=i2")
+	if keyA == "" || keyA == keyB {
+		t.Fatalf("apps got keys %q and %q, want distinct keys", keyA, keyB)
+	}
+	if again := bootstrapSharedKey(t, r, "app-a", "instance_id=i3"); again != keyA {
+		t.Errorf("app-a got a different key on its second bootstrap")
+	}
+
+	if w := serve(r, newOperatorRequest("POST", "/api/keyfile/rotate")); w.Code != http.StatusBadRequest {
+		t.Errorf("rotating without app_id: got status %d, want 400", w.Code)
+	}
+	if w := serve(r, newOperatorRequest("POST", "/api/keyfile/rotate?app_id=app-a")); w.Code != http.StatusOK {
+		t.Fatalf("rotating app-a: got status %d: %s", w.Code, w.Body)
+	}
+	if rotated := bootstrapSharedKey(t, r, "app-a", "instance_id=i4"); rotated == keyA {
+		t.Errorf("app-a kept its key after rotation")
+	}
+	if same := bootstrapSharedKey(t, r, "app-b", "instance_id=i5"); same != keyB {
+		t.Errorf("rotating app-a changed app-b's key")
+	}
+}
+
+func TestSharedKeyWithoutPerApp(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	keyA := bootstrapSharedKey(t, r, "app-a", "instance_id=i1")
+	keyB := bootstrapSharedKey(t, r, "app-b", "instance_id=i2")
+	if keyA != keyB {
+		t.Errorf("without SHARED_KEY_PER_APP apps got different keys")
+	}
+}
+
+func TestPerAppKeyConcurrentFirstUse(t *testing.T) {
+	dir := t.TempDir()
+	keys := newSharedKeyStore(dir, []string{"mongodb"}, nil, true)
+
+	const callers = 10
+	got := make([]string, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key, err := keys.forNode("app-a", "mongodb")
+			if err != nil {
+				t.Errorf("forNode: %v", err)
+			}
+			got[i] = key
+		}(i)
+	}
+	wg.Wait()
+
+	stored, err := os.ReadFile(keys.appPath("app-a"))
+	if err != nil {
+		t.Fatalf("reading the app key file: %v", err)
+	}
+	for i, key := range got {
+		if key == "" || key != string(stored) {
+			t.Errorf("caller %d got key %q, want the stored key %q", i, key, stored)
+		}
+	}
+}
+
+func TestKeyfileFormats(t *testing.T) {
+	newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+
+	getKeyfile := func(format string) *httptest.ResponseRecorder {
+		return serve(r, newRequest("GET", "/api/keyfile?node_type=mongodb&keyfile_format="+format))
+	}
+	keyfile := func(format string) string {
+		t.Helper()
+		w := getKeyfile(format)
+		if w.Code != http.StatusOK {
+			t.Fatalf("keyfile_format=%s: got status %d, want 200: %s", format, w.Code, w.Body)
+		}
+		var resp struct {
+			SharedKey string `json:"shared_key"`
+		}
+		decodeJSON(t, w.Body.Bytes(), &resp)
+		return resp.SharedKey
+	}
+
+	stored := keyfile("")
+	decoded, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		t.Fatalf("stored key is not base64: %v", err)
+	}
+	if got := keyfile("base64"); got != stored {
+		t.Errorf("base64: got %q, want the stored key %q", got, stored)
+	}
+	if got := keyfile("hex"); got != hex.EncodeToString(decoded) {
+		t.Errorf("hex: got %q, want %q", got, hex.EncodeToString(decoded))
+	}
+	w := getKeyfile("raw")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/octet-stream" || !bytes.Equal(w.Body.Bytes(), decoded) {
+		t.Errorf("raw: got status %d, content type %q, %d bytes; want the %d decoded bytes", w.Code, w.Header().Get("Content-Type"), w.Body.Len(), len(decoded))
+	}
+	if w := getKeyfile("pem"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: got status %d, want 400", w.Code)
+	}
+
+	if got := bootstrapSharedKey(t, r, testAppID, "instance_id=i1&node_type=mongodb&keyfile_format=hex"); got != hex.EncodeToString(decoded) {
+		t.Errorf("bootstrap with hex: got %q, want %q", got, hex.EncodeToString(decoded))
+	}
+	if got := bootstrapSharedKey(t, r, testAppID, "instance_id=i2&node_type=mongodb&keyfile_format=base64"); got != stored {
+		t.Errorf("bootstrap with base64: got %q, want the stored key %q", got, stored)
+	}
+
+	// A raw keyfile is the whole body, with the rest of the response in
+	// headers.
+	w = serve(r, newRequest("GET", "/api/register?instance_id=i3&node_type=mongodb&keyfile_format=raw"))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/octet-stream" || !bytes.Equal(w.Body.Bytes(), decoded) {
+		t.Errorf("bootstrap with raw: got status %d, content type %q, %d bytes; want the %d decoded bytes", w.Code, w.Header().Get("Content-Type"), w.Body.Len(), len(decoded))
+	}
+	if !strings.HasPrefix(w.Header().Get("X-Pre-Auth-Key"), "hskey-") || w.Header().Get("X-Server-Url") != state.ServerUrl || w.Header().Get("X-Key-Expires-At") == "" {
+		t.Errorf("bootstrap with raw: got headers %v, want the pre-auth key, server URL and key expiry", w.Header())
+	}
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i4&node_type=mongodb&keyfile_format=raw&wait=active")); w.Code != http.StatusBadRequest {
+		t.Errorf("bootstrap with raw and wait=active: got status %d, want 400", w.Code)
+	}
+
+	// A key provisioned by hand need not be base64; it can only be served
+	// as stored.
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "shared_key"), []byte("not base64!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state.sharedKeys = newSharedKeyStore(dir, state.config.AllowedNodeTypes, nil, false)
+	if got := keyfile(""); got != "not base64!" {
+		t.Errorf("hand-provisioned key: got %q, want it as stored", got)
+	}
+	if w := getKeyfile("hex"); w.Code != http.StatusBadRequest {
+		t.Errorf("hand-provisioned key as hex: got status %d, want 400", w.Code)
+	}
+}
+
+func TestSharedKeysPerNodeType(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "shared_key.app"), []byte("app-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys := newSharedKeyStore(dir, []string{"mongodb", "app", "redis"}, []string{"mongodb", "unknown"}, false)
+
+	defaultKey := keys.forNodeType("")
+	mongoKey := keys.forNodeType("mongodb")
+	if mongoKey == "" || mongoKey == defaultKey {
+		t.Errorf("mongodb got key %q, want its own", mongoKey)
+	}
+	if got := keys.forNodeType("app"); got != "app-key" {
+		t.Errorf("app got key %q, want the provisioned app-key", got)
+	}
+	if got := keys.forNodeType("redis"); got != defaultKey {
+		t.Errorf("redis got key %q, want the default key", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "shared_key.unknown")); err == nil {
+		t.Errorf("a key file was created for an unknown node type")
+	}
+
+	if err := keys.rotate("redis"); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	redisKey := keys.forNodeType("redis")
+	if redisKey == defaultKey || keys.forNodeType("") != defaultKey || keys.forNodeType("mongodb") != mongoKey {
+		t.Errorf("rotating redis should give it its own key and leave the others alone")
+	}
+	if stored, _ := os.ReadFile(filepath.Join(dir, "shared_key.redis")); string(stored) != redisKey {
+		t.Errorf("stored redis key %q, want %q", stored, redisKey)
+	}
+	if reloaded := newSharedKeyStore(dir, []string{"mongodb", "app", "redis"}, nil, false); reloaded.forNodeType("mongodb") != mongoKey || reloaded.forNodeType("redis") != redisKey {
+		t.Errorf("keys changed after reloading from disk")
+	}
+}
+
+func TestGetKeyfileHasNoSideEffects(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.DefaultNodeType = "mongodb" })
+	state.sharedKeys = newSharedKeyStore(t.TempDir(), state.config.AllowedNodeTypes, []string{"mongodb"}, false)
+
+	w := serve(r, newRequest("GET", "/api/keyfile?instance_id=i1"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		SharedKey string `json:"shared_key"`
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if want := state.sharedKeys.forNodeType("mongodb"); resp.SharedKey != want {
+		t.Errorf("got key %q, want the DEFAULT_NODE_TYPE key %q", resp.SharedKey, want)
+	}
+	if keys := hs.preAuthKeys(); len(keys) != 0 {
+		t.Errorf("fetching the keyfile issued %d pre-auth keys", len(keys))
+	}
+	if _, ok := state.storedNode("i1"); ok {
+		t.Errorf("fetching the keyfile registered the node")
+	}
+
+	if w := serve(r, newRequest("GET", "/api/keyfile?node_type=redis")); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown node type: got status %d, want 400", w.Code)
+	}
+}
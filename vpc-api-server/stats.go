@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type StatsResponse struct {
+	ByNodeType map[string]int `json:"by_node_type"`
+	Total      int            `json:"total"`
+	Online     int            `json:"online"`
+	Offline    int            `json:"offline"`
+	NoIP       int            `json:"no_ip"`
+	LastSync   *time.Time     `json:"last_sync"`
+
+	// DistinctApps counts the app ids that bootstrapped a node since the
+	// server started; Apps lists them with include_apps=true.
+	DistinctApps int      `json:"distinct_apps"`
+	Apps         []string `json:"apps,omitempty"`
+}
+
+// appSet records the app ids seen at bootstrap.
+type appSet struct {
+	mutex sync.Mutex
+	ids   map[string]struct{}
+}
+
+func newAppSet() *appSet {
+	return &appSet{ids: make(map[string]struct{})}
+}
+
+func (a *appSet) add(appID string) {
+	if appID == "" {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.ids[appID] = struct{}{}
+}
+
+// list returns the recorded app ids, sorted.
+func (a *appSet) list() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	ids := make([]string, 0, len(a.ids))
+	for id := range a.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// handleStats summarizes the registered nodes as of the last background poll
+// instead of querying Headscale, so it stays cheap to call from dashboards.
+func (s *AppState) handleStats(c *gin.Context) {
+	nodes, lastSync := s.watcher.snapshot()
+
+	stats := StatsResponse{ByNodeType: make(map[string]int)}
+	for _, node := range nodes {
+		stats.ByNodeType[node.NodeType]++
+		stats.Total++
+		if node.Online {
+			stats.Online++
+		} else {
+			stats.Offline++
+		}
+		if node.TailscaleIP == nil {
+			stats.NoIP++
+		}
+	}
+	if !lastSync.IsZero() {
+		stats.LastSync = &lastSync
+	}
+
+	apps := s.apps.list()
+	stats.DistinctApps = len(apps)
+	if c.Query("include_apps") == "true" {
+		stats.Apps = apps
+	}
+
+	respondNegotiated(c, http.StatusOK, stats)
+}
+
+type NodeTypeHealthResponse struct {
+	NodeType  string     `json:"node_type"`
+	Online    int        `json:"online"`
+	MinOnline int        `json:"min_online"`
+	Healthy   bool       `json:"healthy"`
+	LastSync  *time.Time `json:"last_sync"`
+}
+
+// handleNodeTypeHealth reports 200 if at least min_online (default 1) nodes
+// of a type are online and 503 otherwise, for quorum probes and alerting.
+// Like /api/stats it uses the last background poll, so it is cheap to call
+// often; before the first poll nothing counts as online.
+func (s *AppState) handleNodeTypeHealth(c *gin.Context) {
+	nodeType := s.canonicalNodeType(c.Param("type"))
+	if !s.isNodeTypeAllowed(nodeType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid node_type, must be one of %v", s.config.AllowedNodeTypes)})
+		return
+	}
+
+	minOnline := 1
+	if v := c.Query("min_online"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid min_online, expected a positive integer"})
+			return
+		}
+		minOnline = n
+	}
+
+	nodes, lastSync := s.watcher.snapshot()
+	health := NodeTypeHealthResponse{NodeType: nodeType, MinOnline: minOnline}
+	for _, node := range nodes {
+		if node.NodeType == nodeType && node.Online {
+			health.Online++
+		}
+	}
+	if !lastSync.IsZero() {
+		health.LastSync = &lastSync
+	}
+	health.Healthy = health.Online >= minOnline
+
+	status := http.StatusOK
+	if !health.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, health)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// syncWatcher feeds the merged node list to the watcher, as a background
+// poll would.
+func syncWatcher(t *testing.T, state *AppState) {
+	t.Helper()
+	nodes, err := state.mergedNodes(context.Background(), false)
+	if err != nil {
+		t.Fatalf("merging nodes: %v", err)
+	}
+	state.watcher.update(nodes)
+}
+
+func TestStatsSummary(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+
+	var resp StatsResponse
+	w := serve(r, newRequest("GET", "/api/stats"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp.Total != 0 || resp.LastSync != nil {
+		t.Errorf("before the first poll: got %+v, want no nodes and no last_sync", resp)
+	}
+
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "mongo-2", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i3", Name: "app-1", NodeType: "app"})
+	addTestNode(state, nil, NodeInfo{UUID: "i4", Name: "app-2", NodeType: "app"})
+	hs.updateNodes("mongo-2", func(node *HeadscaleNode) { node.Online = false })
+	syncWatcher(t, state)
+
+	resp = StatsResponse{}
+	w = serve(r, newRequest("GET", "/api/stats"))
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if want := map[string]int{"mongodb": 2, "app": 2}; !reflect.DeepEqual(resp.ByNodeType, want) {
+		t.Errorf("by_node_type: got %v, want %v", resp.ByNodeType, want)
+	}
+	if resp.Total != 4 || resp.Online != 2 || resp.Offline != 2 || resp.NoIP != 1 {
+		t.Errorf("got total %d, online %d, offline %d, no_ip %d; want 4, 2, 2, 1", resp.Total, resp.Online, resp.Offline, resp.NoIP)
+	}
+	if resp.LastSync == nil {
+		t.Errorf("last_sync missing after a poll")
+	}
+}
+
+func TestStatsDistinctApps(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	bootstrapNode(t, r, "app-b", "instance_id=i1&node_name=n1")
+	bootstrapNode(t, r, "app-a", "instance_id=i2&node_name=n2")
+	bootstrapNode(t, r, "app-b", "instance_id=i3&node_name=n3")
+
+	var resp StatsResponse
+	decodeJSON(t, serve(r, newRequest("GET", "/api/stats")).Body.Bytes(), &resp)
+	if resp.DistinctApps != 2 || resp.Apps != nil {
+		t.Errorf("got distinct_apps %d and apps %v, want 2 and no list", resp.DistinctApps, resp.Apps)
+	}
+
+	resp = StatsResponse{}
+	decodeJSON(t, serve(r, newRequest("GET", "/api/stats?include_apps=true")).Body.Bytes(), &resp)
+	if want := []string{"app-a", "app-b"}; !reflect.DeepEqual(resp.Apps, want) {
+		t.Errorf("include_apps: got %v, want %v", resp.Apps, want)
+	}
+}
+
+func TestNodeTypeHealth(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i2", Name: "mongo-2", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i3", Name: "mongo-3", NodeType: "mongodb"})
+	addTestNode(state, hs, NodeInfo{UUID: "i4", Name: "app-1", NodeType: "app"})
+	hs.updateNodes("mongo-3", func(n *HeadscaleNode) { n.Online = false })
+
+	health := func(query string, wantStatus int) NodeTypeHealthResponse {
+		t.Helper()
+		w := serve(r, newRequest("GET", "/api/health/node-type/"+query))
+		if w.Code != wantStatus {
+			t.Fatalf("%s: got status %d, want %d: %s", query, w.Code, wantStatus, w.Body)
+		}
+		var resp NodeTypeHealthResponse
+		decodeJSON(t, w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	if resp := health("mongodb", http.StatusServiceUnavailable); resp.Online != 0 || resp.LastSync != nil {
+		t.Errorf("before the first poll: got %+v, want nothing online", resp)
+	}
+
+	syncWatcher(t, state)
+	if resp := health("mongodb", http.StatusOK); resp.Online != 2 || resp.MinOnline != 1 || !resp.Healthy || resp.LastSync == nil {
+		t.Errorf("got %+v, want 2 of at least 1 online", resp)
+	}
+	if resp := health("mongodb?min_online=2", http.StatusOK); !resp.Healthy {
+		t.Errorf("min_online=2: got %+v, want healthy", resp)
+	}
+	if resp := health("mongodb?min_online=3", http.StatusServiceUnavailable); resp.Healthy || resp.MinOnline != 3 {
+		t.Errorf("min_online=3: got %+v, want unhealthy", resp)
+	}
+	if resp := health("app", http.StatusOK); resp.Online != 1 {
+		t.Errorf("app: got %+v, want 1 online", resp)
+	}
+
+	health("redis", http.StatusBadRequest)
+	health("mongodb?min_online=0", http.StatusBadRequest)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket keeps each datagram under a typical path MTU.
+const statsdMaxPacket = 1400
+
+// statsdEmitter pushes the request counters to a StatsD server, for
+// monitoring that doesn't scrape /metrics. Every interval it sends how much
+// each counter grew since the last flush.
+type statsdEmitter struct {
+	conn    net.Conn
+	prefix  string
+	metrics *requestMetrics
+	sent    map[requestKey]uint64
+}
+
+func newStatsdEmitter(addr, prefix string, metrics *requestMetrics) (*statsdEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up StatsD client for %s: %w", addr, err)
+	}
+	return &statsdEmitter{
+		conn:    conn,
+		prefix:  prefix,
+		metrics: metrics,
+		sent:    make(map[requestKey]uint64),
+	}, nil
+}
+
+// statsdName turns a request key into a dotted StatsD bucket, e.g.
+// "vpc_api.http_requests.api.nodes.name.drain.post.2xx".
+func (e *statsdEmitter) statsdName(key requestKey) string {
+	route := strings.NewReplacer(":", "", "*", "", ".", "_").Replace(strings.Trim(key.Route, "/"))
+	route = strings.ReplaceAll(route, "/", ".")
+	if route == "" {
+		route = "root"
+	}
+	return fmt.Sprintf("%s.http_requests.%s.%s.%s", e.prefix, route, strings.ToLower(key.Method), key.StatusClass)
+}
+
+// flush sends the counter increments since the last flush, batching lines
+// into as few datagrams as fit. StatsD is fire-and-forget; a failed write
+// only logs.
+func (e *statsdEmitter) flush() {
+	var packet bytes.Buffer
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := e.conn.Write(packet.Bytes()); err != nil {
+			log.Printf("Failed to send StatsD metrics: %v", err)
+		}
+		packet.Reset()
+	}
+
+	for key, count := range e.metrics.snapshot() {
+		delta := count - e.sent[key]
+		if delta == 0 {
+			continue
+		}
+		e.sent[key] = count
+
+		line := fmt.Sprintf("%s:%d|c", e.statsdName(key), delta)
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	send()
+}
+
+// run flushes every interval until ctx is cancelled.
+func (e *statsdEmitter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.flush()
+		}
+	}
+}
+
+// close sends what is left and closes the socket. It must only be called
+// once run has returned, so that requests served while the server drained
+// are still counted.
+func (e *statsdEmitter) close() {
+	e.flush()
+	e.conn.Close()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readStatsd returns the lines of the next datagram sent to conn.
+func readStatsd(t *testing.T, conn net.PacketConn) []string {
+	t.Helper()
+	buf := make([]byte, 2*statsdMaxPacket)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("reading StatsD packet: %v", err)
+	}
+	if n > statsdMaxPacket {
+		t.Errorf("got a %d byte packet, want at most %d", n, statsdMaxPacket)
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func TestStatsdSendsCounterDeltas(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	metrics := newRequestMetrics()
+	emitter, err := newStatsdEmitter(conn.LocalAddr().String(), "vpc", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emitter.conn.Close()
+
+	drain := requestKey{Route: "/api/nodes/:name/drain", Method: "POST", StatusClass: "2xx"}
+	root := requestKey{Route: "/", Method: "GET", StatusClass: "4xx"}
+	metrics.counts[drain] = 3
+	metrics.counts[root] = 1
+	emitter.flush()
+	want := []string{"vpc.http_requests.api.nodes.name.drain.post.2xx:3|c", "vpc.http_requests.root.get.4xx:1|c"}
+	if got := readStatsd(t, conn); !reflect.DeepEqual(got, want) {
+		t.Errorf("first flush: got %q, want %q", got, want)
+	}
+
+	metrics.counts[drain] = 5
+	emitter.flush()
+	want = []string{"vpc.http_requests.api.nodes.name.drain.post.2xx:2|c"}
+	if got := readStatsd(t, conn); !reflect.DeepEqual(got, want) {
+		t.Errorf("second flush: got %q, want %q", got, want)
+	}
+}
+
+func TestStatsdSplitsLargeFlushes(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	metrics := newRequestMetrics()
+	emitter, err := newStatsdEmitter(conn.LocalAddr().String(), "vpc", metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emitter.conn.Close()
+
+	const routes = 100
+	for i := 0; i < routes; i++ {
+		metrics.counts[requestKey{Route: fmt.Sprintf("/api/route-%03d", i), Method: "GET", StatusClass: "2xx"}] = 1
+	}
+	emitter.flush()
+
+	lines := 0
+	packets := 0
+	for lines < routes {
+		lines += len(readStatsd(t, conn))
+		packets++
+	}
+	if packets < 2 {
+		t.Errorf("%d counters were sent in %d packet, want them split", routes, packets)
+	}
+}
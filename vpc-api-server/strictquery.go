@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeQueryParams lists the query parameters each route reads, keyed by
+// method and route path, for STRICT_QUERY. Routes not listed take none.
+// Keep this in sync when a handler starts reading a new parameter.
+var routeQueryParams = map[string][]string{
+	"GET /api/register":            {"instance_id", "node_type", "node_name", "node_key", "tags", "priority", "client_ref", "wait", "timeout", "include_gateway", "nonce", "keyfile_format"},
+	"POST /api/bootstrap/validate": {"instance_id", "node_type", "node_name", "client_ref", "nonce"},
+	"GET /api/nodes": {
+		"node_type", "include_unmanaged", "include_debug", "only_verified", "reachable", "missing_tag", "sort", "draining",
+		"created_before", "created_after", "last_seen_before", "modified_since", "format", "grouped", "route", "subnet", "limit", "offset",
+	},
+	"DELETE /api/nodes":        {"node_type", "confirm"},
+	"POST /api/nodes/rekey":    {"node_type"},
+	"GET /api/nodes/ips":       {"node_type", "port"},
+	"GET /api/nodes/watch":     {"timeout"},
+	"GET /api/stats":           {"include_apps"},
+	"GET /api/preauthkeys":     {"label"},
+	"GET /api/keyfile":         {"instance_id", "node_type", "keyfile_format"},
+	"POST /api/keyfile/rotate": {"app_id", "node_type"},
+
+	"GET /api/health/node-type/:type": {"min_online"},
+}
+
+// globalQueryParams are read by middleware and accepted on every route.
+var globalQueryParams = []string{"pretty"}
+
+// strictQuery rejects requests carrying query parameters their route doesn't
+// read, so a typo such as node_typ=mongodb fails loudly instead of being
+// ignored. It does nothing unless enabled; unmatched routes are left to 404.
+func strictQuery(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if !enabled || route == "" {
+			c.Next()
+			return
+		}
+
+		allowed := make(map[string]bool)
+		for _, param := range globalQueryParams {
+			allowed[param] = true
+		}
+		for _, param := range routeQueryParams[c.Request.Method+" "+route] {
+			allowed[param] = true
+		}
+
+		var unknown []string
+		for param := range c.Request.URL.Query() {
+			if !allowed[param] {
+				unknown = append(unknown, param)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Unknown query parameters", "unknown": unknown})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestStrictQueryRejectsUnknownParams(t *testing.T) {
+	t.Setenv("STRICT_QUERY", "true")
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	for _, target := range []string{"/api/nodes?node_type=mongodb", "/api/nodes?pretty=true", "/api/config"} {
+		if w := serve(r, newRequest("GET", target)); w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want 200: %s", target, w.Code, w.Body)
+		}
+	}
+
+	w := serve(r, newRequest("GET", "/api/nodes?node_typ=mongodb&verbose=1&limit=1"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want 400", w.Code)
+	}
+	var resp struct {
+		Unknown []string `json:"unknown"`
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if want := []string{"node_typ", "verbose"}; !reflect.DeepEqual(resp.Unknown, want) {
+		t.Errorf("got unknown %v, want %v", resp.Unknown, want)
+	}
+
+	if w := serve(r, newRequest("GET", "/api/config?node_type=mongodb")); w.Code != http.StatusBadRequest {
+		t.Errorf("route without parameters: got status %d, want 400", w.Code)
+	}
+}
+
+func TestStrictQueryOffByDefault(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	if w := serve(r, newRequest("GET", "/api/nodes?node_typ=mongodb")); w.Code != http.StatusOK {
+		t.Errorf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestRouteQueryParamsNameRealRoutes(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	routes := map[string]bool{}
+	for _, route := range r.Routes() {
+		routes[route.Method+" "+route.Path] = true
+	}
+	for route := range routeQueryParams {
+		if !routes[route] {
+			t.Errorf("routeQueryParams lists %q, which is not a route", route)
+		}
+	}
+}
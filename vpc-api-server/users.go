@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// headscaleUserDefaults are extra fields sent when creating a Headscale
+// user, from HEADSCALE_USER_DEFAULTS. "{name}" in a value is replaced by the
+// user's name.
+var headscaleUserDefaults map[string]string
+
+// userDefaultFields are the CreateUser fields besides name that Headscale
+// accepts.
+var userDefaultFields = map[string]bool{"displayName": true, "email": true, "pictureUrl": true}
+
+// parseUserDefaults parses HEADSCALE_USER_DEFAULTS, e.g.
+// "displayName=VPC {name},email={name}@vpc.example".
+func parseUserDefaults(list string) (map[string]string, error) {
+	entries, err := parseKeyValueList(list)
+	if err != nil {
+		return nil, err
+	}
+	for field := range entries {
+		if !userDefaultFields[field] {
+			return nil, fmt.Errorf("unknown user field %q, must be one of displayName, email, pictureUrl", field)
+		}
+	}
+	return entries, nil
+}
+
+// maxUserNameLength keeps derived user names within a DNS label, which is
+// what Headscale's MagicDNS uses them for.
+const maxUserNameLength = 63
+
+// headscaleUserName derives the "<app-id>-<node-type>" user that scopes a
+// node's pre-auth keys. App ids are hex and may start with a digit, which
+// Headscale rejects, so those get an "app-" prefix.
+func headscaleUserName(appID, nodeType string) (string, error) {
+	name := sanitizeNodeName(appID)
+	if nodeType != "" {
+		name += "-" + sanitizeNodeName(nodeType)
+	}
+	if name != "" && (name[0] < 'a' || name[0] > 'z') {
+		name = "app-" + name
+	}
+
+	if err := validateUserName(name); err != nil {
+		return "", fmt.Errorf("derived Headscale user name %q for app %q is invalid: %w", name, appID, err)
+	}
+	return name, nil
+}
+
+// validateUserName checks name against Headscale's user name rules: at
+// least two characters, starting with a letter, made of letters, digits,
+// '-', '.' and '_'.
+func validateUserName(name string) error {
+	if len(name) < 2 {
+		return fmt.Errorf("must be at least 2 characters long")
+	}
+	if len(name) > maxUserNameLength {
+		return fmt.Errorf("must be at most %d characters long", maxUserNameLength)
+	}
+	if name[0] < 'a' || name[0] > 'z' {
+		return fmt.Errorf("must start with a letter")
+	}
+	if i := strings.IndexFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '-' && r != '.' && r != '_'
+	}); i >= 0 {
+		return fmt.Errorf("invalid character %q", name[i])
+	}
+	return nil
+}
+
+func createUser(ctx context.Context, name string) (string, error) {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	body := map[string]string{"name": name}
+	for field, value := range headscaleUserDefaults {
+		body[field] = strings.ReplaceAll(value, "{name}", name)
+	}
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", headscaleInternalURL+"/api/v1/user", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newHeadscaleAPIError(resp)
+	}
+
+	var userResp struct {
+		User User `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&userResp); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return userResp.User.ID, nil
+}
+
+// getOrCreateUserID looks up a Headscale user, creating it on first use.
+// Users it creates are recorded in createdUsers.
+func getOrCreateUserID(ctx context.Context, name string) (string, error) {
+	id, err := getUserID(ctx, name)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, errUserNotFound) {
+		return "", err
+	}
+
+	id, err = createUser(ctx, name)
+	if err != nil {
+		// A concurrent bootstrap may have created it first.
+		if id, lookupErr := getUserID(ctx, name); lookupErr == nil {
+			return id, nil
+		}
+		return "", fmt.Errorf("failed to create user %s: %w", name, err)
+	}
+
+	createdUsers.add(name)
+	log.Printf("Created Headscale user %s", name)
+	return id, nil
+}
+
+// listUsers returns every Headscale user, following pagination.
+func listUsers(ctx context.Context) ([]User, error) {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	pageToken := ""
+	for {
+		usersResp, err := listUsersPage(ctx, apiKey, pageToken)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, usersResp.Users...)
+
+		if usersResp.NextPageToken == "" || usersResp.NextPageToken == pageToken {
+			return users, nil
+		}
+		pageToken = usersResp.NextPageToken
+	}
+}
+
+func deleteUser(ctx context.Context, userID string) error {
+	apiKey, err := getAPIKey()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", headscaleInternalURL+"/api/v1/user/"+url.PathEscape(userID), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHeadscaleAPIError(resp)
+	}
+
+	return nil
+}
+
+// createdUserStore remembers the Headscale users we created, by name. User
+// GC only ever deletes these, so users created by operators or other tools
+// are left alone however they are named. Once loaded from a file, every
+// change is written back to it so that GC still recognizes our users after
+// a restart.
+type createdUserStore struct {
+	mutex sync.Mutex
+	path  string
+	names map[string]bool
+}
+
+var createdUsers createdUserStore
+
+// load reads the users recorded in path and keeps path to save changes to.
+func (u *createdUserStore) load(path string) error {
+	var names []string
+	if err := readStateFile(path, &names); err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.path = path
+	u.names = make(map[string]bool, len(names))
+	for _, name := range names {
+		u.names[name] = true
+	}
+	return nil
+}
+
+// save writes the recorded users back to the file they were loaded from, if
+// any. The caller must hold the mutex.
+func (u *createdUserStore) save() {
+	if u.path == "" {
+		return
+	}
+	names := make([]string, 0, len(u.names))
+	for name := range u.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := writeStateFile(u.path, names); err != nil {
+		log.Printf("Warning: failed to save created Headscale users: %v", err)
+	}
+}
+
+func (u *createdUserStore) add(name string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.names == nil {
+		u.names = make(map[string]bool)
+	}
+	u.names[name] = true
+	u.save()
+}
+
+// created reports whether we created the user name.
+func (u *createdUserStore) created(name string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.names[name]
+}
+
+func (u *createdUserStore) forget(name string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if !u.names[name] {
+		return
+	}
+	delete(u.names, name)
+	u.save()
+}
+
+// collectIdleUsers deletes users we created that have no nodes, no pre-auth
+// key that could still register one, and no activity for longer than idle.
+// Activity is taken from Headscale: the user's creation or its newest key,
+// whichever is later, as every bootstrap issues a key. Users Headscale
+// reports no timestamps for are kept. "default" is never deleted.
+func collectIdleUsers(ctx context.Context, idle time.Duration) (int, error) {
+	users, err := listUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	hsNodes, err := getHeadscaleNodes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	hasNodes := make(map[string]bool)
+	for _, hsNode := range hsNodes {
+		hasNodes[hsNode.User.ID] = true
+	}
+
+	now := time.Now()
+	deleted := 0
+	for _, user := range users {
+		if !createdUsers.created(user.Name) || user.Name == "default" || hasNodes[user.ID] {
+			continue
+		}
+		var lastActive time.Time
+		if user.CreatedAt != nil {
+			lastActive = *user.CreatedAt
+			if now.Sub(lastActive) < idle {
+				continue
+			}
+		}
+
+		keys, err := listPreAuthKeys(ctx, user.ID)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list pre-auth keys of user %s: %w", user.Name, err)
+		}
+		pending := false
+		for _, key := range keys {
+			if key.Expiration != nil && key.Expiration.After(now) && (key.Reusable || !key.Used) {
+				pending = true
+				break
+			}
+			if key.CreatedAt != nil && key.CreatedAt.After(lastActive) {
+				lastActive = *key.CreatedAt
+			}
+		}
+		if pending || lastActive.IsZero() || now.Sub(lastActive) < idle {
+			continue
+		}
+
+		if err := deleteUser(ctx, user.ID); err != nil {
+			return deleted, fmt.Errorf("failed to delete user %s: %w", user.Name, err)
+		}
+		createdUsers.forget(user.Name)
+		log.Printf("Deleted idle Headscale user %s (last active %s, no nodes)", user.Name, lastActive.Format(time.RFC3339))
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// runUserGC periodically removes idle users we created until ctx is
+// cancelled.
+func runUserGC(ctx context.Context, interval, idle time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		deleted, err := collectIdleUsers(ctx, idle)
+		if err != nil {
+			log.Printf("User cleanup failed after deleting %d users: %v", deleted, err)
+			continue
+		}
+		if deleted > 0 {
+			log.Printf("User cleanup deleted %d idle users", deleted)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetUserIDFollowsPages(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	hs.userPageSize = 2
+	hs.addUser("default", time.Now())
+	hs.addUser("app-a-mongodb", time.Now())
+	want := hs.addUser("app-b-mongodb", time.Now())
+
+	id, err := getUserID(context.Background(), "app-b-mongodb")
+	if err != nil {
+		t.Fatalf("getUserID: %v", err)
+	}
+	if id != want.ID {
+		t.Errorf("got user ID %q, want %q", id, want.ID)
+	}
+	if n := len(hs.requestsTo("GET", "/api/v1/user")); n != 2 {
+		t.Errorf("listed users %d times, want 2 pages", n)
+	}
+}
+
+func TestGetUserIDNotFound(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	hs.userPageSize = 1
+	hs.addUser("default", time.Now())
+	hs.addUser("app-a-mongodb", time.Now())
+
+	_, err := getUserID(context.Background(), "missing")
+	if !errors.Is(err, errUserNotFound) {
+		t.Errorf("got error %v, want errUserNotFound", err)
+	}
+}
+
+func TestCollectIdleUsersOnlyDeletesCreatedUsers(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	ctx := context.Background()
+	longAgo := time.Now().Add(-48 * time.Hour)
+
+	// Looks namespaced, but an operator created it.
+	hs.addUser("ops-mongodb", longAgo)
+
+	ids := map[string]string{}
+	for _, name := range []string{"app-b-mongodb", "app-c-mongodb", "app-d-mongodb", "default"} {
+		id, err := getOrCreateUserID(ctx, name)
+		if err != nil {
+			t.Fatalf("creating user %s: %v", name, err)
+		}
+		ids[name] = id
+	}
+
+	if deleted, err := collectIdleUsers(ctx, time.Hour); err != nil || deleted != 0 {
+		t.Fatalf("right after creation: deleted %d users (%v), want 0", deleted, err)
+	}
+
+	// Make every user we created look created long ago; only the key and
+	// node activity below should keep one alive.
+	for _, name := range []string{"app-b-mongodb", "app-c-mongodb", "app-d-mongodb", "default"} {
+		hs.setUserCreatedAt(name, longAgo)
+	}
+	recent := time.Now().Add(-10 * time.Minute)
+	hs.addKey(ids["app-c-mongodb"], HeadscalePreAuthKey{Expiration: &recent, CreatedAt: &recent})
+	hs.addNode(HeadscaleNode{Name: "mongo-1", User: User{ID: ids["app-d-mongodb"], Name: "app-d-mongodb"}})
+
+	deleted, err := collectIdleUsers(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("collectIdleUsers: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("deleted %d users, want 1", deleted)
+	}
+	want := []string{"ops-mongodb", "app-c-mongodb", "app-d-mongodb", "default"}
+	if got := hs.userNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("remaining users %v, want %v", got, want)
+	}
+	if createdUsers.created("app-b-mongodb") {
+		t.Errorf("deleted user is still recorded")
+	}
+}
+
+func TestCollectIdleUsersAfterRestart(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "created_users.json")
+	if err := createdUsers.load(path); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, err := getOrCreateUserID(ctx, "app-b-mongodb"); err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	hs.addUser("ops-mongodb", time.Now().Add(-48*time.Hour))
+	hs.setUserCreatedAt("app-b-mongodb", time.Now().Add(-48*time.Hour))
+
+	// A freshly started server has seen no activity at all, but Headscale
+	// still knows how long the user has been idle.
+	createdUsers = createdUserStore{}
+	if err := createdUsers.load(path); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if deleted, err := collectIdleUsers(ctx, time.Hour); err != nil || deleted != 1 {
+		t.Fatalf("deleted %d users (%v), want 1", deleted, err)
+	}
+	if got := hs.userNames(); !reflect.DeepEqual(got, []string{"ops-mongodb"}) {
+		t.Errorf("remaining users %v, want only ops-mongodb", got)
+	}
+
+	createdUsers = createdUserStore{}
+	if err := createdUsers.load(path); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if createdUsers.created("app-b-mongodb") {
+		t.Errorf("deleted user is still recorded in %s", path)
+	}
+}
+
+func TestParseUserDefaults(t *testing.T) {
+	defaults, err := parseUserDefaults("displayName=VPC {name}, email={name}@vpc.example")
+	if err != nil {
+		t.Fatalf("parseUserDefaults failed: %v", err)
+	}
+	if want := map[string]string{"displayName": "VPC {name}", "email": "{name}@vpc.example"}; !reflect.DeepEqual(defaults, want) {
+		t.Errorf("got %v, want %v", defaults, want)
+	}
+
+	if _, err := parseUserDefaults("nickname=x"); err == nil {
+		t.Errorf("parseUserDefaults accepted an unknown field")
+	}
+}
+
+func TestCreateUserSendsDefaults(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	headscaleUserDefaults = map[string]string{"displayName": "VPC {name}", "email": "{name}@vpc.example"}
+	t.Cleanup(func() { headscaleUserDefaults = nil })
+
+	if _, err := createUser(context.Background(), "app-a-mongodb"); err != nil {
+		t.Fatalf("createUser: %v", err)
+	}
+	requests := hs.requestsTo("POST", "/api/v1/user")
+	if len(requests) != 1 {
+		t.Fatalf("got %d user creations, want 1", len(requests))
+	}
+	var body map[string]string
+	decodeJSON(t, requests[0].Body, &body)
+	want := map[string]string{"name": "app-a-mongodb", "displayName": "VPC app-a-mongodb", "email": "app-a-mongodb@vpc.example"}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("got body %v, want %v", body, want)
+	}
+}
+
+func TestHeadscaleUserName(t *testing.T) {
+	for _, tc := range []struct {
+		appID, nodeType, want string
+	}{
+		{"myapp", "mongodb", "myapp-mongodb"},
+		{"1a2b3c", "mongodb", "app-1a2b3c-mongodb"},
+		{"MyApp", "", "myapp"},
+		{"my_app", "app", "my-app-app"},
+	} {
+		got, err := headscaleUserName(tc.appID, tc.nodeType)
+		if err != nil || got != tc.want {
+			t.Errorf("headscaleUserName(%q, %q) = %q, %v; want %q", tc.appID, tc.nodeType, got, err, tc.want)
+		}
+	}
+
+	for _, appID := range []string{"", "_", strings.Repeat("a", 70)} {
+		if got, err := headscaleUserName(appID, "mongodb"); err == nil && len(got) > maxUserNameLength {
+			t.Errorf("headscaleUserName(%q) = %q, longer than %d", appID, got, maxUserNameLength)
+		}
+	}
+	if _, err := headscaleUserName("", ""); err == nil {
+		t.Errorf("headscaleUserName accepted an empty app id")
+	}
+}
+
+func TestRegisterNamespacedUsers(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	_, r := newTestServer(t, func(c *Config) { c.NamespacedUsers = true })
+
+	bootstrapNode(t, r, "1a2b3c", "instance_id=i1&node_type=mongodb")
+	bootstrapNode(t, r, "1a2b3c", "instance_id=i2&node_type=mongodb")
+
+	if names := hs.userNames(); !reflect.DeepEqual(names, []string{"app-1a2b3c-mongodb"}) {
+		t.Errorf("got users %v, want app-1a2b3c-mongodb created once", names)
+	}
+	user := hs.userByName("app-1a2b3c-mongodb")
+	for _, key := range hs.preAuthKeys() {
+		if key.UserID != user.ID {
+			t.Errorf("key %s was issued for user %s, want %s", key.ID, key.UserID, user.ID)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BootstrapViolation is one reason a bootstrap request would be rejected.
+type BootstrapViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// maxClientRefLength bounds client_ref, which is stored with the node and
+// returned by /api/nodes.
+const maxClientRefLength = 128
+
+// sanitizeClientRef rejects an over-long client_ref and replaces anything
+// other than letters, digits and "-._:/@" with '_', so the value is safe to
+// log and echo back.
+func sanitizeClientRef(ref string) (string, error) {
+	if len(ref) > maxClientRefLength {
+		return "", fmt.Errorf("client_ref must be at most %d characters long", maxClientRefLength)
+	}
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("-._:/@", r) {
+			return r
+		}
+		return '_'
+	}, ref), nil
+}
+
+// bootstrapViolations checks the app id, node type, node name, client_ref and
+// nonce the way /api/register would, without touching Headscale, the shared
+// key files, the registered nodes or the used nonces. It returns the node
+// type and name the request would end up with.
+func (s *AppState) bootstrapViolations(appID, instanceID, nodeType, nodeName, clientRef, nonce string) (string, string, []BootstrapViolation) {
+	var violations []BootstrapViolation
+
+	// The auth middleware lets disallowed apps through when AUTH_ENFORCE is
+	// off; report them anyway so callers see what enforcement would do.
+	if !s.isAppAllowed(appID) {
+		violations = append(violations, BootstrapViolation{"app_id", fmt.Sprintf("app %q is not in ALLOWED_APPS", appID)})
+	} else if s.sharedKeys.perApp && !validAppID.MatchString(appID) {
+		violations = append(violations, BootstrapViolation{"app_id", "Invalid app id for keyfile"})
+	}
+
+	if instanceID == "" {
+		violations = append(violations, BootstrapViolation{"instance_id", "Missing required parameter"})
+	}
+
+	if _, err := sanitizeClientRef(clientRef); err != nil {
+		violations = append(violations, BootstrapViolation{"client_ref", err.Error()})
+	}
+
+	if len(nonce) > maxNonceLength {
+		violations = append(violations, BootstrapViolation{"nonce", fmt.Sprintf("nonce must be at most %d characters long", maxNonceLength)})
+	}
+
+	if nodeType == "" {
+		nodeType = s.config.DefaultNodeType
+	}
+	if nodeType != "" && !s.isNodeTypeAllowed(nodeType) {
+		violations = append(violations, BootstrapViolation{"node_type", fmt.Sprintf("Invalid node_type, must be one of %v", s.config.AllowedNodeTypes)})
+	} else if !s.isAppAllowedForType(appID, nodeType) {
+		violations = append(violations, BootstrapViolation{"node_type", fmt.Sprintf("App %s may not bootstrap %s nodes", appID, nodeType)})
+	}
+
+	if s.config.NamespacedUsers {
+		if _, err := headscaleUserName(appID, nodeType); err != nil {
+			violations = append(violations, BootstrapViolation{"app_id", err.Error()})
+		}
+	}
+
+	if nodeName == "" && instanceID != "" {
+		if s.config.NodeNameTemplate != "" {
+			rendered, err := renderNodeName(s.config.NodeNameTemplate, nodeType, instanceID)
+			if err != nil {
+				violations = append(violations, BootstrapViolation{"node_name", "Failed to derive node name, please provide node_name"})
+			}
+			nodeName = rendered
+		} else {
+			nodeName = fmt.Sprintf("node-%s", instanceID)
+		}
+	}
+
+	return nodeType, nodeName, violations
+}
+
+// handleValidateBootstrap reports whether a bootstrap request with the same
+// query parameters would be accepted, so admission controllers can pre-check
+// it cheaply. Checks that need Headscale (quotas, ACL tags) are not run.
+func (s *AppState) handleValidateBootstrap(c *gin.Context) {
+	nodeType, nodeName, violations := s.bootstrapViolations(
+		c.GetHeader("x-dstack-app-id"),
+		c.Query("instance_id"),
+		s.canonicalNodeType(c.Query("node_type")),
+		c.Query("node_name"),
+		c.Query("client_ref"),
+		c.Query("nonce"),
+	)
+	if len(violations) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bootstrap parameters", "violations": violations})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true, "node_type": nodeType, "node_name": nodeName})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidateBootstrapHasNoSideEffects(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, func(c *Config) { c.DefaultNodeType = "app" })
+
+	w := serve(r, newRequest("POST", "/api/bootstrap/validate?instance_id=i1&nonce=n-1"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Valid    bool   `json:"valid"`
+		NodeType string `json:"node_type"`
+		NodeName string `json:"node_name"`
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if !resp.Valid || resp.NodeType != "app" || resp.NodeName != "node-i1" {
+		t.Errorf("got %+v, want a valid app node named node-i1", resp)
+	}
+
+	hs.mutex.Lock()
+	requests := len(hs.requests)
+	hs.mutex.Unlock()
+	if requests != 0 {
+		t.Errorf("validation sent %d requests to Headscale", requests)
+	}
+	if _, ok := state.storedNode("i1"); ok {
+		t.Errorf("validation registered the node")
+	}
+	if w := serve(r, newRequest("GET", "/api/register?instance_id=i1&nonce=n-1")); w.Code != http.StatusOK {
+		t.Errorf("bootstrap with the validated nonce: got status %d, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestValidateBootstrapReportsViolations(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	w := serve(r, newRequest("POST", "/api/bootstrap/validate?node_type=redis"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want 400", w.Code)
+	}
+	var resp struct {
+		Violations []BootstrapViolation `json:"violations"`
+	}
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	fields := map[string]bool{}
+	for _, v := range resp.Violations {
+		fields[v.Field] = true
+	}
+	if !fields["instance_id"] || !fields["node_type"] || len(fields) != 2 {
+		t.Errorf("got violations %+v, want instance_id and node_type", resp.Violations)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Headscale minor versions this server's API structs were tested against.
+var (
+	minTestedHeadscale = [2]int{0, 26}
+	maxTestedHeadscale = [2]int{0, 27}
+)
+
+type HeadscaleVersionResponse struct {
+	Version string `json:"version"`
+}
+
+func getHeadscaleVersion(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", headscaleInternalURL+"/version", nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := headscaleClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("headscale API request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newHeadscaleAPIError(resp)
+	}
+
+	var versionResp HeadscaleVersionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&versionResp); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if versionResp.Version == "" {
+		return "", fmt.Errorf("empty version in response")
+	}
+
+	return versionResp.Version, nil
+}
+
+// parseMinorVersion extracts major and minor from versions like "v0.26.1" or
+// "0.26.1-dstack".
+func parseMinorVersion(version string) ([2]int, error) {
+	v := strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) < 2 {
+		return [2]int{}, fmt.Errorf("unrecognized version %q", version)
+	}
+
+	var result [2]int
+	for i := 0; i < 2; i++ {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return [2]int{}, fmt.Errorf("unrecognized version %q", version)
+		}
+		result[i] = n
+	}
+	return result, nil
+}
+
+func compareMinorVersion(a, b [2]int) int {
+	if a[0] != b[0] {
+		return a[0] - b[0]
+	}
+	return a[1] - b[1]
+}
+
+// checkHeadscaleVersion logs the Headscale version and warns when it is
+// outside the range our API structs were tested against, since field names
+// differ between versions and mismatches decode silently as empty values.
+func checkHeadscaleVersion(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	version, err := getHeadscaleVersion(ctx)
+	if err != nil {
+		log.Printf("Warning: could not detect Headscale version: %v", err)
+		return
+	}
+
+	parsed, err := parseMinorVersion(version)
+	if err != nil {
+		log.Printf("Warning: %v, cannot check Headscale compatibility", err)
+		return
+	}
+
+	if compareMinorVersion(parsed, minTestedHeadscale) < 0 || compareMinorVersion(parsed, maxTestedHeadscale) > 0 {
+		log.Printf("Warning: Headscale %s is outside the tested range v%d.%d-v%d.%d, API responses may not parse correctly",
+			version, minTestedHeadscale[0], minTestedHeadscale[1], maxTestedHeadscale[0], maxTestedHeadscale[1])
+		return
+	}
+
+	log.Printf("Detected Headscale %s", version)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseMinorVersion(t *testing.T) {
+	tests := map[string][2]int{
+		"v0.26.1":        {0, 26},
+		"0.27.0-dstack":  {0, 27},
+		"v1.0.0+build.5": {1, 0},
+	}
+	for version, want := range tests {
+		got, err := parseMinorVersion(version)
+		if err != nil || got != want {
+			t.Errorf("parseMinorVersion(%q) = %v, %v, want %v", version, got, err, want)
+		}
+	}
+	for _, version := range []string{"", "dev", "v0.x.1"} {
+		if _, err := parseMinorVersion(version); err == nil {
+			t.Errorf("parseMinorVersion(%q): got no error", version)
+		}
+	}
+}
+
+func TestCheckHeadscaleVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		warn    bool
+	}{
+		{"v0.26.1", false},
+		{"v0.27.0", false},
+		{"v0.23.0", true},
+		{"v0.28.0", true},
+		{"unknown", true},
+	}
+	for _, tt := range tests {
+		hs := newFakeHeadscale(t)
+		hs.version = tt.version
+		logs := captureLog(t)
+
+		checkHeadscaleVersion(context.Background())
+		if warned := strings.Contains(logs.String(), "Warning"); warned != tt.warn {
+			t.Errorf("Headscale %s: warned=%t, want %t: %s", tt.version, warned, tt.warn, logs)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bounds for bootstrap with wait=active.
+const (
+	defaultBootstrapWait  = 60 * time.Second
+	maxBootstrapWait      = 5 * time.Minute
+	bootstrapWaitInterval = time.Second
+)
+
+// Progress events of a bootstrap streamed with Accept: text/event-stream, in
+// the order they are sent. The stream ends after active or timeout.
+const (
+	bootstrapKeyGenerated = "key_generated"
+	bootstrapRegistered   = "registered"
+	bootstrapIPAssigned   = "ip_assigned"
+	bootstrapActive       = "active"
+	bootstrapTimeout      = "timeout"
+)
+
+// waitForActive waits until the registered node with the given uuid reaches
+// active status, the timeout passes or ctx is cancelled. It reads the
+// background poll's results rather than querying Headscale itself, asking
+// for early polls that concurrent waiters share. It returns the node's last
+// known state and whether it became active. If observe is set it is called
+// with every polled state of the node and whether Headscale knows it yet.
+func (s *AppState) waitForActive(ctx context.Context, uuid string, timeout time.Duration, observe func(node NodeInfo, inHeadscale bool)) (NodeInfo, bool) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var last NodeInfo
+	for {
+		synced := s.watcher.requestSync()
+		if node, ok := s.watcher.node(uuid); ok {
+			last = node
+			if observe != nil {
+				observe(node, node.inHeadscale)
+			}
+			if node.Status == statusActive {
+				return node, true
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if last.UUID == "" {
+				last, _ = s.storedNode(uuid)
+				last.Status = statusPending
+			}
+			return last, false
+		case <-synced:
+		}
+	}
+}
+
+// streamBootstrap sends the bootstrap response as a key_generated event and
+// then a registered, ip_assigned and active event as the node comes up, so
+// provisioning UIs get live feedback. If the node isn't active within
+// timeout the stream ends with a timeout event carrying its last state.
+func (s *AppState) streamBootstrap(c *gin.Context, response BootstrapResponse, uuid string, timeout time.Duration) {
+	c.Header("Cache-Control", "no-cache")
+	c.SSEvent(bootstrapKeyGenerated, response)
+	c.Writer.Flush()
+
+	registered, ipAssigned := false, false
+	node, active := s.waitForActive(c.Request.Context(), uuid, timeout, func(node NodeInfo, inHeadscale bool) {
+		if inHeadscale && !registered {
+			registered = true
+			c.SSEvent(bootstrapRegistered, node)
+		}
+		if node.TailscaleIP != nil && !ipAssigned {
+			ipAssigned = true
+			c.SSEvent(bootstrapIPAssigned, node)
+		}
+		c.Writer.Flush()
+	})
+
+	if active {
+		c.SSEvent(bootstrapActive, node)
+	} else {
+		c.SSEvent(bootstrapTimeout, node)
+	}
+	c.Writer.Flush()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runPoller runs the background node poll for the duration of the test. The
+// interval is long so that only early polls requested by waiters happen.
+func runPoller(t *testing.T, state *AppState) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		state.pollNodes(ctx, time.Hour)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestWaitActiveSharesPolls(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	runPoller(t, state)
+
+	const waiters = 5
+	codes := make([]int, waiters)
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := serve(r, newRequest("GET", fmt.Sprintf("/api/register?instance_id=i%d&node_name=n%d&wait=active&timeout=10s", i, i)))
+			codes[i] = w.Code
+		}(i)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	before := len(hs.requestsTo("GET", "/api/v1/node"))
+	for i := 0; i < waiters; i++ {
+		hs.addNode(HeadscaleNode{Name: fmt.Sprintf("n%d", i), Online: true})
+	}
+	start := time.Now()
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("waiter %d: got status %d, want 200", i, code)
+		}
+	}
+	// One shared poll per interval at most, however many waiters there are.
+	polls := len(hs.requestsTo("GET", "/api/v1/node")) - before
+	if max := int(elapsed/bootstrapWaitInterval) + 2; polls > max {
+		t.Errorf("%d waiters caused %d node listings in %s, want at most %d", waiters, polls, elapsed, max)
+	}
+}
+
+func TestWaitActiveTimesOut(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	w := serve(r, newRequest("GET", "/api/register?instance_id=i1&node_name=n1&wait=active&timeout=200ms"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want 202: %s", w.Code, w.Body)
+	}
+	var resp BootstrapResponse
+	decodeJSON(t, w.Body.Bytes(), &resp)
+	if resp.PreAuthKey == "" || resp.Node == nil || resp.Node.Status != statusPending {
+		t.Errorf("got %+v, want a key and a pending node", resp)
+	}
+}
+
+// sseEvent is one server-sent event read by readSSE.
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readSSE returns the next event from an event stream.
+func readSSE(t *testing.T, reader *bufio.Reader) sseEvent {
+	t.Helper()
+	var event sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && event.name != "":
+			return event
+		case strings.HasPrefix(line, "event:"):
+			event.name = strings.TrimPrefix(line, "event:")
+		case strings.HasPrefix(line, "data:"):
+			event.data = strings.TrimPrefix(line, "data:")
+		}
+	}
+}
+
+func TestBootstrapStreamsProgress(t *testing.T) {
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	runPoller(t, state)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/api/register?instance_id=i1&node_name=n1&timeout=30s", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("x-dstack-app-id", testAppID)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("got status %d and content type %q, want an event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	event := readSSE(t, reader)
+	var bootstrap BootstrapResponse
+	decodeJSON(t, []byte(event.data), &bootstrap)
+	if event.name != bootstrapKeyGenerated || bootstrap.PreAuthKey == "" {
+		t.Fatalf("got first event %s %s, want key_generated with a pre-auth key", event.name, event.data)
+	}
+
+	// Each change is made only after the previous event arrived, so every
+	// event comes from its own poll.
+	hs.addNode(HeadscaleNode{Name: "n1", IPAddresses: []string{}})
+	if event := readSSE(t, reader); event.name != bootstrapRegistered {
+		t.Fatalf("got event %s %s, want registered", event.name, event.data)
+	}
+
+	hs.updateNodes("n1", func(n *HeadscaleNode) { n.IPAddresses = []string{"100.64.0.9"} })
+	event = readSSE(t, reader)
+	var node NodeInfo
+	decodeJSON(t, []byte(event.data), &node)
+	if event.name != bootstrapIPAssigned || node.TailscaleIP == nil || *node.TailscaleIP != "100.64.0.9" {
+		t.Fatalf("got event %s %s, want ip_assigned with 100.64.0.9", event.name, event.data)
+	}
+
+	hs.updateNodes("n1", func(n *HeadscaleNode) { n.Online = true })
+	event = readSSE(t, reader)
+	decodeJSON(t, []byte(event.data), &node)
+	if event.name != bootstrapActive || node.Status != statusActive {
+		t.Fatalf("got event %s %s, want active", event.name, event.data)
+	}
+	if rest, _ := io.ReadAll(reader); len(strings.TrimSpace(string(rest))) != 0 {
+		t.Errorf("stream continued after active: %q", rest)
+	}
+}
+
+func TestBootstrapStreamTimesOut(t *testing.T) {
+	newFakeHeadscale(t)
+	_, r := newTestServer(t, nil)
+
+	req := newRequest("GET", "/api/register?instance_id=i1&node_name=n1&timeout=200ms")
+	req.Header.Set("Accept", "text/event-stream")
+	w := serve(r, req)
+	reader := bufio.NewReader(w.Body)
+	if event := readSSE(t, reader); event.name != bootstrapKeyGenerated {
+		t.Fatalf("got event %s, want key_generated", event.name)
+	}
+	event := readSSE(t, reader)
+	var node NodeInfo
+	decodeJSON(t, []byte(event.data), &node)
+	if event.name != bootstrapTimeout || node.Status != statusPending {
+		t.Errorf("got event %s %s, want timeout with a pending node", event.name, event.data)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// warmupRetryInterval is how often warmUp retries Headscale until it answers.
+const warmupRetryInterval = 2 * time.Second
+
+// warmUp waits until the Headscale API answers an authenticated request,
+// loads the initial node list into the watcher and then marks the server
+// ready. Until then /ready reports 503, so orchestrators don't route traffic
+// to a server whose Headscale is still starting or that has no node data
+// to fall back on yet. It gives up when ctx is cancelled.
+func (s *AppState) warmUp(ctx context.Context) {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		nodes, err := s.mergedNodes(attemptCtx, false)
+		cancel()
+		if err == nil {
+			s.watcher.update(nodes)
+			break
+		}
+		if attempt == 1 || attempt%15 == 0 {
+			log.Printf("Waiting for Headscale API (attempt %d): %v", attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(warmupRetryInterval):
+		}
+	}
+
+	s.warm.Store(true)
+	log.Printf("Headscale API is up and nodes are synced after %s, server is ready", time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWarmUpGatesReadiness(t *testing.T) {
+	t.Setenv("VPC_SERVER_URL", "https://headscale.example")
+	hs := newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	addTestNode(state, hs, NodeInfo{UUID: "i1", Name: "mongo-1", NodeType: "mongodb"})
+
+	if w := serve(r, httptest.NewRequest("GET", "/ready", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("before warm-up: got status %d, want 503", w.Code)
+	}
+
+	state.warmUp(context.Background())
+
+	if w := serve(r, httptest.NewRequest("GET", "/ready", nil)); w.Code != http.StatusOK {
+		t.Errorf("after warm-up: got status %d, want 200: %s", w.Code, w.Body)
+	}
+	if nodes, lastSync := state.watcher.snapshot(); len(nodes) != 1 || lastSync.IsZero() {
+		t.Errorf("warm-up did not sync the watcher: %d nodes, last sync %v", len(nodes), lastSync)
+	}
+}
+
+func TestWarmUpStopsOnCancel(t *testing.T) {
+	t.Setenv("VPC_SERVER_URL", "https://headscale.example")
+	hs := newFakeHeadscale(t)
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		writeFakeJSON(w, http.StatusServiceUnavailable, map[string]any{"message": "starting"})
+		return true
+	})
+	state, r := newTestServer(t, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		state.warmUp(ctx)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("warmUp did not return after cancellation")
+	}
+
+	if w := serve(r, httptest.NewRequest("GET", "/ready", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("after a failed warm-up: got status %d, want 503", w.Code)
+	}
+}
+
+func TestWarmUpWaitsForNodeSync(t *testing.T) {
+	t.Setenv("VPC_SERVER_URL", "https://headscale.example")
+	hs := newFakeHeadscale(t)
+	hs.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/api/v1/node" {
+			return false
+		}
+		writeFakeJSON(w, http.StatusInternalServerError, map[string]any{"message": "database is locked"})
+		return true
+	})
+	state, r := newTestServer(t, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	state.warmUp(ctx)
+
+	if w := serve(r, httptest.NewRequest("GET", "/ready", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("without a node sync: got status %d, want 503", w.Code)
+	}
+	if _, lastSync := state.watcher.snapshot(); !lastSync.IsZero() {
+		t.Errorf("watcher was synced at %v", lastSync)
+	}
+	if len(hs.requestsTo("GET", "/api/v1/node")) == 0 {
+		t.Errorf("warm-up never listed the Headscale nodes")
+	}
+}
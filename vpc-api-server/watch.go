@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultWatchTimeout = 5 * time.Minute
+	maxWatchTimeout     = 30 * time.Minute
+
+	// watchBufferSize is how many events a watcher may fall behind before it
+	// is disconnected and has to reconnect for a fresh snapshot.
+	watchBufferSize = 64
+)
+
+// Node change event types streamed by /api/nodes/watch.
+const (
+	nodeAdded   = "added"
+	nodeUpdated = "updated"
+	nodeRemoved = "removed"
+)
+
+type NodeEvent struct {
+	Type string   `json:"type"`
+	Node NodeInfo `json:"node"`
+}
+
+// nodeWatcher keeps the last polled node set and fans out changes to
+// subscribers of /api/nodes/watch.
+type nodeWatcher struct {
+	mutex       sync.Mutex
+	last        map[string]NodeInfo
+	lastSync    time.Time
+	subscribers map[chan NodeEvent]struct{}
+
+	// refresh asks pollNodes for an early poll. synced is closed and
+	// replaced after every update, waking everyone waiting for a poll.
+	refresh chan struct{}
+	synced  chan struct{}
+}
+
+func newNodeWatcher() *nodeWatcher {
+	return &nodeWatcher{
+		last:        make(map[string]NodeInfo),
+		subscribers: make(map[chan NodeEvent]struct{}),
+		refresh:     make(chan struct{}, 1),
+		synced:      make(chan struct{}),
+	}
+}
+
+// requestSync asks for an early poll and returns a channel that is closed
+// once the next poll has been applied. Requests made before that poll
+// starts share it.
+func (w *nodeWatcher) requestSync() <-chan struct{} {
+	w.mutex.Lock()
+	synced := w.synced
+	w.mutex.Unlock()
+
+	select {
+	case w.refresh <- struct{}{}:
+	default:
+	}
+	return synced
+}
+
+// node returns the node with the given uuid as of the last poll.
+func (w *nodeWatcher) node(uuid string) (NodeInfo, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	node, ok := w.last[uuid]
+	return node, ok
+}
+
+// subscribe registers a new subscriber and returns it together with a
+// snapshot of the current node set, so no change is missed in between.
+func (w *nodeWatcher) subscribe() (chan NodeEvent, []NodeInfo) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	ch := make(chan NodeEvent, watchBufferSize)
+	w.subscribers[ch] = struct{}{}
+
+	return ch, w.snapshotLocked()
+}
+
+// snapshot returns the last polled node set, sorted by name, and the time
+// of that poll. The time is zero until the first successful poll.
+func (w *nodeWatcher) snapshot() ([]NodeInfo, time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.snapshotLocked(), w.lastSync
+}
+
+func (w *nodeWatcher) snapshotLocked() []NodeInfo {
+	snapshot := make([]NodeInfo, 0, len(w.last))
+	for _, node := range w.last {
+		snapshot = append(snapshot, node)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Name < snapshot[j].Name })
+	return snapshot
+}
+
+func (w *nodeWatcher) unsubscribe(ch chan NodeEvent) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, ok := w.subscribers[ch]; ok {
+		delete(w.subscribers, ch)
+		close(ch)
+	}
+}
+
+// closeAll disconnects every subscriber, ending their streams.
+func (w *nodeWatcher) closeAll() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for ch := range w.subscribers {
+		delete(w.subscribers, ch)
+		close(ch)
+	}
+}
+
+// update replaces the current node set and notifies subscribers of the
+// difference.
+func (w *nodeWatcher) update(nodes []NodeInfo) {
+	current := make(map[string]NodeInfo, len(nodes))
+	for _, node := range nodes {
+		// Watchers get what a plain listing shows.
+		node.Debug = nil
+		node.BootstrapIP = ""
+		current[node.UUID] = node
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var events []NodeEvent
+	for id, node := range current {
+		prev, ok := w.last[id]
+		switch {
+		case !ok:
+			events = append(events, NodeEvent{Type: nodeAdded, Node: node})
+		case !sameNode(prev, node):
+			events = append(events, NodeEvent{Type: nodeUpdated, Node: node})
+		}
+	}
+	for id, node := range w.last {
+		if _, ok := current[id]; !ok {
+			events = append(events, NodeEvent{Type: nodeRemoved, Node: node})
+		}
+	}
+	w.last = current
+	w.lastSync = time.Now()
+	close(w.synced)
+	w.synced = make(chan struct{})
+
+	for ch := range w.subscribers {
+		for _, event := range events {
+			select {
+			case ch <- event:
+				continue
+			default:
+			}
+			// Too slow to keep up; drop it so it reconnects.
+			delete(w.subscribers, ch)
+			close(ch)
+			break
+		}
+	}
+}
+
+func sameNode(a, b NodeInfo) bool {
+	ipA, ipB := "", ""
+	if a.TailscaleIP != nil {
+		ipA = *a.TailscaleIP
+	}
+	if b.TailscaleIP != nil {
+		ipB = *b.TailscaleIP
+	}
+	return a.Name == b.Name && a.NodeType == b.NodeType && a.Online == b.Online && a.Draining == b.Draining && a.Status == b.Status && ipA == ipB
+}
+
+// pollNodes periodically merges the node list with Headscale and feeds the
+// result to the watcher, until ctx is cancelled. Bootstrap waiters can ask
+// for an early poll; those come at most every bootstrapWaitInterval however
+// many waiters there are.
+func (s *AppState) pollNodes(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		polledAt := time.Now()
+		nodes, err := s.mergedNodes(ctx, false)
+		if err != nil {
+			log.Printf("Node poll failed: %v", err)
+		} else {
+			s.watcher.update(nodes)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.watcher.refresh:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(polledAt.Add(bootstrapWaitInterval))):
+			}
+		}
+	}
+}
+
+// handleWatchNodes streams an initial snapshot followed by node changes as
+// server-sent events. The stream ends after the requested timeout so clients
+// reconnect periodically.
+func (s *AppState) handleWatchNodes(c *gin.Context) {
+	timeout := defaultWatchTimeout
+	if t := c.Query("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timeout"})
+			return
+		}
+		if d > maxWatchTimeout {
+			d = maxWatchTimeout
+		}
+		timeout = d
+	}
+
+	events, snapshot := s.watcher.subscribe()
+	defer s.watcher.unsubscribe(events)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.SSEvent("snapshot", NodesResponse{Nodes: snapshot})
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Type, event.Node)
+			return true
+		case <-deadline.C:
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNodeWatcherEvents(t *testing.T) {
+	w := newNodeWatcher()
+	w.update([]NodeInfo{{UUID: "i1", Name: "mongo-1"}, {UUID: "i2", Name: "mongo-2"}})
+	events, snapshot := w.subscribe()
+	if len(snapshot) != 2 {
+		t.Fatalf("got a snapshot of %d nodes, want 2", len(snapshot))
+	}
+
+	seen := time.Now()
+	w.update([]NodeInfo{
+		{UUID: "i1", Name: "mongo-1", LastSeen: &seen},
+		{UUID: "i2", Name: "mongo-2", Online: true},
+		{UUID: "i3", Name: "mongo-3"},
+	})
+	w.update([]NodeInfo{{UUID: "i2", Name: "mongo-2", Online: true}, {UUID: "i3", Name: "mongo-3"}})
+
+	got := map[string]string{}
+	for len(events) > 0 {
+		event := <-events
+		got[event.Node.UUID+" "+event.Type] = event.Node.Name
+	}
+	want := map[string]string{"i2 updated": "mongo-2", "i3 added": "mongo-3", "i1 removed": "mongo-1"}
+	if len(got) != len(want) {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+	for key := range want {
+		if _, ok := got[key]; !ok {
+			t.Errorf("missing event %q in %v", key, got)
+		}
+	}
+}
+
+func TestNodeWatcherDropsSlowSubscribers(t *testing.T) {
+	w := newNodeWatcher()
+	events, _ := w.subscribe()
+
+	for i := 0; i <= watchBufferSize; i++ {
+		w.update([]NodeInfo{{UUID: "i1", Name: "mongo-1", Online: i%2 == 0}})
+	}
+
+	received := 0
+	for range events {
+		received++
+	}
+	if received != watchBufferSize {
+		t.Errorf("received %d events before the stream closed, want %d", received, watchBufferSize)
+	}
+}
+
+func TestWatchNodesStream(t *testing.T) {
+	newFakeHeadscale(t)
+	state, r := newTestServer(t, nil)
+	state.watcher.update([]NodeInfo{{UUID: "i1", Name: "mongo-1", Debug: &NodeDebugInfo{}, BootstrapIP: "203.0.113.7"}})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/api/nodes/watch?timeout=10s", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("x-dstack-app-id", testAppID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	event := readSSE(t, reader)
+	var snapshot NodesResponse
+	decodeJSON(t, []byte(event.data), &snapshot)
+	if event.name != "snapshot" || len(snapshot.Nodes) != 1 {
+		t.Fatalf("got first event %s %s, want a snapshot of mongo-1", event.name, event.data)
+	}
+	if node := snapshot.Nodes[0]; node.Debug != nil || node.BootstrapIP != "" {
+		t.Errorf("snapshot shows debug details: %+v", node)
+	}
+
+	state.watcher.update([]NodeInfo{{UUID: "i1", Name: "mongo-1", Online: true}})
+	event = readSSE(t, reader)
+	var node NodeInfo
+	decodeJSON(t, []byte(event.data), &node)
+	if event.name != nodeUpdated || !node.Online {
+		t.Errorf("got event %s %s, want mongo-1 updated to online", event.name, event.data)
+	}
+
+	// Shutdown ends open streams.
+	state.watcher.closeAll()
+	done := make(chan struct{})
+	go func() {
+		reader.ReadString(0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the stream stayed open after closeAll")
+	}
+}